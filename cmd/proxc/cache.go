@@ -0,0 +1,810 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	cli "github.com/urfave/cli/v2"
+	"github.com/wenerme/proxc/har"
+	"github.com/wenerme/proxc/httpcache/dbcache"
+	"github.com/wenerme/proxc/httpcache/dbcache/models"
+	"github.com/wenerme/proxc/httpcache/dbcache/sqlitecache"
+	"github.com/wenerme/proxc/httpcache/reqtrace"
+	"github.com/wenerme/proxc/proxc"
+	"gorm.io/gorm"
+)
+
+var cacheCommand = &cli.Command{
+	Name:  "cache",
+	Usage: "inspect and maintain the cache in db dir, without starting the proxy",
+	Subcommands: cli.Commands{
+		{
+			Name:      "ls",
+			Usage:     "list hosts, or responses of host",
+			ArgsUsage: "[host]",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "prefix", Usage: "filter by url prefix"},
+				&cli.IntFlag{Name: "offset"},
+				&cli.IntFlag{Name: "limit", Value: 100},
+			},
+			Action: runCacheList,
+		},
+		{
+			Name:      "show",
+			Usage:     "show the cached response",
+			ArgsUsage: "<url>",
+			Flags: append([]cli.Flag{
+				&cli.BoolFlag{Name: "body", Usage: "only print the decoded body"},
+				&cli.BoolFlag{Name: "head", Usage: "only print the status and headers"},
+				&cli.BoolFlag{Name: "request", Usage: "print the originating request, client address and timings"},
+			}, versionFlags...),
+			Action: runCacheShow,
+		},
+		{
+			Name:      "rm",
+			Usage:     "remove cached responses by url, url prefix, path prefix of the url host or host",
+			ArgsUsage: "[url]",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "method", Usage: "only remove the method, default to all"},
+				&cli.StringFlag{Name: "host", Usage: "remove the host db"},
+				&cli.StringFlag{Name: "prefix", Usage: "remove by url prefix, or by path prefix if the url is given"},
+			},
+			Action: runCacheRemove,
+		},
+		{
+			Name:      "stats",
+			Usage:     "show stats of hosts",
+			ArgsUsage: "[host...]",
+			Action:    runCacheStats,
+		},
+		{
+			Name:      "vacuum",
+			Usage:     "vacuum dbs to reclaim space",
+			ArgsUsage: "[host...]",
+			Action:    runCacheVacuum,
+		},
+		{
+			Name:  "evict",
+			Usage: "evict responses exceed the limits and collect unreferenced files, default to the evict config",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "max-size", Usage: "max total size, e.g. 10G"},
+				&cli.StringFlag{Name: "max-host-size", Usage: "max size per host, e.g. 1G"},
+				&cli.Int64Flag{Name: "max-entries", Usage: "max number of responses"},
+				&cli.DurationFlag{Name: "max-age", Usage: "evict responses not accessed within, e.g. 720h"},
+				&cli.StringFlag{Name: "policy", Usage: "lru or lfu"},
+			},
+			Action: runCacheEvict,
+		},
+		{
+			Name:  "fsck",
+			Usage: "check dangling, orphan and corrupted files",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{Name: "repair", Usage: "delete orphans, corrupted files and the responses referencing missing or corrupted files"},
+			},
+			Action: runCacheFsck,
+		},
+		{
+			Name:   "migrate-blobs",
+			Usage:  "move inline file content to blob dir",
+			Action: runCacheMigrateBlobs,
+		},
+		{
+			Name:  "versions",
+			Usage: "list, diff and pin response versions, recorded by --history or record mode",
+			Subcommands: cli.Commands{
+				{
+					Name:      "ls",
+					Usage:     "list versions of the response, latest first",
+					ArgsUsage: "<url>",
+					Flags:     versionFlags,
+					Action:    runCacheVersionList,
+				},
+				{
+					Name:      "diff",
+					Usage:     "diff status, headers and body of two versions, compare to current response if to is omitted",
+					ArgsUsage: "<url> <from> [to]",
+					Flags:     versionFlags,
+					Action:    runCacheVersionDiff,
+				},
+				{
+					Name:      "pin",
+					Usage:     "serve the version and keep it from being overwritten",
+					ArgsUsage: "<url> <version>",
+					Flags:     []cli.Flag{&cli.StringFlag{Name: "method", Value: http.MethodGet}},
+					Action:    runCacheVersionPin,
+				},
+				{
+					Name:      "unpin",
+					Usage:     "allow the response to be overwritten again",
+					ArgsUsage: "<url>",
+					Flags:     versionFlags,
+					Action:    runCacheVersionUnpin,
+				},
+			},
+		},
+		{
+			Name:  "har",
+			Usage: "import or export HAR (HTTP Archive) files",
+			Subcommands: cli.Commands{
+				{
+					Name:      "export",
+					Usage:     "export responses of host to HAR",
+					ArgsUsage: "<host>",
+					Flags: []cli.Flag{
+						&cli.StringFlag{Name: "prefix", Usage: "filter by url prefix"},
+						&cli.StringFlag{Name: "output", Aliases: []string{"o"}, Usage: "output file, default to stdout"},
+						&cli.Int64Flag{Name: "max-body-size", Value: dbcache.DefaultLargeBodySize, Usage: "max size of body to export, larger body is omitted"},
+					},
+					Action: runCacheHARExport,
+				},
+				{
+					Name:      "import",
+					Usage:     "import HAR files into cache",
+					ArgsUsage: "<file...>",
+					Flags: []cli.Flag{
+						&cli.StringSliceFlag{Name: "method", Value: cli.NewStringSlice(http.MethodGet), Usage: "methods to import"},
+					},
+					Action: runCacheHARImport,
+				},
+			},
+		},
+	},
+}
+
+// versionFlags select the response variant of the url
+var versionFlags = []cli.Flag{
+	&cli.StringFlag{Name: "method", Value: http.MethodGet},
+	&cli.StringFlag{Name: "vary", Usage: "vary key of the variant, required if there are multiple"},
+}
+
+// cacheKey resolve the url to the cache key by the configured key normalization and rules
+func cacheKey(method string, u string) (key string, err error) {
+	keyFunc, err := _conf.KeyFunc()
+	if err != nil {
+		return
+	}
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return
+	}
+	return keyFunc(req), nil
+}
+
+// cacheVariant return the cache key of url and the vary key of --vary or the only variant
+func cacheVariant(cc *cli.Context, db *gorm.DB, u string) (key string, varyKey string, err error) {
+	method := cc.String("method")
+	if key, err = cacheKey(method, u); err != nil {
+		return
+	}
+	if cc.IsSet("vary") {
+		return key, cc.String("vary"), nil
+	}
+	varyKey, err = dbcache.OnlyVaryKey(db, method, key)
+	return
+}
+
+func openCacheSet() (*sqlitecache.Set, error) {
+	if _, err := os.Stat(_conf.DBDir); err != nil {
+		return nil, errors.Wrap(err, "open db dir")
+	}
+	return &sqlitecache.Set{Dir: _conf.DBDir}, nil
+}
+
+func openCacheHost(set *sqlitecache.Set, host string) (*gorm.DB, error) {
+	if host == sqlitecache.FileDBKey || !set.Has(host) {
+		return nil, errors.Errorf("host %q not found", host)
+	}
+	return sqlitecache.OpenHostDB(set, host)
+}
+
+// openCacheURL open the host db of url
+func openCacheURL(set *sqlitecache.Set, u string) (*gorm.DB, error) {
+	if u == "" {
+		return nil, errors.New("url is required")
+	}
+	pu, err := url.Parse(u)
+	if err != nil {
+		return nil, err
+	}
+	return openCacheHost(set, pu.Hostname())
+}
+
+// cacheHosts return hosts in args or all hosts
+func cacheHosts(set *sqlitecache.Set, args []string) ([]string, error) {
+	if len(args) > 0 {
+		return args, nil
+	}
+	return sqlitecache.Hosts(set)
+}
+
+func runCacheList(cc *cli.Context) (err error) {
+	set, err := openCacheSet()
+	if err != nil {
+		return
+	}
+	defer set.Close()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+
+	host := cc.Args().First()
+	if host == "" {
+		var hosts []string
+		hosts, err = sqlitecache.Hosts(set)
+		for _, v := range hosts {
+			fmt.Fprintln(w, v)
+		}
+		return
+	}
+
+	db, err := openCacheHost(set, host)
+	if err != nil {
+		return
+	}
+	o := &dbcache.ListResponsesOptions{
+		DB:     db,
+		Prefix: cc.String("prefix"),
+		Offset: cc.Int("offset"),
+		Limit:  cc.Int("limit"),
+	}
+	list, err := dbcache.ListResponses(o)
+	if err != nil {
+		return
+	}
+	fmt.Fprintln(w, "METHOD\tSTATUS\tTYPE\tRAW\tBODY\tUPDATED\tURL")
+	for _, v := range list {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%d\t%d\t%s\t%s\n", v.Method, v.StatusCode, v.ContentType, v.RawSize, v.BodySize, v.UpdatedAt.Format("2006-01-02 15:04:05"), v.URL)
+	}
+	if int64(o.Offset+len(list)) < o.Total {
+		fmt.Fprintf(w, "... %d of %d\n", o.Offset+len(list), o.Total)
+	}
+	return
+}
+
+func runCacheShow(cc *cli.Context) (err error) {
+	set, err := openCacheSet()
+	if err != nil {
+		return
+	}
+	defer set.Close()
+	u := cc.Args().First()
+	db, err := openCacheURL(set, u)
+	if err != nil {
+		return
+	}
+	key, varyKey, err := cacheVariant(cc, db, u)
+	if err != nil {
+		return
+	}
+	hr, err := dbcache.FindVariant(db, cc.String("method"), key, varyKey)
+	if err != nil {
+		return
+	}
+	if hr == nil {
+		return errors.Errorf("%s %s not found", cc.String("method"), u)
+	}
+	if cc.Bool("request") {
+		return printRequest(hr)
+	}
+
+	if !cc.Bool("body") {
+		resp, err := hr.GetResponse(nil)
+		if err != nil {
+			return err
+		}
+		_ = resp.Body.Close()
+		fmt.Printf("%s %s\n", resp.Proto, resp.Status)
+		printHeader(resp.Header)
+		if cc.Bool("head") {
+			return nil
+		}
+		fmt.Println()
+	}
+
+	if hr.ContentHash == "" {
+		var body []byte
+		body, err = hr.ReadAll()
+		if err == nil {
+			_, err = os.Stdout.Write(body)
+		}
+		return
+	}
+	fdb, err := sqlitecache.OpenFileDB(set)
+	if err != nil {
+		return
+	}
+	body, err := dbcache.OpenBody(hr, fdb, &dbcache.FSBlobStore{Dir: _conf.GetBlobDir()})
+	if err != nil {
+		return
+	}
+	defer body.Close()
+	_, err = io.Copy(os.Stdout, body)
+	return
+}
+
+func printHeader(h http.Header) {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range h[k] {
+			fmt.Printf("%s: %s\n", k, v)
+		}
+	}
+}
+
+func printRequest(hr *models.HTTPResponse) (err error) {
+	fmt.Printf("%s %s\n", hr.Method, hr.URL)
+	header := http.Header{}
+	if len(hr.RequestHeader) > 0 {
+		if err = json.Unmarshal(hr.RequestHeader, &header); err != nil {
+			return
+		}
+	}
+	printHeader(header)
+	if hr.ClientAddr != "" {
+		fmt.Printf("# client %s\n", hr.ClientAddr)
+	}
+	if len(hr.Timings) > 0 {
+		var t reqtrace.Timings
+		if err = json.Unmarshal(hr.Timings, &t); err != nil {
+			return
+		}
+		fmt.Printf("# dns %v connect %v tls %v ttfb %v total %v\n", t.DNS, t.Connect, t.TLS, t.TTFB, t.Total)
+	}
+	if len(hr.RequestBody) == 0 {
+		return
+	}
+	fmt.Println()
+	body, err := hr.GetRequestBody()
+	if err != nil {
+		return
+	}
+	defer body.Close()
+	_, err = io.Copy(os.Stdout, body)
+	return
+}
+
+func runCacheRemove(cc *cli.Context) (err error) {
+	set, err := openCacheSet()
+	if err != nil {
+		return
+	}
+	defer set.Close()
+
+	if host := cc.String("host"); host != "" {
+		if _, err = openCacheHost(set, host); err != nil {
+			return
+		}
+		if err = set.Remove(host); err == nil {
+			log.Info().Str("host", host).Msg("host removed")
+		}
+		return
+	}
+
+	u := cc.Args().First()
+	prefix := cc.String("prefix")
+	if u == "" && prefix == "" {
+		return errors.New("url, --host or --prefix is required")
+	}
+	o := &dbcache.DeleteResponsesOptions{Method: cc.String("method")}
+	switch {
+	case u == "":
+		o.Prefix, u = prefix, prefix
+	case prefix != "":
+		// the prefix is the path prefix of the url host
+		o.PathPrefix = prefix
+	default:
+		o.URL = u
+	}
+	pu, err := url.Parse(u)
+	if err != nil {
+		return
+	}
+	if o.DB, err = openCacheHost(set, pu.Hostname()); err != nil {
+		return
+	}
+	if err = dbcache.DeleteResponses(o); err == nil {
+		log.Info().Int64("deleted", o.Deleted).Msg("responses removed")
+	}
+	return
+}
+
+func runCacheStats(cc *cli.Context) (err error) {
+	set, err := openCacheSet()
+	if err != nil {
+		return
+	}
+	defer set.Close()
+	hosts, err := cacheHosts(set, cc.Args().Slice())
+	if err != nil {
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+	defer w.Flush()
+	fmt.Fprintln(w, "HOST\tCOUNT\tFILES\tRAW\tBODY\tRATIO\tFILE SIZE\t")
+	total := &dbcache.Stats{}
+	row := func(host string, s *dbcache.Stats) {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%.2f\t%d\t\n", host, s.Count, s.Files, s.RawSize, s.BodySize, s.Ratio(), s.FileSize)
+	}
+	for _, host := range hosts {
+		db, err := openCacheHost(set, host)
+		if err != nil {
+			return err
+		}
+		s, err := dbcache.GetStats(db)
+		if err != nil {
+			return err
+		}
+		total.Add(s)
+		row(host, s)
+	}
+	row("TOTAL", total)
+	return
+}
+
+func runCacheVacuum(cc *cli.Context) (err error) {
+	set, err := openCacheSet()
+	if err != nil {
+		return
+	}
+	defer set.Close()
+	keys, err := cacheHosts(set, cc.Args().Slice())
+	if err != nil {
+		return
+	}
+	if cc.NArg() == 0 {
+		keys = append(keys, sqlitecache.FileDBKey)
+	}
+	for _, key := range keys {
+		var db *gorm.DB
+		if key == sqlitecache.FileDBKey {
+			db, err = sqlitecache.OpenFileDB(set)
+		} else {
+			db, err = openCacheHost(set, key)
+		}
+		if err != nil {
+			return
+		}
+		if err = sqlitecache.Vacuum(db); err != nil {
+			return errors.Wrapf(err, "vacuum %s", key)
+		}
+		log.Info().Str("db", key).Msg("vacuumed")
+	}
+	return
+}
+
+func runCacheEvict(cc *cli.Context) (err error) {
+	conf := &proxc.EvictConf{}
+	if _conf.Evict != nil {
+		*conf = *_conf.Evict
+	}
+	for name, v := range map[string]*proxc.Size{"max-size": &conf.MaxSize, "max-host-size": &conf.MaxHostSize} {
+		if cc.IsSet(name) {
+			if *v, err = proxc.ParseSize(cc.String(name)); err != nil {
+				return
+			}
+		}
+	}
+	if cc.IsSet("max-entries") {
+		conf.MaxEntries = cc.Int64("max-entries")
+	}
+	if cc.IsSet("max-age") {
+		conf.MaxAge = cc.Duration("max-age")
+	}
+	if cc.IsSet("policy") {
+		conf.Policy = cc.String("policy")
+	}
+	if err = conf.Init(); err != nil {
+		return
+	}
+	if !conf.Enabled() {
+		return errors.New("no limit, set the flags or evict in config")
+	}
+
+	set, err := openCacheSet()
+	if err != nil {
+		return
+	}
+	defer set.Close()
+	o := conf.Options()
+	o.Blobs = &dbcache.FSBlobStore{Dir: _conf.GetBlobDir()}
+	if err = sqlitecache.Evict(set, o); err != nil {
+		return
+	}
+	log.Info().Int64("evicted", o.Evicted).Int64("size", o.EvictedSize).
+		Int64("files", o.Files.Files).Int64("file_size", o.Files.Size).Int64("file_refs", o.Files.Refs).Msg("evict")
+	return
+}
+
+func runCacheFsck(cc *cli.Context) (err error) {
+	set, err := openCacheSet()
+	if err != nil {
+		return
+	}
+	defer set.Close()
+	o := &dbcache.FsckOptions{
+		Blobs:  &dbcache.FSBlobStore{Dir: _conf.GetBlobDir()},
+		Repair: cc.Bool("repair"),
+	}
+	if err = sqlitecache.Fsck(set, o); err != nil {
+		return
+	}
+	if len(o.Problems) > 0 {
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "KIND\tHASH\tHOST\tURL\tDETAIL\tREPAIRED")
+		for _, p := range o.Problems {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%v\n", p.Kind, p.Hash, p.Host, p.URL, p.Detail, p.Repaired)
+		}
+		_ = w.Flush()
+	}
+	unrepaired := 0
+	for _, p := range o.Problems {
+		if !p.Repaired {
+			unrepaired++
+		}
+	}
+	log.Info().Int("files", o.Files).Int("problems", len(o.Problems)).Int("unrepaired", unrepaired).Msg("fsck")
+	if unrepaired > 0 {
+		return errors.Errorf("%d problems found, run with --repair to fix", unrepaired)
+	}
+	return
+}
+
+func runCacheMigrateBlobs(cc *cli.Context) (err error) {
+	set, err := openCacheSet()
+	if err != nil {
+		return
+	}
+	defer set.Close()
+	fdb, err := sqlitecache.OpenFileDB(set)
+	if err != nil {
+		return
+	}
+	o := &dbcache.MigrateBlobsOptions{
+		FileDB: fdb,
+		Blobs:  &dbcache.FSBlobStore{Dir: _conf.GetBlobDir()},
+	}
+	err = dbcache.MigrateBlobs(o)
+	log.Info().Int("migrated", o.Migrated).Str("dir", _conf.GetBlobDir()).Msg("migrate blobs")
+	return
+}
+
+func runCacheHARExport(cc *cli.Context) (err error) {
+	host := cc.Args().First()
+	prefix := cc.String("prefix")
+	if host == "" && prefix != "" {
+		var pu *url.URL
+		if pu, err = url.Parse(prefix); err != nil {
+			return
+		}
+		host = pu.Hostname()
+	}
+	if host == "" {
+		return errors.New("host or --prefix is required")
+	}
+	set, err := openCacheSet()
+	if err != nil {
+		return
+	}
+	defer set.Close()
+	db, err := openCacheHost(set, host)
+	if err != nil {
+		return
+	}
+	fdb, err := sqlitecache.OpenFileDB(set)
+	if err != nil {
+		return
+	}
+	o := &dbcache.ExportHAROptions{
+		DB:          db,
+		FileDB:      fdb,
+		Blobs:       &dbcache.FSBlobStore{Dir: _conf.GetBlobDir()},
+		Prefix:      prefix,
+		MaxBodySize: cc.Int64("max-body-size"),
+	}
+	out, err := dbcache.ExportHAR(o)
+	if err != nil {
+		return
+	}
+	if o.Omitted > 0 {
+		log.Warn().Int("omitted", o.Omitted).Int64("max_body_size", o.MaxBodySize).Msg("large bodies omitted")
+	}
+
+	var w io.Writer = os.Stdout
+	if fn := cc.String("output"); fn != "" {
+		var f *os.File
+		if f, err = os.Create(fn); err != nil {
+			return
+		}
+		defer f.Close()
+		w = f
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err = enc.Encode(out); err == nil {
+		log.Info().Str("host", host).Int("entries", len(out.Log.Entries)).Msg("har exported")
+	}
+	return
+}
+
+func runCacheHARImport(cc *cli.Context) (err error) {
+	if cc.NArg() == 0 {
+		return errors.New("har file is required")
+	}
+	if err = os.MkdirAll(_conf.DBDir, 0o777); err != nil {
+		return
+	}
+	set := &sqlitecache.Set{Dir: _conf.DBDir}
+	defer set.Close()
+	cache := sqlitecache.NewSetCache(set)
+	cache.Blobs = &dbcache.FSBlobStore{Dir: _conf.GetBlobDir()}
+	keyFunc, err := _conf.KeyFunc()
+	if err != nil {
+		return
+	}
+
+	for _, fn := range cc.Args().Slice() {
+		h := &har.HAR{}
+		var data []byte
+		if data, err = os.ReadFile(fn); err != nil {
+			return
+		}
+		if err = json.Unmarshal(data, h); err != nil {
+			return errors.Wrapf(err, "parse %s", fn)
+		}
+		if h.Log == nil {
+			return errors.Errorf("invalid har file %s", fn)
+		}
+		o := &dbcache.ImportHAROptions{Cache: cache, HAR: h, Methods: cc.StringSlice("method"), KeyFunc: keyFunc}
+		if err = dbcache.ImportHAR(o); err != nil {
+			return
+		}
+		log.Info().Str("file", fn).Int("imported", o.Imported).Int("skipped", o.Skipped).Msg("har imported")
+	}
+	return
+}
+
+func parseVersionID(s string) (uint, error) {
+	id, err := strconv.ParseUint(s, 10, 64)
+	return uint(id), errors.Wrapf(err, "invalid version %q", s)
+}
+
+func runCacheVersionList(cc *cli.Context) (err error) {
+	set, err := openCacheSet()
+	if err != nil {
+		return
+	}
+	defer set.Close()
+	u := cc.Args().First()
+	db, err := openCacheURL(set, u)
+	if err != nil {
+		return
+	}
+	key, varyKey, err := cacheVariant(cc, db, u)
+	if err != nil {
+		return
+	}
+	list, err := dbcache.ListVersions(db, cc.String("method"), key, varyKey)
+	if err != nil {
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintln(w, "ID\tSTATUS\tTYPE\tRAW\tFIRST SEEN\tLAST SEEN\tHASH")
+	for _, v := range list {
+		fmt.Fprintf(w, "%d\t%d\t%s\t%d\t%s\t%s\t%.12s\n", v.ID, v.StatusCode, v.ContentType, v.RawSize,
+			v.CreatedAt.Format("2006-01-02 15:04:05"), v.UpdatedAt.Format("2006-01-02 15:04:05"), v.BodyHash)
+	}
+	return
+}
+
+func runCacheVersionDiff(cc *cli.Context) (err error) {
+	if cc.NArg() < 2 {
+		return errors.New("url and from version are required")
+	}
+	set, err := openCacheSet()
+	if err != nil {
+		return
+	}
+	defer set.Close()
+	u := cc.Args().First()
+	db, err := openCacheURL(set, u)
+	if err != nil {
+		return
+	}
+	fdb, err := sqlitecache.OpenFileDB(set)
+	if err != nil {
+		return
+	}
+	o := &dbcache.DiffVersionsOptions{
+		DB:     db,
+		FileDB: fdb,
+		Blobs:  &dbcache.FSBlobStore{Dir: _conf.GetBlobDir()},
+		Method: cc.String("method"),
+	}
+	if o.Key, o.VaryKey, err = cacheVariant(cc, db, u); err != nil {
+		return
+	}
+	if o.From, err = parseVersionID(cc.Args().Get(1)); err != nil {
+		return
+	}
+	if to := cc.Args().Get(2); to != "" {
+		if o.To, err = parseVersionID(to); err != nil {
+			return
+		}
+	}
+	diff, err := dbcache.DiffVersions(o)
+	if err == nil {
+		fmt.Print(diff)
+	}
+	return
+}
+
+func runCacheVersionPin(cc *cli.Context) (err error) {
+	if cc.NArg() < 2 {
+		return errors.New("url and version are required")
+	}
+	set, err := openCacheSet()
+	if err != nil {
+		return
+	}
+	defer set.Close()
+	u := cc.Args().First()
+	db, err := openCacheURL(set, u)
+	if err != nil {
+		return
+	}
+	id, err := parseVersionID(cc.Args().Get(1))
+	if err != nil {
+		return
+	}
+	key, err := cacheKey(cc.String("method"), u)
+	if err != nil {
+		return
+	}
+	v, err := dbcache.FindVersion(db, id)
+	if err != nil {
+		return
+	}
+	if v == nil || v.Method != cc.String("method") || v.CacheKey != key {
+		return errors.Errorf("version %d of %s %s not found", id, cc.String("method"), u)
+	}
+	if _, err = dbcache.PinVersion(db, id); err == nil {
+		log.Info().Uint("version", id).Str("url", u).Msg("version pinned")
+	}
+	return
+}
+
+func runCacheVersionUnpin(cc *cli.Context) (err error) {
+	set, err := openCacheSet()
+	if err != nil {
+		return
+	}
+	defer set.Close()
+	u := cc.Args().First()
+	db, err := openCacheURL(set, u)
+	if err != nil {
+		return
+	}
+	key, varyKey, err := cacheVariant(cc, db, u)
+	if err != nil {
+		return
+	}
+	if err = dbcache.UnpinResponse(db, cc.String("method"), key, varyKey); err == nil {
+		log.Info().Str("url", u).Msg("response unpinned")
+	}
+	return
+}
@@ -5,6 +5,7 @@ import (
 	"os"
 
 	"github.com/pkg/errors"
+	"github.com/wenerme/proxc/httpcache"
 	"github.com/wenerme/proxc/httpcache/dbcache/models"
 	"github.com/wenerme/proxc/httpencoding"
 
@@ -27,12 +28,29 @@ func main() {
 		Before: setup,
 		Action: runServer,
 		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "config",
+				Usage:   "yaml config file",
+				EnvVars: []string{"CONFIG_FILE"},
+			},
 			&cli.StringFlag{
 				Name:        "web-addr",
 				Value:       ":9081",
 				EnvVars:     []string{"WEB_ADDR"},
 				Destination: &_conf.WebAddr,
 			},
+			&cli.StringFlag{
+				Name:        "api-addr",
+				Usage:       "cache management api address, same as web-addr to replace the web interface, binds to loopback if the host is omitted and no api-token",
+				EnvVars:     []string{"API_ADDR"},
+				Destination: &_conf.APIAddr,
+			},
+			&cli.StringFlag{
+				Name:        "api-token",
+				Usage:       "bearer token required by the cache management api",
+				EnvVars:     []string{"API_TOKEN"},
+				Destination: &_conf.APIToken,
+			},
 			&cli.StringFlag{
 				Name:        "addr",
 				Value:       ":9080",
@@ -51,6 +69,48 @@ func main() {
 				EnvVars:     []string{"DB_DIR"},
 				Destination: &_conf.DBDir,
 			},
+			&cli.StringFlag{
+				Name:        "blob-dir",
+				Usage:       "file content dir, default to $DB_DIR/blobs",
+				EnvVars:     []string{"BLOB_DIR"},
+				Destination: &_conf.BlobDir,
+			},
+			&cli.StringFlag{
+				Name:        "policy",
+				Usage:       "default cache policy: fresh, rfc, ttl, transparent, swr",
+				Value:       proxc.PolicyFresh,
+				EnvVars:     []string{"CACHE_POLICY"},
+				Destination: &_conf.Policy,
+			},
+			&cli.StringFlag{
+				Name:        "mode",
+				Usage:       "transport mode: empty for default, replay to serve only from cache, record to always refresh from upstream",
+				EnvVars:     []string{"CACHE_MODE"},
+				Destination: &_conf.Mode,
+			},
+			&cli.BoolFlag{
+				Name:    "offline",
+				Usage:   "same as --mode=replay, never touches the network",
+				EnvVars: []string{"OFFLINE"},
+			},
+			&cli.IntFlag{
+				Name:        "miss-status",
+				Usage:       "status code of replay mode cache miss, 504 or 404",
+				EnvVars:     []string{"MISS_STATUS"},
+				Destination: &_conf.MissStatus,
+			},
+			&cli.BoolFlag{
+				Name:        "history",
+				Usage:       "record every distinct response as a version",
+				EnvVars:     []string{"CACHE_HISTORY"},
+				Destination: &_conf.History,
+			},
+			&cli.IntFlag{
+				Name:        "revalidate-concurrency",
+				Usage:       "max number of background revalidations of stale-while-revalidate responses",
+				EnvVars:     []string{"REVALIDATE_CONCURRENCY"},
+				Destination: &_conf.RevalidateConcurrency,
+			},
 			&cli.StringFlag{
 				Name:  "encoding",
 				Value: "zstd",
@@ -61,6 +121,7 @@ func main() {
 				Name:   "server",
 				Action: runServer,
 			},
+			cacheCommand,
 			{
 				Name: "config",
 				Action: func(cc *cli.Context) (err error) {
@@ -78,6 +139,28 @@ func main() {
 }
 
 func setup(cc *cli.Context) (err error) {
+	if file := cc.String("config"); file != "" {
+		var data []byte
+		data, err = os.ReadFile(file)
+		if err != nil {
+			return
+		}
+		// the flags and env set explicitly override the config file, the destinations are overwritten by unmarshal
+		explicit := map[string]string{}
+		for _, f := range cc.App.Flags {
+			if name := f.Names()[0]; cc.IsSet(name) {
+				explicit[name] = fmt.Sprint(cc.Value(name))
+			}
+		}
+		if err = yaml.Unmarshal(data, _conf); err != nil {
+			return errors.Wrap(err, "parse config")
+		}
+		for name, v := range explicit {
+			if err = cc.Set(name, v); err != nil {
+				return
+			}
+		}
+	}
 	if err = env.Parse(_conf); err != nil {
 		return
 	}
@@ -87,6 +170,10 @@ func setup(cc *cli.Context) (err error) {
 
 	_conf.CaRootPath = os.ExpandEnv(_conf.CaRootPath)
 	_conf.DBDir = os.ExpandEnv(_conf.DBDir)
+	_conf.BlobDir = os.ExpandEnv(_conf.BlobDir)
+	if cc.Bool("offline") {
+		_conf.Mode = httpcache.ModeReplay
+	}
 
 	enc := cc.String("encoding")
 	if !httpencoding.IsSupported(enc) {
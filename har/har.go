@@ -0,0 +1,244 @@
+// Package har implements the HTTP Archive 1.2 format
+//
+// See http://www.softwareishard.com/blog/har-12-spec/
+package har
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const Version = "1.2"
+
+type HAR struct {
+	Log *Log `json:"log"`
+}
+
+type Log struct {
+	Version string   `json:"version"`
+	Creator *Creator `json:"creator"`
+	Pages   []*Page  `json:"pages,omitempty"`
+	Entries []*Entry `json:"entries"`
+	Comment string   `json:"comment,omitempty"`
+}
+
+type Creator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Comment string `json:"comment,omitempty"`
+}
+
+type Page struct {
+	StartedDateTime time.Time `json:"startedDateTime"`
+	ID              string    `json:"id"`
+	Title           string    `json:"title"`
+}
+
+type Entry struct {
+	Pageref         string    `json:"pageref,omitempty"`
+	StartedDateTime time.Time `json:"startedDateTime"`
+	Time            float64   `json:"time"`
+	Request         *Request  `json:"request"`
+	Response        *Response `json:"response"`
+	Cache           struct{}  `json:"cache"`
+	Timings         *Timings  `json:"timings"`
+	ServerIPAddress string    `json:"serverIPAddress,omitempty"`
+	Connection      string    `json:"connection,omitempty"`
+	Comment         string    `json:"comment,omitempty"`
+}
+
+type Request struct {
+	Method      string       `json:"method"`
+	URL         string       `json:"url"`
+	HTTPVersion string       `json:"httpVersion"`
+	Cookies     []*Cookie    `json:"cookies"`
+	Headers     []*NameValue `json:"headers"`
+	QueryString []*NameValue `json:"queryString"`
+	PostData    *PostData    `json:"postData,omitempty"`
+	HeadersSize int64        `json:"headersSize"`
+	BodySize    int64        `json:"bodySize"`
+	Comment     string       `json:"comment,omitempty"`
+}
+
+type Response struct {
+	Status      int          `json:"status"`
+	StatusText  string       `json:"statusText"`
+	HTTPVersion string       `json:"httpVersion"`
+	Cookies     []*Cookie    `json:"cookies"`
+	Headers     []*NameValue `json:"headers"`
+	Content     *Content     `json:"content"`
+	RedirectURL string       `json:"redirectURL"`
+	HeadersSize int64        `json:"headersSize"`
+	BodySize    int64        `json:"bodySize"`
+	Comment     string       `json:"comment,omitempty"`
+}
+
+type Cookie struct {
+	Name     string     `json:"name"`
+	Value    string     `json:"value"`
+	Path     string     `json:"path,omitempty"`
+	Domain   string     `json:"domain,omitempty"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	HTTPOnly bool       `json:"httpOnly,omitempty"`
+	Secure   bool       `json:"secure,omitempty"`
+	Comment  string     `json:"comment,omitempty"`
+}
+
+type NameValue struct {
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+	Comment string `json:"comment,omitempty"`
+}
+
+type PostData struct {
+	MimeType string       `json:"mimeType"`
+	Params   []*NameValue `json:"params,omitempty"`
+	Text     string       `json:"text"`
+	Comment  string       `json:"comment,omitempty"`
+}
+
+type Content struct {
+	Size        int64  `json:"size"`
+	Compression int64  `json:"compression,omitempty"`
+	MimeType    string `json:"mimeType"`
+	Text        string `json:"text,omitempty"`
+	Encoding    string `json:"encoding,omitempty"` // base64 or empty
+	Comment     string `json:"comment,omitempty"`
+}
+
+type Timings struct {
+	Blocked float64 `json:"blocked,omitempty"`
+	DNS     float64 `json:"dns,omitempty"`
+	Connect float64 `json:"connect,omitempty"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl,omitempty"`
+	Comment string  `json:"comment,omitempty"`
+}
+
+func NewHAR() *HAR {
+	return &HAR{Log: &Log{
+		Version: Version,
+		Creator: &Creator{Name: "proxc", Version: "dev"},
+		Entries: []*Entry{},
+	}}
+}
+
+// NewHeaders convert http.Header to sorted name value pairs
+func NewHeaders(h http.Header) (out []*NameValue) {
+	out = []*NameValue{}
+	for k, vv := range h {
+		for _, v := range vv {
+			out = append(out, &NameValue{Name: k, Value: v})
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return
+}
+
+// Header convert name value pairs to http.Header
+func Header(nv []*NameValue) http.Header {
+	h := http.Header{}
+	for _, v := range nv {
+		// http2 pseudo header
+		if strings.HasPrefix(v.Name, ":") {
+			continue
+		}
+		h.Add(v.Name, v.Value)
+	}
+	return h
+}
+
+// IsText return true if the mime type should be stored as text
+func IsText(mimeType string) bool {
+	mt, _, _ := mime.ParseMediaType(mimeType)
+	switch {
+	case strings.HasPrefix(mt, "text/"):
+		return true
+	case strings.HasSuffix(mt, "+json"), strings.HasSuffix(mt, "+xml"):
+		return true
+	}
+	switch mt {
+	case "application/json", "application/javascript", "application/x-javascript", "application/xml",
+		"application/x-www-form-urlencoded", "application/graphql", "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+// NewContent create content from decoded body, use base64 if not text
+func NewContent(mimeType string, body []byte) *Content {
+	c := &Content{Size: int64(len(body)), MimeType: mimeType}
+	if IsText(mimeType) {
+		c.Text = string(body)
+	} else if len(body) > 0 {
+		c.Text = base64.StdEncoding.EncodeToString(body)
+		c.Encoding = "base64"
+	}
+	return c
+}
+
+// Bytes return the decoded content
+func (c *Content) Bytes() ([]byte, error) {
+	if c.Encoding == "base64" {
+		return base64.StdEncoding.DecodeString(c.Text)
+	}
+	return []byte(c.Text), nil
+}
+
+// NewRequest convert to http.Request
+func (e *Entry) NewRequest() (req *http.Request, err error) {
+	var body io.Reader
+	if e.Request.PostData != nil && e.Request.PostData.Text != "" {
+		body = strings.NewReader(e.Request.PostData.Text)
+	}
+	req, err = http.NewRequest(e.Request.Method, e.Request.URL, body)
+	if err != nil {
+		return
+	}
+	req.Header = Header(e.Request.Headers)
+	return
+}
+
+// NewResponse convert to http.Response, the body is decoded content
+func (e *Entry) NewResponse(req *http.Request) (resp *http.Response, err error) {
+	r := e.Response
+	var body []byte
+	if r.Content != nil {
+		body, err = r.Content.Bytes()
+		if err != nil {
+			return
+		}
+	}
+	proto := r.HTTPVersion
+	major, minor, ok := http.ParseHTTPVersion(strings.ToUpper(proto))
+	if !ok {
+		proto, major, minor = "HTTP/1.1", 1, 1
+	}
+	text := r.StatusText
+	if text == "" {
+		text = http.StatusText(r.Status)
+	}
+	resp = &http.Response{
+		Status:        fmt.Sprintf("%d %s", r.Status, text),
+		StatusCode:    r.Status,
+		Proto:         strings.ToUpper(proto),
+		ProtoMajor:    major,
+		ProtoMinor:    minor,
+		Header:        Header(r.Headers),
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+		// content is always decoded
+		Uncompressed: true,
+	}
+	return
+}
@@ -0,0 +1,46 @@
+package har
+
+import (
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wenerme/wego/testx"
+)
+
+func TestEntryNewResponse(t *testing.T) {
+	e := &Entry{Response: &Response{
+		Status:      http.StatusOK,
+		HTTPVersion: "http/2.0",
+		Headers:     []*NameValue{{Name: ":status", Value: "200"}, {Name: "content-type", Value: "text/plain"}},
+		Content:     &Content{Text: "SGVsbG8=", Encoding: "base64"},
+	}}
+	resp := testx.Must(e.NewResponse(nil))
+	assert.Equal(t, "200 OK", resp.Status)
+	assert.Equal(t, "HTTP/2.0", resp.Proto)
+	assert.Equal(t, http.Header{"Content-Type": {"text/plain"}}, resp.Header)
+	assert.Equal(t, "Hello", string(testx.Must(io.ReadAll(resp.Body))))
+
+	// the status text of the archive is kept
+	e.Response.Status = http.StatusNotFound
+	e.Response.StatusText = "Nothing Here"
+	assert.Equal(t, "404 Nothing Here", testx.Must(e.NewResponse(nil)).Status)
+}
+
+func TestNewHeaders(t *testing.T) {
+	h := http.Header{"B": {"1"}, "A": {"2", "1"}}
+	assert.Equal(t, []*NameValue{{Name: "A", Value: "2"}, {Name: "A", Value: "1"}, {Name: "B", Value: "1"}}, NewHeaders(h))
+}
+
+func TestNewContent(t *testing.T) {
+	c := NewContent("text/plain", []byte("Hello"))
+	assert.Equal(t, "Hello", c.Text)
+	assert.Empty(t, c.Encoding)
+
+	bin := []byte{0, 1, 2, 0xff}
+	c = NewContent("image/png", bin)
+	assert.Equal(t, "base64", c.Encoding)
+	assert.Equal(t, int64(len(bin)), c.Size)
+	assert.Equal(t, bin, testx.Must(c.Bytes()))
+}
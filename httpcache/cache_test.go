@@ -2,10 +2,20 @@ package httpcache
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
 	"io"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/wenerme/proxc/httpencoding"
@@ -13,6 +23,7 @@ import (
 
 	"github.com/wenerme/proxc/httpcache/dbcache"
 	"github.com/wenerme/proxc/httpcache/dbcache/models"
+	"github.com/wenerme/proxc/httpcache/dbcache/sqlitecache"
 )
 
 func TestGzip(t *testing.T) {
@@ -77,3 +88,1119 @@ func TestFile(t *testing.T) {
 		}
 	}
 }
+
+func TestLargeBody(t *testing.T) {
+	resetTest()
+	data := make([]byte, 3<<20+100)
+	testx.Must(rand.Read(data))
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Cache-Control", "max-age=3600")
+		// no content-length
+		for b := data; len(b) > 0; b = b[len(b)/2+1:] {
+			testx.Must(w.Write(b[:len(b)/2+1]))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer svr.Close()
+
+	tp := NewMemoryCacheTransport()
+	tp.SpoolSize = 1024
+	tp.Cache.(*dbcache.Cache).LargeBodySize = 1 << 20
+	client := http.Client{Transport: tp}
+
+	resp := testx.Must(client.Get(svr.URL + "/large.bin"))
+	assert.True(t, bytes.Equal(data, testx.Must(io.ReadAll(resp.Body))))
+	// read after EOF should not store again
+	_, err := resp.Body.Read(make([]byte, 10))
+	assert.Equal(t, io.EOF, err)
+	resp = testx.Must(client.Get(svr.URL + "/large.bin"))
+	assert.Equal(t, "1", resp.Header.Get(XFromCache))
+	assert.Equal(t, int64(len(data)), resp.ContentLength)
+	assert.True(t, bytes.Equal(data, testx.Must(io.ReadAll(resp.Body))))
+
+	_, fdb, _ := tp.Cache.(*dbcache.Cache).GetDB(resp.Request)
+	fc := &models.FileContent{}
+	testx.NoErr(fdb.Where(models.FileContent{Hash: models.ContentHashBytes(data)}).First(fc).Error)
+	assert.Equal(t, "large.bin", fc.Name)
+	assert.Nil(t, fc.Content)
+	blobs := &dbcache.DBBlobStore{DB: fdb}
+	assert.True(t, testx.Must(blobs.HasBlob(fc.Hash)))
+}
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestReplayMode(t *testing.T) {
+	resetTest()
+	resp := testx.Must(s.client.Get(s.server.URL + "/method"))
+	_, _ = io.ReadAll(resp.Body)
+	resp = testx.Must(s.client.Get(s.server.URL + "/cachederror"))
+	_, _ = io.ReadAll(resp.Body)
+
+	tp := NewTransport(s.transport.Cache)
+	tp.Mode = ModeReplay
+	tp.Transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		t.Errorf("upstream called: %s %s", req.Method, req.URL)
+		return nil, errors.New("offline")
+	})
+	client := http.Client{Transport: tp}
+
+	resp = testx.Must(client.Get(s.server.URL + "/method"))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get(XFromCache))
+	assert.Equal(t, "GET", string(testx.Must(io.ReadAll(resp.Body))))
+
+	// the range applies to the cached 200 only
+	req := testx.Must(http.NewRequest("GET", s.server.URL+"/method", nil))
+	req.Header.Set("Range", "bytes=1-")
+	resp = testx.Must(client.Do(req))
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, "ET", string(testx.Must(io.ReadAll(resp.Body))))
+	req = testx.Must(http.NewRequest("GET", s.server.URL+"/cachederror", nil))
+	req.Header.Set("Range", "bytes=0-2")
+	resp = testx.Must(client.Do(req))
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get("Content-Range"))
+	assert.Equal(t, "Not found", string(testx.Must(io.ReadAll(resp.Body))))
+
+	// miss and unsafe method never delete
+	resp = testx.Must(client.Post(s.server.URL+"/method", "text/plain", nil))
+	assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+	assert.Equal(t, "POST "+s.server.URL+"/method", resp.Header.Get(XCacheMissKey))
+
+	tp.ReplayMissStatus = http.StatusNotFound
+	resp = testx.Must(client.Get(s.server.URL + "/missing"))
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Equal(t, "GET "+s.server.URL+"/missing", resp.Header.Get(XCacheMissKey))
+
+	resp = testx.Must(client.Get(s.server.URL + "/method"))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestRecordMode(t *testing.T) {
+	counter := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		counter++
+		w.Header().Set("Cache-Control", "no-store")
+		_, _ = w.Write([]byte(strconv.Itoa(counter)))
+	}))
+	defer server.Close()
+
+	cache := NewMemoryCache()
+	cache.KeepPrevious = true
+	tp := NewTransport(cache)
+	tp.Mode = ModeRecord
+	client := http.Client{Transport: tp}
+	for i := 1; i <= 3; i++ {
+		resp := testx.Must(client.Get(server.URL))
+		assert.Equal(t, strconv.Itoa(i), string(testx.Must(io.ReadAll(resp.Body))))
+		assert.Empty(t, resp.Header.Get(XFromCache))
+	}
+
+	req := testx.Must(http.NewRequest("GET", server.URL, nil))
+	resp := testx.Must(cache.GetResponse(req))
+	assert.Equal(t, "3", string(testx.Must(io.ReadAll(resp.Body))))
+
+	db, _, err := cache.GetDB(req)
+	testx.NoErr(err)
+	var versions []*models.HTTPResponseVersion
+	testx.NoErr(db.Order("id").Find(&versions).Error)
+	assert.Len(t, versions, 2)
+	for i, v := range versions {
+		hr := &models.HTTPResponse{Body: v.Body, ContentEncoding: v.ContentEncoding}
+		assert.Equal(t, strconv.Itoa(i+1), string(testx.Must(hr.ReadAll())))
+		assert.Equal(t, server.URL, v.URL)
+	}
+}
+
+func TestVaryVariants(t *testing.T) {
+	counter := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		counter++
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Vary", "Accept-Language, Accept-Encoding")
+		if r.URL.Path == "/star" {
+			w.Header().Set("Vary", "*")
+		}
+		_, _ = w.Write([]byte(r.Header.Get("Accept-Language")))
+	}))
+	defer server.Close()
+
+	cache := NewMemoryCache()
+	client := http.Client{Transport: NewTransport(cache)}
+	get := func(p string, lang string) *http.Response {
+		req := testx.Must(http.NewRequest("GET", server.URL+p, nil))
+		if lang != "" {
+			req.Header.Set("Accept-Language", lang)
+		}
+		resp := testx.Must(client.Do(req))
+		assert.Equal(t, lang, string(testx.Must(io.ReadAll(resp.Body))))
+		return resp
+	}
+	for _, lang := range []string{"en", "de", "", "en", "de", ""} {
+		get("/", lang)
+	}
+	assert.Equal(t, 3, counter)
+	assert.Equal(t, "1", get("/", "de").Header.Get(XFromCache))
+
+	db, _, err := cache.GetDB(testx.Must(http.NewRequest("GET", server.URL, nil)))
+	testx.NoErr(err)
+	var variants []*models.HTTPResponse
+	testx.NoErr(db.Where("url = ?", server.URL+"/").Order("id").Find(&variants).Error)
+	assert.Len(t, variants, 3)
+	assert.Equal(t, "Accept-Language=en", variants[0].VaryKey)
+
+	get("/star", "en")
+	get("/star", "en")
+	assert.Equal(t, 5, counter)
+}
+
+func TestRangeRequest(t *testing.T) {
+	data := make([]byte, 4096)
+	testx.Must(rand.Read(data))
+	counter := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		counter++
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Etag", `"v1"`)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	// the body stored in db, as file and as db chunks across the ranges
+	for _, store := range []string{"db", "file", "chunks"} {
+		counter = 0
+		set := &sqlitecache.Set{Dir: t.TempDir()}
+		cache := sqlitecache.NewSetCache(set)
+		switch store {
+		case "file":
+			cache.LargeBodySize = 1024
+		case "chunks":
+			cache.LargeBodySize = 1024
+			cache.Blobs = &dbcache.DBBlobStore{DB: testx.Must(sqlitecache.OpenFileDB(set)), ChunkSize: 1000}
+		}
+		client := http.Client{Transport: NewTransport(cache)}
+		get := func(rng string, h ...string) *http.Response {
+			req := testx.Must(http.NewRequest("GET", server.URL+"/data.bin", nil))
+			if rng != "" {
+				req.Header.Set("Range", rng)
+			}
+			for i := 0; i < len(h); i += 2 {
+				req.Header.Set(h[i], h[i+1])
+			}
+			return testx.Must(client.Do(req))
+		}
+
+		// miss goes upstream
+		resp := get("bytes=0-9")
+		assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+		_ = resp.Body.Close()
+		resp = get("")
+		testx.Must(io.ReadAll(resp.Body))
+		assert.Equal(t, 2, counter)
+
+		resp = get("bytes=10-19")
+		assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+		assert.Equal(t, "1", resp.Header.Get(XFromCache))
+		assert.Equal(t, "bytes 10-19/4096", resp.Header.Get("Content-Range"))
+		assert.Equal(t, data[10:20], testx.Must(io.ReadAll(resp.Body)))
+
+		resp = get("bytes=-100")
+		assert.Equal(t, "bytes 3996-4095/4096", resp.Header.Get("Content-Range"))
+		assert.Equal(t, data[3996:], testx.Must(io.ReadAll(resp.Body)))
+
+		resp = get("bytes=0-1,4000-")
+		assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+		mt, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		testx.NoErr(err)
+		assert.Equal(t, "multipart/byteranges", mt)
+		body := testx.Must(io.ReadAll(resp.Body))
+		assert.Equal(t, int64(len(body)), resp.ContentLength)
+		mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+		part := testx.Must(mr.NextPart())
+		assert.Equal(t, "bytes 0-1/4096", part.Header.Get("Content-Range"))
+		assert.Equal(t, data[:2], testx.Must(io.ReadAll(part)))
+		part = testx.Must(mr.NextPart())
+		assert.Equal(t, "bytes 4000-4095/4096", part.Header.Get("Content-Range"))
+		assert.Equal(t, data[4000:], testx.Must(io.ReadAll(part)))
+
+		resp = get("bytes=999999-")
+		assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, resp.StatusCode)
+		assert.Equal(t, "bytes */4096", resp.Header.Get("Content-Range"))
+		resp = get("bytes=9-0")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, data, testx.Must(io.ReadAll(resp.Body)))
+		resp = get("items=0-9")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, data, testx.Must(io.ReadAll(resp.Body)))
+
+		resp = get("bytes=0-9", "If-Range", `"v1"`)
+		assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+		assert.Equal(t, data[:10], testx.Must(io.ReadAll(resp.Body)))
+		resp = get("bytes=0-9", "If-Range", `"v0"`)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, data, testx.Must(io.ReadAll(resp.Body)))
+		assert.Equal(t, 2, counter)
+	}
+}
+
+func TestRangeRequestStale(t *testing.T) {
+	data := make([]byte, 4096)
+	testx.Must(rand.Read(data))
+	etag := `"v1"`
+	var ifRange []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ifRange = append(ifRange, r.Header.Get("If-Range"))
+		w.Header().Set("Cache-Control", "max-age=0")
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Etag", etag)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	client := http.Client{Transport: NewTransport(sqlitecache.NewSQLiteCache(t.TempDir()))}
+	get := func(h ...string) *http.Response {
+		req := testx.Must(http.NewRequest("GET", server.URL+"/data.bin", nil))
+		for i := 0; i < len(h); i += 2 {
+			req.Header.Set(h[i], h[i+1])
+		}
+		return testx.Must(client.Do(req))
+	}
+	cached := func() []byte {
+		resp := get("Cache-Control", "only-if-cached")
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		return testx.Must(io.ReadAll(resp.Body))
+	}
+	resp := get()
+	testx.Must(io.ReadAll(resp.Body))
+
+	// the stale complete response is kept, the range is fetched with If-Range
+	resp = get("Range", "bytes=0-9")
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, data[:10], testx.Must(io.ReadAll(resp.Body)))
+	assert.Equal(t, []string{"", `"v1"`}, ifRange)
+	assert.Equal(t, data, cached())
+
+	// the changed response is answered in full and stored
+	testx.Must(rand.Read(data))
+	etag = `"v2"`
+	resp = get("Range", "bytes=0-9")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, data, testx.Must(io.ReadAll(resp.Body)))
+	assert.Equal(t, data, cached())
+	assert.Equal(t, []string{"", `"v1"`, `"v1"`}, ifRange)
+}
+
+func TestConditionalRequest(t *testing.T) {
+	lastModified := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	counter := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		counter++
+		if r.URL.Path == "/stale" {
+			w.Header().Set("Cache-Control", "max-age=0")
+		} else {
+			w.Header().Set("Cache-Control", "max-age=3600")
+		}
+		w.Header().Set("Etag", `"v1"`)
+		w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		_, _ = io.WriteString(w, "Hello")
+	}))
+	defer server.Close()
+
+	client := http.Client{Transport: NewTransport(sqlitecache.NewSQLiteCache(t.TempDir()))}
+	get := func(path string, h ...string) *http.Response {
+		req := testx.Must(http.NewRequest("GET", server.URL+path, nil))
+		for i := 0; i < len(h); i += 2 {
+			req.Header.Set(h[i], h[i+1])
+		}
+		resp := testx.Must(client.Do(req))
+		_, _ = io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		return resp
+	}
+	before := lastModified.Add(-time.Hour).Format(http.TimeFormat)
+	after := lastModified.Add(time.Hour).Format(http.TimeFormat)
+
+	// the conditional miss is answered by upstream and not stored
+	resp := get("/fresh", "If-None-Match", `"v1"`)
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+	assert.Equal(t, `"v1"`, resp.Header.Get("Etag"))
+	assert.Equal(t, 1, counter)
+	assert.Equal(t, http.StatusOK, get("/fresh").StatusCode)
+	assert.Equal(t, 2, counter)
+	assert.Equal(t, http.StatusNotModified, get("/fresh", "If-None-Match", `"v1"`).StatusCode)
+	assert.Equal(t, 2, counter)
+
+	for _, test := range []struct {
+		header []string
+		status int
+	}{
+		{[]string{"If-None-Match", `"v1"`}, http.StatusNotModified},
+		{[]string{"If-None-Match", `"v0", W/"v1"`}, http.StatusNotModified},
+		{[]string{"If-None-Match", "*"}, http.StatusNotModified},
+		{[]string{"If-None-Match", `"v0"`}, http.StatusOK},
+		{[]string{"If-None-Match", `"v0"`, "If-Modified-Since", after}, http.StatusOK},
+		{[]string{"If-Modified-Since", after}, http.StatusNotModified},
+		{[]string{"If-Modified-Since", lastModified.Format(http.TimeFormat)}, http.StatusNotModified},
+		{[]string{"If-Modified-Since", before}, http.StatusOK},
+		{[]string{"If-Match", `"v1"`}, http.StatusOK},
+		{[]string{"If-Match", "*"}, http.StatusOK},
+		{[]string{"If-Match", `W/"v1"`}, http.StatusPreconditionFailed},
+		{[]string{"If-Match", `"v0"`, "If-None-Match", `"v1"`}, http.StatusPreconditionFailed},
+		{[]string{"If-Unmodified-Since", after}, http.StatusOK},
+		{[]string{"If-Unmodified-Since", before}, http.StatusPreconditionFailed},
+		{[]string{"If-Match", `"v1"`, "If-Unmodified-Since", before}, http.StatusOK},
+		{[]string{"Range", "bytes=0-1", "If-None-Match", `"v1"`}, http.StatusNotModified},
+		{[]string{"Range", "bytes=0-1", "If-Match", `"v0"`}, http.StatusPreconditionFailed},
+		{[]string{"Range", "bytes=0-1", "If-Match", `"v1"`}, http.StatusPartialContent},
+	} {
+		resp = get("/fresh", test.header...)
+		assert.Equal(t, test.status, resp.StatusCode, test.header)
+		assert.Equal(t, "1", resp.Header.Get(XFromCache), test.header)
+	}
+	assert.Equal(t, 2, counter)
+
+	// the stale response is revalidated with the cached validators then answered to the client
+	get("/stale")
+	resp = get("/stale", "If-None-Match", `"v1"`)
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+	resp = get("/stale", "If-Modified-Since", before)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 5, counter)
+}
+
+func TestConditionalMiss(t *testing.T) {
+	data := make([]byte, 1<<20)
+	var body *bytes.Reader
+	var ifNoneMatch []string
+	noStore := false
+	tp := NewTransport(sqlitecache.NewSQLiteCache(t.TempDir()))
+	tp.Transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		ifNoneMatch = append(ifNoneMatch, req.Header.Get("If-None-Match"))
+		body = bytes.NewReader(data)
+		resp := &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Cache-Control": {"max-age=0"}, "Etag": {`"v1"`}, "Date": {time.Now().UTC().Format(http.TimeFormat)}},
+			Body:       io.NopCloser(body),
+			Request:    req,
+		}
+		if noStore {
+			resp.Header.Set("Cache-Control", "no-store")
+		} else if req.Header.Get("If-None-Match") == `"v1"` {
+			resp.StatusCode = http.StatusNotModified
+		}
+		return resp, nil
+	})
+	client := tp.Client()
+	get := func() *http.Response {
+		req := testx.Must(http.NewRequest("GET", "http://a.test/data.bin", nil))
+		req.Header.Set("If-None-Match", `"v1"`)
+		resp := testx.Must(client.Do(req))
+		_ = resp.Body.Close()
+		return resp
+	}
+
+	// the client validators of the miss are forwarded to upstream
+	assert.Equal(t, http.StatusNotModified, get().StatusCode)
+	assert.Equal(t, []string{`"v1"`}, ifNoneMatch)
+	assert.Equal(t, len(data), body.Len())
+
+	// the stale response is revalidated, the unstored response is not read to answer the 304
+	resp := testx.Must(client.Get("http://a.test/data.bin"))
+	testx.Must(io.ReadAll(resp.Body))
+	_ = resp.Body.Close()
+	noStore = true
+	assert.Equal(t, http.StatusNotModified, get().StatusCode)
+	assert.Equal(t, []string{`"v1"`, "", `"v1"`}, ifNoneMatch)
+	assert.NotZero(t, body.Len())
+}
+
+func TestHeuristicFreshness(t *testing.T) {
+	resetTest()
+	defer resetTest()
+	now := time.Now().UTC()
+	resp := func(lastModified time.Duration, h ...string) *http.Response {
+		r := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}}
+		r.Header.Set("Date", now.Format(http.TimeFormat))
+		r.Header.Set("Last-Modified", now.Add(-lastModified).Format(http.TimeFormat))
+		for i := 0; i < len(h); i += 2 {
+			r.Header.Set(h[i], h[i+1])
+		}
+		return r
+	}
+	h := &Heuristic{}
+	lifetime, ok := h.Lifetime(resp(100 * time.Second))
+	assert.True(t, ok)
+	assert.Equal(t, 10*time.Second, lifetime)
+	lifetime, _ = h.Lifetime(resp(30 * 24 * time.Hour))
+	assert.Equal(t, DefaultHeuristicMaxAge, lifetime)
+	lifetime, _ = (&Heuristic{Fraction: 0.5, MaxAge: time.Minute}).Lifetime(resp(100 * time.Second))
+	assert.Equal(t, 50*time.Second, lifetime)
+	for _, h := range [][]string{
+		{"Cache-Control", "max-age=0"},
+		{"Cache-Control", "no-cache"},
+		{"Expires", now.Format(http.TimeFormat)},
+		{"Last-Modified", ""},
+	} {
+		_, ok = (&Heuristic{}).Lifetime(resp(100*time.Second, h...))
+		assert.False(t, ok, h)
+	}
+	r := resp(100 * time.Second)
+	r.StatusCode = http.StatusInternalServerError
+	_, ok = h.Lifetime(r)
+	assert.False(t, ok)
+
+	req := testx.Must(http.NewRequest("GET", "http://example.com/", nil))
+	clock = &fakeClock{elapsed: 5 * time.Second}
+	r = resp(100 * time.Second)
+	assert.Equal(t, Fresh, h.GetFreshness(req, r))
+	assert.Equal(t, "5", r.Header.Get("Age"))
+	assert.Equal(t, `113 - "Heuristic Expiration"`, r.Header.Get("Warning"))
+	r = resp(100 * time.Second)
+	h2 := &Heuristic{Header: http.Header{"X-Heuristic": {"1"}}}
+	assert.Equal(t, Fresh, h2.GetFreshness(req, r))
+	assert.Equal(t, "1", r.Header.Get("X-Heuristic"))
+	assert.Equal(t, "", r.Header.Get("Warning"))
+
+	req.Header.Set("Cache-Control", "min-fresh=6")
+	assert.Equal(t, Stale, h.GetFreshness(req, resp(100*time.Second)))
+	req.Header.Set("Cache-Control", "max-age=4")
+	assert.Equal(t, Stale, h.GetFreshness(req, resp(100*time.Second)))
+	req.Header.Del("Cache-Control")
+	clock = &fakeClock{elapsed: 20 * time.Second}
+	r = resp(100 * time.Second)
+	assert.Equal(t, Stale, h.GetFreshness(req, r))
+	assert.Equal(t, "", r.Header.Get("Age"))
+
+	// served from cache by the transport
+	clock = &realClock{}
+	counter := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		counter++
+		w.Header().Set("Last-Modified", time.Now().Add(-240*time.Hour).UTC().Format(http.TimeFormat))
+		_, _ = io.WriteString(w, "Hello")
+	}))
+	defer server.Close()
+	tp := NewTransport(sqlitecache.NewSQLiteCache(t.TempDir()))
+	client := tp.Client()
+	for i := 0; i < 2; i++ {
+		r = testx.Must(client.Get(server.URL))
+		testx.Must(io.ReadAll(r.Body))
+		_ = r.Body.Close()
+	}
+	assert.Equal(t, 2, counter)
+	tp.Heuristic = &Heuristic{}
+	r = testx.Must(client.Get(server.URL))
+	assert.Equal(t, "Hello", string(testx.Must(io.ReadAll(r.Body))))
+	assert.Equal(t, 2, counter)
+	assert.Equal(t, "1", r.Header.Get(XFromCache))
+	assert.NotEmpty(t, r.Header.Get("Age"))
+	assert.NotEmpty(t, r.Header.Get("Warning"))
+}
+
+func TestSharedCache(t *testing.T) {
+	resetTest()
+	defer resetTest()
+	var mu sync.Mutex
+	counter := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		counter[r.URL.Path]++
+		mu.Unlock()
+		w.Header().Set("Date", time.Now().UTC().Format(http.TimeFormat))
+		switch r.URL.Path {
+		case "/s-maxage":
+			w.Header().Set("Cache-Control", "max-age=0, s-maxage=3600")
+		case "/private":
+			w.Header().Set("Cache-Control", "private, max-age=3600")
+		case "/public":
+			w.Header().Set("Cache-Control", "public, max-age=3600")
+		case "/age":
+			w.Header().Set("Cache-Control", "max-age=3600")
+			w.Header().Set("Age", "100")
+		default:
+			w.Header().Set("Cache-Control", "max-age=3600")
+		}
+		_, _ = io.WriteString(w, "Hello")
+	}))
+	defer server.Close()
+
+	for _, shared := range []bool{false, true} {
+		counter = map[string]int{}
+		tp := NewTransport(sqlitecache.NewSQLiteCache(t.TempDir()))
+		tp.Shared = shared
+		client := tp.Client()
+		get := func(path string, h ...string) *http.Response {
+			req := testx.Must(http.NewRequest("GET", server.URL+path, nil))
+			for i := 0; i < len(h); i += 2 {
+				req.Header.Set(h[i], h[i+1])
+			}
+			resp := testx.Must(client.Do(req))
+			testx.Must(io.ReadAll(resp.Body))
+			_ = resp.Body.Close()
+			assert.Empty(t, resp.Header.Get(XCacheRequestTime))
+			assert.Empty(t, resp.Header.Get(XCacheResponseTime))
+			return resp
+		}
+		for i := 0; i < 2; i++ {
+			get("/s-maxage")
+			get("/private")
+			get("/auth", "Authorization", "Bearer a")
+			get("/public", "Authorization", "Bearer a")
+			get("/age")
+		}
+		if shared {
+			assert.Equal(t, map[string]int{"/s-maxage": 1, "/private": 2, "/auth": 2, "/public": 1, "/age": 1}, counter)
+		} else {
+			assert.Equal(t, map[string]int{"/s-maxage": 2, "/private": 1, "/auth": 1, "/public": 1, "/age": 1}, counter)
+		}
+
+		resp := get("/age")
+		assert.Equal(t, "1", resp.Header.Get(XFromCache))
+		if shared {
+			assert.GreaterOrEqual(t, testx.Must(strconv.Atoi(resp.Header.Get("Age"))), 100)
+			// the Date is in seconds
+			assert.LessOrEqual(t, testx.Must(strconv.Atoi(get("/public").Header.Get("Age"))), 1)
+		} else {
+			assert.Equal(t, "100", resp.Header.Get("Age"))
+			assert.Empty(t, get("/public").Header.Get("Age"))
+		}
+	}
+
+	// the age by the stored times
+	now := time.Now().UTC().Truncate(time.Second)
+	h := http.Header{}
+	h.Set("Date", now.Add(-10*time.Second).Format(http.TimeFormat))
+	h.Set(XCacheRequestTime, now.Add(-2*time.Second).Format(time.RFC3339Nano))
+	h.Set(XCacheResponseTime, now.Format(time.RFC3339Nano))
+	clock = &fakeClock{elapsed: 60 * time.Second}
+	assert.Equal(t, 70*time.Second, cachedAge(h))
+	h.Set("Age", "30")
+	assert.Equal(t, 92*time.Second, cachedAge(h))
+	h.Del(XCacheResponseTime)
+	assert.Equal(t, 60*time.Second, cachedAge(h))
+
+	// stale is not served if must revalidate
+	h = http.Header{}
+	h.Set("Date", now.Format(http.TimeFormat))
+	clock = &fakeClock{elapsed: 20 * time.Second}
+	for _, test := range []struct {
+		cc      string
+		req     string
+		private int
+		shared  int
+	}{
+		{"max-age=10, stale-while-revalidate=60", "", StaleWhileRevalidate, StaleWhileRevalidate},
+		{"max-age=10, must-revalidate, stale-while-revalidate=60", "", StaleWhileRevalidate, Stale},
+		{"max-age=10, proxy-revalidate, stale-while-revalidate=60", "", StaleWhileRevalidate, Stale},
+		{"max-age=10, proxy-revalidate", "max-stale", Fresh, Stale},
+		{"max-age=10, s-maxage=60", "", Stale, Fresh},
+		{"max-age=60, s-maxage=10", "", Fresh, Stale},
+	} {
+		h.Set("Cache-Control", test.cc)
+		req := http.Header{}
+		req.Set("Cache-Control", test.req)
+		assert.Equal(t, test.private, getFreshnessOf(h, req, false), test.cc)
+		assert.Equal(t, test.shared, getFreshnessOf(h, req, true), test.cc)
+	}
+}
+
+func TestInvalidate(t *testing.T) {
+	var mu sync.Mutex
+	counter := map[string]int{}
+	upstream := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		counter[req.Method+" "+req.URL.Host+req.URL.Path]++
+		mu.Unlock()
+		resp := &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Cache-Control": {"max-age=3600"}, "Date": {time.Now().UTC().Format(http.TimeFormat)}},
+			Body:       io.NopCloser(strings.NewReader("Hello")),
+			Request:    req,
+		}
+		switch req.URL.Path {
+		case "/created":
+			resp.StatusCode = http.StatusCreated
+			resp.Header.Set("Location", "/items/1")
+			resp.Header.Set("Content-Location", "http://b.test/items/1")
+		case "/moved":
+			resp.StatusCode = http.StatusSeeOther
+			resp.Header.Set("Content-Location", "http://a.test/items/2")
+		case "/error":
+			if req.Method != "GET" {
+				resp.StatusCode = http.StatusInternalServerError
+			}
+		}
+		return resp, nil
+	})
+	cache := sqlitecache.NewSQLiteCache(t.TempDir())
+	tp := NewTransport(cache)
+	tp.Transport = upstream
+	client := tp.Client()
+	do := func(method string, u string) {
+		resp := testx.Must(client.Do(testx.Must(http.NewRequest(method, u, nil))))
+		testx.Must(io.ReadAll(resp.Body))
+		_ = resp.Body.Close()
+	}
+	urls := []string{"http://a.test/a", "http://a.test/created", "http://a.test/items/1", "http://a.test/items/2", "http://b.test/items/1", "http://a.test/error", "http://a.test/pinned"}
+	for _, u := range urls {
+		do("GET", u)
+		do("HEAD", u)
+	}
+	// the pinned response is never invalidated
+	db, _, err := cache.GetDB(testx.Must(http.NewRequest("GET", "http://a.test/pinned", nil)))
+	testx.NoErr(err)
+	testx.NoErr(db.Model(&models.HTTPResponse{}).Where("url = ?", "http://a.test/pinned").Update("pinned", true).Error)
+	do("DELETE", "http://a.test/pinned")
+
+	do("PUT", "http://a.test/a")
+	do("POST", "http://a.test/created")
+	do("DELETE", "http://a.test/moved")
+	do("PATCH", "http://a.test/error")
+	do("OPTIONS", "http://a.test/a")
+	counter = map[string]int{}
+	for _, u := range urls {
+		do("GET", u)
+		do("HEAD", u)
+	}
+	// HEAD is answered from the refetched GET
+	assert.Equal(t, map[string]int{
+		"GET a.test/a":       1,
+		"GET a.test/created": 1,
+		"GET a.test/items/1": 1,
+		"GET a.test/items/2": 1,
+	}, counter)
+}
+
+func TestHeadFromGet(t *testing.T) {
+	content := strings.Repeat("Hello proxc\n", 100)
+	var mu sync.Mutex
+	counter := map[string]int{}
+	etag := `"v1"`
+	version := "1"
+	upstream := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		counter[req.Method]++
+		resp := &http.Response{
+			StatusCode: http.StatusOK,
+			Header: http.Header{
+				"Date":          {time.Now().UTC().Format(http.TimeFormat)},
+				"Etag":          {etag},
+				"X-Version":     {version},
+				"Content-Type":  {"text/plain"},
+				"Cache-Control": {"max-age=3600"},
+			},
+			Body:    http.NoBody,
+			Request: req,
+		}
+		if req.URL.Path == "/stale" {
+			resp.Header.Set("Cache-Control", "max-age=0")
+		}
+		if req.Header.Get("If-None-Match") == etag {
+			resp.StatusCode = http.StatusNotModified
+			return resp, nil
+		}
+		resp.Header.Set("Content-Length", strconv.Itoa(len(content)))
+		resp.ContentLength = int64(len(content))
+		if req.Method == "GET" {
+			resp.Body = io.NopCloser(strings.NewReader(content))
+		}
+		return resp, nil
+	})
+
+	for _, large := range []bool{false, true} {
+		counter = map[string]int{}
+		etag, version = `"v1"`, "1"
+		cache := sqlitecache.NewSQLiteCache(t.TempDir())
+		if large {
+			cache.LargeBodySize = 100
+		}
+		tp := NewTransport(cache)
+		tp.Transport = upstream
+		client := tp.Client()
+		do := func(method string, path string) (*http.Response, string) {
+			resp := testx.Must(client.Do(testx.Must(http.NewRequest(method, "http://a.test"+path, nil))))
+			body := testx.Must(io.ReadAll(resp.Body))
+			_ = resp.Body.Close()
+			return resp, string(body)
+		}
+		cached := func(path string) *http.Response {
+			resp := testx.Must(cache.GetResponse(testx.Must(http.NewRequest("GET", "http://a.test"+path, nil))))
+			if resp != nil {
+				assert.Equal(t, content, string(testx.Must(io.ReadAll(resp.Body))))
+			}
+			return resp
+		}
+
+		do("GET", "/fresh")
+		resp, body := do("HEAD", "/fresh")
+		assert.Equal(t, map[string]int{"GET": 1}, counter)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "1", resp.Header.Get(XFromCache))
+		assert.Equal(t, strconv.Itoa(len(content)), resp.Header.Get("Content-Length"))
+		assert.Equal(t, int64(len(content)), resp.ContentLength)
+		assert.Empty(t, resp.Header.Get("Content-Encoding"))
+		assert.Equal(t, large, resp.Header.Get("Content-Hash") != "")
+		assert.Empty(t, body)
+
+		// the 304 of HEAD updates the GET metadata
+		do("GET", "/stale")
+		version = "2"
+		resp, _ = do("HEAD", "/stale")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "2", resp.Header.Get("X-Version"))
+		assert.Equal(t, map[string]int{"GET": 2, "HEAD": 1}, counter)
+		assert.Equal(t, "2", cached("/stale").Header.Get("X-Version"))
+
+		// the changed validator deletes the GET response
+		etag = `"v2"`
+		resp, _ = do("HEAD", "/stale")
+		assert.Equal(t, `"v2"`, resp.Header.Get("Etag"))
+		assert.Nil(t, cached("/stale"))
+		resp, body = do("HEAD", "/stale")
+		assert.Equal(t, `"v2"`, resp.Header.Get("Etag"))
+		assert.Empty(t, body)
+		assert.Equal(t, map[string]int{"GET": 2, "HEAD": 3}, counter)
+		_, body = do("GET", "/stale")
+		assert.Equal(t, content, body)
+		assert.Equal(t, 3, counter["GET"])
+	}
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	resetTest()
+	var mu sync.Mutex
+	counter := map[string]int{}
+	block := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		counter[r.URL.Path]++
+		n, wait := counter[r.URL.Path], block
+		mu.Unlock()
+		if n > 1 {
+			// revalidation
+			<-wait
+		}
+		w.Header().Set("Date", time.Now().Add(-10*time.Second).Format(time.RFC1123))
+		w.Header().Set("Cache-Control", "max-age=1, stale-while-revalidate=100")
+		_, _ = w.Write([]byte(strconv.Itoa(n)))
+	}))
+	defer server.Close()
+
+	tp := NewMemoryCacheTransport()
+	tp.Revalidator = NewRevalidator(1)
+	client := http.Client{Transport: tp}
+	get := func(p string) string {
+		resp := testx.Must(client.Get(server.URL + p))
+		assert.Equal(t, resp.Request.URL.Path, p)
+		return string(testx.Must(io.ReadAll(resp.Body)))
+	}
+
+	assert.Equal(t, "1", get("/a"))
+	// served stale, revalidated once in background
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, "1", get("/a"))
+	}
+	assert.Eventually(t, func() bool {
+		list := tp.Revalidator.List()
+		return len(list) == 1 && !list[0].StartedAt.IsZero()
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, server.URL+"/a", tp.Revalidator.List()[0].URL)
+	close(block)
+	tp.Revalidator.Wait()
+	assert.Equal(t, "2", get("/a"))
+	tp.Revalidator.Wait()
+
+	// pending revalidation is canceled without touching the upstream
+	mu.Lock()
+	assert.Equal(t, 3, counter["/a"])
+	block = make(chan struct{})
+	mu.Unlock()
+	var done []*Revalidation
+	tp.Revalidator.OnDone = func(r *Revalidation) {
+		mu.Lock()
+		done = append(done, r)
+		mu.Unlock()
+	}
+	get("/b")
+	get("/a")
+	assert.Eventually(t, func() bool {
+		list := tp.Revalidator.List()
+		return len(list) == 1 && !list[0].StartedAt.IsZero()
+	}, time.Second, 10*time.Millisecond)
+	get("/b")
+	assert.Len(t, tp.Revalidator.List(), 2)
+	list := tp.Revalidator.List()
+	assert.False(t, list[0].StartedAt.IsZero())
+	assert.True(t, list[1].StartedAt.IsZero())
+	assert.True(t, tp.Revalidator.Cancel(list[1].Key))
+	assert.False(t, tp.Revalidator.Cancel("GET nope"))
+	assert.Eventually(t, func() bool {
+		return len(tp.Revalidator.List()) == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 1, tp.Revalidator.CancelAll())
+	tp.Revalidator.Wait()
+	close(block)
+	assert.Len(t, done, 2)
+	assert.ErrorIs(t, done[0].Err, context.Canceled)
+	// canceled revalidation keeps the cached response
+	assert.Equal(t, "3", get("/a"))
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 1, counter["/b"])
+}
+
+func TestCoalesce(t *testing.T) {
+	data := make([]byte, 3<<20)
+	testx.Must(rand.Read(data))
+	var mu sync.Mutex
+	counter := map[string]int{}
+	release := make(chan struct{})
+	gone := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		counter[r.URL.Path]++
+		mu.Unlock()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+			gone <- struct{}{}
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, _ = w.Write(data)
+	}))
+	defer server.Close()
+
+	tp := NewMemoryCacheTransport()
+	tp.SpoolSize = 1024
+	client := http.Client{Transport: tp}
+	refs := func(p string) int {
+		tp.flightsMu.Lock()
+		defer tp.flightsMu.Unlock()
+		f := tp.flights["GET "+server.URL+p]
+		if f == nil {
+			return 0
+		}
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return f.refs
+	}
+	get := func(ctx context.Context, p string) (*http.Response, error) {
+		req := testx.Must(http.NewRequestWithContext(ctx, "GET", server.URL+p, nil))
+		return client.Do(req)
+	}
+
+	// one upstream fetch streams to all callers
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := get(context.Background(), "/a")
+			if assert.NoError(t, err) {
+				defer resp.Body.Close()
+				assert.True(t, bytes.Equal(data, testx.Must(io.ReadAll(resp.Body))))
+			}
+		}()
+	}
+	assert.Eventually(t, func() bool { return refs("/a") == 50 }, 5*time.Second, 10*time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, 1, counter["/a"])
+	resp := testx.Must(get(context.Background(), "/a"))
+	assert.Equal(t, "1", resp.Header.Get(XFromCache))
+	assert.True(t, bytes.Equal(data, testx.Must(io.ReadAll(resp.Body))))
+	assert.Equal(t, 0, refs("/a"))
+
+	// the leader canceled, the follower still completes
+	release = make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	leader := make(chan error)
+	go func() {
+		_, err := get(ctx, "/b")
+		leader <- err
+	}()
+	assert.Eventually(t, func() bool { return refs("/b") == 1 }, time.Second, 10*time.Millisecond)
+	follower := make(chan *http.Response)
+	go func() {
+		follower <- testx.Must(get(context.Background(), "/b"))
+	}()
+	assert.Eventually(t, func() bool { return refs("/b") == 2 }, time.Second, 10*time.Millisecond)
+	cancel()
+	assert.ErrorIs(t, <-leader, context.Canceled)
+	close(release)
+	resp = <-follower
+	assert.True(t, bytes.Equal(data, testx.Must(io.ReadAll(resp.Body))))
+	_ = resp.Body.Close()
+	assert.Equal(t, 1, counter["/b"])
+
+	// all callers gone, the upstream request is canceled
+	release = make(chan struct{})
+	defer close(release)
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		_, err := get(ctx, "/c")
+		leader <- err
+	}()
+	assert.Eventually(t, func() bool { return refs("/c") == 1 }, time.Second, 10*time.Millisecond)
+	cancel()
+	assert.ErrorIs(t, <-leader, context.Canceled)
+	select {
+	case <-gone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream request not canceled")
+	}
+	assert.Equal(t, 0, refs("/c"))
+}
+
+func TestCoalesceError(t *testing.T) {
+	var mu sync.Mutex
+	counter := 0
+	release := make(chan struct{})
+	tp := NewMemoryCacheTransport()
+	tp.Transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		counter++
+		mu.Unlock()
+		<-release
+		return nil, errors.New("upstream down")
+	})
+	client := http.Client{Transport: tp}
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := client.Get("http://example.com/")
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), "upstream down")
+			}
+		}()
+	}
+	assert.Eventually(t, func() bool {
+		tp.flightsMu.Lock()
+		defer tp.flightsMu.Unlock()
+		f := tp.flights["GET http://example.com/"]
+		if f == nil {
+			return false
+		}
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return f.refs == 5
+	}, time.Second, 10*time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, 1, counter)
+}
+
+type failingCache struct {
+	Cache
+}
+
+func (failingCache) SetResponse(resp *http.Response) error {
+	return errors.New("disk full")
+}
+
+func TestObserver(t *testing.T) {
+	upstream := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		header := http.Header{
+			"Cache-Control": {"max-age=3600"},
+			"Date":          {time.Now().UTC().Format(http.TimeFormat)},
+		}
+		status := http.StatusOK
+		if req.URL.Path == "/etag" {
+			header.Set("Cache-Control", "max-age=0")
+			header.Set("ETag", `"v1"`)
+			if req.Header.Get("If-None-Match") == `"v1"` {
+				status = http.StatusNotModified
+			}
+		}
+		return &http.Response{StatusCode: status, Header: header, Body: io.NopCloser(strings.NewReader("hello")), Request: req}, nil
+	})
+	var mu sync.Mutex
+	var events []string
+	var validate *http.Request
+	observer := ObserverFunc(func(e *Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		v := e.Type + " " + e.Key
+		switch e.Type {
+		case EventFreshness:
+			v += " " + strconv.Itoa(e.Freshness)
+		case EventServed:
+			v += " " + e.Result + " " + strconv.FormatInt(e.Bytes, 10)
+		case EventStoreError:
+			v += " " + e.Err.Error()
+		case EventValidate:
+			validate = e.Request
+		}
+		events = append(events, v)
+	})
+	tp := NewMemoryCacheTransport()
+	tp.Transport = upstream
+	tp.Observer = observer
+	client := tp.Client()
+	do := func(method string, u string) []string {
+		events = nil
+		req := testx.Must(http.NewRequest(method, u, nil))
+		resp := testx.Must(client.Do(req))
+		_, _ = io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		return events
+	}
+
+	assert.Equal(t, []string{
+		"lookup-miss GET http://a.test/a",
+		"miss GET http://a.test/a",
+		"store GET http://a.test/a",
+		"served GET http://a.test/a miss 5",
+	}, do("GET", "http://a.test/a"))
+	assert.Equal(t, []string{
+		"lookup-hit GET http://a.test/a",
+		"freshness GET http://a.test/a 1",
+		"hit GET http://a.test/a",
+		"served GET http://a.test/a hit 5",
+	}, do("GET", "http://a.test/a"))
+	do("GET", "http://a.test/etag")
+	assert.Equal(t, []string{
+		"lookup-hit GET http://a.test/etag",
+		"freshness GET http://a.test/etag 0",
+		"validate GET http://a.test/etag",
+		"not-modified GET http://a.test/etag",
+		"revalidated GET http://a.test/etag",
+		"store GET http://a.test/etag",
+		"served GET http://a.test/etag revalidated 5",
+	}, do("GET", "http://a.test/etag"))
+	assert.Equal(t, `"v1"`, validate.Header.Get("If-None-Match"))
+	// invalidated before and after, the succeeded unsafe method invalidates GET and HEAD
+	assert.Equal(t, []string{
+		"delete POST http://a.test/a",
+		"delete POST http://a.test/a",
+		"delete GET http://a.test/a",
+		"delete HEAD http://a.test/a",
+		"bypass POST http://a.test/a",
+		"served POST http://a.test/a bypass 5",
+	}, do("POST", "http://a.test/a"))
+
+	tp.Cache = failingCache{tp.Cache}
+	assert.Equal(t, []string{
+		"lookup-miss GET http://a.test/b",
+		"miss GET http://a.test/b",
+		"store-error GET http://a.test/b disk full",
+		"served GET http://a.test/b miss 5",
+	}, do("GET", "http://a.test/b"))
+}
@@ -0,0 +1,236 @@
+// Package cachekey computes the cache key of request and passes it from the transport to the cache by request context
+package cachekey
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+const (
+	// BodyRaw keys the request body as is
+	BodyRaw = "raw"
+	// BodyJSON keys the request body as JSON, object keys are sorted and whitespaces are ignored
+	BodyJSON = "json"
+	// BodyGraphQL keys the request body as GraphQL request, by operation name, query and variables
+	BodyGraphQL = "graphql"
+)
+
+// Func return the cache key of request, the method is not part of the key
+type Func func(req *http.Request) string
+
+type contextKey struct{}
+
+// WithKey return a shallow copy of req with key in context
+func WithKey(req *http.Request, key string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), contextKey{}, key))
+}
+
+// FromRequest return the key in context, default to the url
+func FromRequest(req *http.Request) string {
+	if key, ok := req.Context().Value(contextKey{}).(string); ok && key != "" {
+		return key
+	}
+	return req.URL.String()
+}
+
+// Options of the built-in key normalizers
+type Options struct {
+	// SortQuery sort query params by name, keep the order of same name
+	SortQuery bool `yaml:"sort_query,omitempty"`
+	// DropParams drop query params by name, `utm_*` drops params with the prefix
+	DropParams []string `yaml:"drop_params,omitempty"`
+	// LowerHost lowercase the host
+	LowerHost bool `yaml:"lower_host,omitempty"`
+	// StripFragment remove the fragment
+	StripFragment bool `yaml:"strip_fragment,omitempty"`
+	// Headers include the request headers in key
+	Headers []string `yaml:"headers,omitempty"`
+	// BodyHash include the sha256 of request body in key, the body is buffered
+	BodyHash bool `yaml:"body_hash,omitempty"`
+	// Body include the request body canonicalized by format in key, BodyRaw, BodyJSON or BodyGraphQL
+	Body string `yaml:"body,omitempty"`
+}
+
+// New create a key func by options
+func New(o *Options) Func {
+	return func(req *http.Request) string {
+		return o.Key(req)
+	}
+}
+
+// Key return the key of req, extra parts are appended as `\n<name>=<value>` lines
+func (o *Options) Key(req *http.Request) string {
+	u := *req.URL
+	if o.LowerHost {
+		u.Host = strings.ToLower(u.Host)
+	}
+	if o.StripFragment {
+		u.Fragment = ""
+		u.RawFragment = ""
+	}
+	if o.SortQuery || len(o.DropParams) > 0 {
+		u.RawQuery = o.query(u.RawQuery)
+	}
+
+	sb := &strings.Builder{}
+	sb.WriteString(u.String())
+	for _, name := range o.Headers {
+		name = http.CanonicalHeaderKey(name)
+		sb.WriteString("\n" + name + "=" + strings.Join(req.Header.Values(name), ", "))
+	}
+	switch {
+	case o.Body != "":
+		sb.WriteString(BodyKey(req, o.Body))
+	case o.BodyHash:
+		sb.WriteString("\nbody=" + BodyHash(req))
+	}
+	return sb.String()
+}
+
+func (o *Options) query(raw string) string {
+	if raw == "" {
+		return raw
+	}
+	params := strings.Split(raw, "&")
+	out := params[:0]
+	for _, v := range params {
+		if v == "" {
+			continue
+		}
+		name := v
+		if i := strings.IndexByte(v, '='); i >= 0 {
+			name = v[:i]
+		}
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		if !o.drop(name) {
+			out = append(out, v)
+		}
+	}
+	if o.SortQuery {
+		sort.SliceStable(out, func(i, j int) bool {
+			return paramName(out[i]) < paramName(out[j])
+		})
+	}
+	return strings.Join(out, "&")
+}
+
+func (o *Options) drop(name string) bool {
+	for _, v := range o.DropParams {
+		if prefix := strings.TrimSuffix(v, "*"); prefix != v {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if name == v {
+			return true
+		}
+	}
+	return false
+}
+
+func paramName(v string) string {
+	if i := strings.IndexByte(v, '='); i >= 0 {
+		return v[:i]
+	}
+	return v
+}
+
+// BodyHash return the sha256 of request body, the body is buffered and can be read again,
+// return empty if no body
+func BodyHash(req *http.Request) string {
+	data, err := ReadBody(req)
+	if err != nil || len(data) == 0 {
+		return ""
+	}
+	return hash(data)
+}
+
+// ReadBody buffer the request body and set GetBody, so the body can be read again
+func ReadBody(req *http.Request) (data []byte, err error) {
+	switch {
+	case req.GetBody != nil:
+		var body io.ReadCloser
+		if body, err = req.GetBody(); err != nil {
+			return
+		}
+		data, err = io.ReadAll(body)
+		_ = body.Close()
+		return
+	case req.Body == nil || req.Body == http.NoBody:
+		return
+	}
+	data, err = io.ReadAll(req.Body)
+	_ = req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(data))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	return
+}
+
+// BodyKey return the key part of the request body canonicalized by format,
+// as `\nbody=<sha256>` lines, fallback to BodyRaw if the body is not valid for format
+func BodyKey(req *http.Request, format string) string {
+	data, err := ReadBody(req)
+	if err != nil || len(data) == 0 {
+		return "\nbody="
+	}
+	switch format {
+	case BodyJSON:
+		if v, err := canonicalJSON(data); err == nil {
+			data = v
+		}
+	case BodyGraphQL:
+		if op, v, err := canonicalGraphQL(data); err == nil {
+			return "\noperation=" + op + "\nbody=" + hash(v)
+		}
+	}
+	return "\nbody=" + hash(data)
+}
+
+func canonicalJSON(data []byte) ([]byte, error) {
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	// map keys are sorted by Marshal
+	return json.Marshal(v)
+}
+
+func canonicalGraphQL(data []byte) (op string, out []byte, err error) {
+	var gql struct {
+		OperationName string          `json:"operationName"`
+		Query         string          `json:"query"`
+		Variables     json.RawMessage `json:"variables"`
+	}
+	if err = json.Unmarshal(data, &gql); err != nil {
+		return
+	}
+	variables := []byte("null")
+	if len(gql.Variables) > 0 {
+		if variables, err = canonicalJSON(gql.Variables); err != nil {
+			return
+		}
+	}
+	out, err = json.Marshal(map[string]interface{}{
+		"query":     strings.Join(strings.Fields(gql.Query), " "),
+		"variables": json.RawMessage(variables),
+	})
+	return gql.OperationName, out, err
+}
+
+func hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,67 @@
+package cachekey
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wenerme/wego/testx"
+)
+
+func TestKey(t *testing.T) {
+	for _, test := range []struct {
+		opts *Options
+		url  string
+		key  string
+	}{
+		{&Options{}, "https://Example.com/a?b=1&a=2#top", "https://Example.com/a?b=1&a=2#top"},
+		{&Options{SortQuery: true}, "https://example.com/a?b=1&a=2&b=0", "https://example.com/a?a=2&b=1&b=0"},
+		{&Options{DropParams: []string{"utm_*", "_"}}, "https://example.com/a?utm_source=x&id=1&_=123&utm_medium=y", "https://example.com/a?id=1"},
+		{&Options{DropParams: []string{"_"}}, "https://example.com/a?_=123", "https://example.com/a"},
+		{&Options{LowerHost: true, StripFragment: true}, "https://Example.COM/A#top", "https://example.com/A"},
+	} {
+		req := testx.Must(http.NewRequest("GET", test.url, nil))
+		assert.Equal(t, test.key, test.opts.Key(req), test.url)
+	}
+
+	o := &Options{Headers: []string{"accept-language"}, BodyHash: true}
+	req := testx.Must(http.NewRequest("POST", "https://example.com/graphql", strings.NewReader("{}")))
+	req.Header.Set("Accept-Language", "en")
+	key := o.Key(req)
+	assert.Equal(t, "https://example.com/graphql\nAccept-Language=en\nbody=44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a", key)
+	// body can be read again
+	assert.Equal(t, key, o.Key(req))
+
+	assert.Equal(t, "https://example.com/graphql", FromRequest(req))
+	assert.Equal(t, key, FromRequest(WithKey(req, key)))
+}
+
+func TestBodyKey(t *testing.T) {
+	newReq := func(body string) *http.Request {
+		return testx.Must(http.NewRequest("POST", "https://example.com/graphql", strings.NewReader(body)))
+	}
+	for _, test := range []struct {
+		format string
+		a, b   string
+		equal  bool
+	}{
+		{BodyRaw, `{"a":1,"b":2}`, `{"b":2,"a":1}`, false},
+		{BodyJSON, `{"a":1,"b":[1,2]}`, `{ "b": [1, 2], "a": 1 }`, true},
+		{BodyJSON, `{"a":1}`, `{"a":1.0}`, false},
+		{BodyJSON, `not json`, `not json`, true},
+		{BodyGraphQL, `{"query":"{ a }","variables":{"x":1,"y":2}}`, `{"query":"{\n  a\n}","variables":{"y":2,"x":1},"extensions":{}}`, true},
+		{BodyGraphQL, `{"operationName":"A","query":"{ a }"}`, `{"operationName":"B","query":"{ a }"}`, false},
+		{BodyGraphQL, `{"query":"{ a }","variables":{"x":1}}`, `{"query":"{ a }","variables":{"x":2}}`, false},
+	} {
+		a, b := BodyKey(newReq(test.a), test.format), BodyKey(newReq(test.b), test.format)
+		assert.Equal(t, test.equal, a == b, "%s %s %s", test.format, test.a, test.b)
+	}
+	assert.Equal(t, "\noperation=A\nbody=", BodyKey(newReq(`{"operationName":"A","query":"{ a }"}`), BodyGraphQL)[:len("\noperation=A\nbody=")])
+	assert.Equal(t, "\nbody=", BodyKey(testx.Must(http.NewRequest("POST", "https://example.com", nil)), BodyRaw))
+
+	req := newReq("{}")
+	assert.Equal(t, BodyKey(req, BodyJSON), BodyKey(req, BodyJSON))
+	assert.Equal(t, "{}", string(testx.Must(io.ReadAll(req.Body))))
+}
@@ -0,0 +1,90 @@
+package cachekey_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wenerme/proxc/httpcache"
+	"github.com/wenerme/proxc/httpcache/cachekey"
+	"github.com/wenerme/proxc/httpcache/dbcache"
+	"github.com/wenerme/proxc/httpcache/dbcache/models"
+	"github.com/wenerme/proxc/httpcache/dbcache/sqlitecache"
+	"github.com/wenerme/wego/testx"
+)
+
+func TestKeyFunc(t *testing.T) {
+	counter := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		counter++
+		w.Header().Set("Cache-Control", "max-age=3600")
+		_, _ = w.Write([]byte(r.URL.RawQuery))
+	}))
+	defer server.Close()
+
+	cache := sqlitecache.NewMemoryCache()
+	tp := httpcache.NewTransport(cache)
+	tp.KeyFunc = cachekey.New(&cachekey.Options{SortQuery: true, DropParams: []string{"utm_*", "_"}})
+	client := http.Client{Transport: tp}
+	for _, q := range []string{"b=1&a=2", "a=2&b=1&utm_source=x", "_=123&b=1&a=2"} {
+		resp := testx.Must(client.Get(server.URL + "/?" + q))
+		assert.Equal(t, "b=1&a=2", string(testx.Must(io.ReadAll(resp.Body))))
+	}
+	assert.Equal(t, 1, counter)
+
+	req := testx.Must(http.NewRequest("GET", server.URL+"/?a=2&b=1", nil))
+	db, _, err := cache.GetDB(req)
+	testx.NoErr(err)
+	hr := testx.Must(dbcache.FindResponse(db, "GET", server.URL+"/?b=1&a=2"))
+	assert.Equal(t, server.URL+"/?a=2&b=1", hr.CacheKey)
+
+	testx.NoErr(cache.DeleteResponse(cachekey.WithKey(req, tp.KeyFunc(req))))
+	assert.Nil(t, testx.Must(dbcache.FindResponse(db, "GET", server.URL+"/?b=1&a=2")))
+}
+
+func TestCacheablePOST(t *testing.T) {
+	counter := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		counter++
+		w.Header().Set("Cache-Control", "max-age=3600")
+		_, _ = io.Copy(w, r.Body)
+	}))
+	defer server.Close()
+
+	cache := sqlitecache.NewMemoryCache()
+	tp := httpcache.NewTransport(cache)
+	tp.Cacheable = func(req *http.Request) bool {
+		return req.URL.Path == "/graphql"
+	}
+	tp.KeyFunc = cachekey.New(&cachekey.Options{Body: cachekey.BodyGraphQL})
+	client := http.Client{Transport: tp}
+	post := func(p string, body string) *http.Response {
+		resp := testx.Must(client.Post(server.URL+p, "application/json", strings.NewReader(body)))
+		data := testx.Must(io.ReadAll(resp.Body))
+		if resp.Header.Get(httpcache.XFromCache) == "" {
+			assert.Equal(t, body, string(data))
+		}
+		return resp
+	}
+	first := `{"operationName":"User","query":"query User($id: ID!) { user(id: $id) { name } }","variables":{"id":"1","x":2}}`
+	post("/graphql", first)
+	resp := post("/graphql", `{"variables":{"x":2,"id":"1"},"query":"query User($id: ID!) {\n  user(id: $id) {\n    name\n  }\n}","operationName":"User"}`)
+	assert.Equal(t, "1", resp.Header.Get(httpcache.XFromCache))
+	post("/graphql", `{"operationName":"User","query":"query User($id: ID!) { user(id: $id) { name } }","variables":{"id":"2"}}`)
+	assert.Equal(t, 2, counter)
+	post("/rpc", first)
+	assert.Empty(t, post("/rpc", first).Header.Get(httpcache.XFromCache))
+	assert.Equal(t, 4, counter)
+
+	db, _, err := cache.GetDB(resp.Request)
+	testx.NoErr(err)
+	var list []*models.HTTPResponse
+	testx.NoErr(db.Where("method = ?", "POST").Order("id").Find(&list).Error)
+	assert.Len(t, list, 2)
+	assert.Equal(t, first, string(testx.Must(io.ReadAll(testx.Must(list[0].GetRequestBody())))))
+	assert.Equal(t, models.ContentHashBytes([]byte(first)), list[0].RequestBodyHash)
+	assert.Equal(t, server.URL+"/graphql", list[0].URL)
+}
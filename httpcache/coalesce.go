@@ -0,0 +1,257 @@
+package httpcache
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/wenerme/proxc/httpcache/spool"
+)
+
+// flight is an upstream fetch shared by the concurrent cache misses of the same key,
+// the body is spooled and read by every caller from its own offset, the fastest caller pulls from upstream
+type flight struct {
+	req    *http.Request
+	header http.Header   // request header of the leader when started
+	ready  chan struct{} // closed when resp or err is set
+	resp   *http.Response
+	err    error
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	buf      spool.Buffer
+	bodyErr  error // io.EOF when the body is complete
+	pulling  bool  // a caller is reading from upstream
+	refs     int
+	canceled bool // all callers gone before the body is complete
+	closed   bool
+	cancel   context.CancelFunc
+	land     func()
+}
+
+// coalesce share one fetch of req among the concurrent callers with the same key,
+// the upstream request is canceled when all callers are gone
+func (t *Transport) coalesce(req *http.Request, fetch func(req *http.Request) (*http.Response, error)) (*http.Response, error) {
+	key := cacheKey(req)
+	t.flightsMu.Lock()
+	if t.flights == nil {
+		t.flights = map[string]*flight{}
+	}
+	f := t.flights[key]
+	if f == nil || !f.join() {
+		f = &flight{req: req, header: req.Header.Clone(), ready: make(chan struct{}), refs: 1}
+		f.cond = sync.NewCond(&f.mu)
+		f.buf.Limit = t.SpoolSize
+		f.buf.Dir = t.SpoolDir
+		f.land = func() {
+			t.flightsMu.Lock()
+			if t.flights[key] == f {
+				delete(t.flights, key)
+			}
+			t.flightsMu.Unlock()
+		}
+		t.flights[key] = f
+		f.start(fetch)
+	}
+	t.flightsMu.Unlock()
+
+	select {
+	case <-f.ready:
+	case <-req.Context().Done():
+		f.release()
+		return nil, req.Context().Err()
+	}
+	if f.err != nil {
+		f.release()
+		return nil, f.err
+	}
+	if f.req != req && !sharable(f.resp, f.header, req.Header) {
+		f.release()
+		return fetch(req)
+	}
+	return f.response(req), nil
+}
+
+// sharable return true if the response fetched with the leader header can be used by the request with header
+func sharable(resp *http.Response, leader http.Header, header http.Header) bool {
+	if resp.Header.Get("Content-Encoding") != "" && leader.Get("Accept-Encoding") != header.Get("Accept-Encoding") {
+		return false
+	}
+	for _, h := range headerAllCommaSepValues(resp.Header, "vary") {
+		if h == "*" || leader.Get(h) != header.Get(h) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *flight) start(fetch func(req *http.Request) (*http.Response, error)) {
+	// the upstream request outlives the leader, canceled only when all callers are gone
+	ctx, cancel := context.WithCancel(detachedContext{f.req.Context()})
+	f.cancel = cancel
+	go func() {
+		resp, err := fetch(f.req.WithContext(ctx))
+		f.mu.Lock()
+		f.resp, f.err = resp, err
+		switch {
+		case err != nil:
+			f.bodyErr = err
+			cancel()
+			go f.land()
+		case f.canceled:
+			f.finish(context.Canceled)
+		}
+		f.mu.Unlock()
+		close(f.ready)
+	}()
+}
+
+// pull read the next chunk from upstream, called with f.mu held
+func (f *flight) pull() {
+	f.pulling = true
+	f.mu.Unlock()
+	p := make([]byte, 32<<10)
+	n, err := f.resp.Body.Read(p)
+	f.mu.Lock()
+	f.pulling = false
+	if n > 0 {
+		if _, werr := f.buf.Write(p[:n]); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	if err != nil {
+		f.finish(err)
+	}
+	f.cond.Broadcast()
+}
+
+// finish the body with err, called with f.mu held
+func (f *flight) finish(err error) {
+	f.bodyErr = err
+	_ = f.resp.Body.Close()
+	f.cancel()
+	f.closeIfDone()
+	go f.land()
+}
+
+// join add a caller, return false if the flight is canceled or closed but not landed yet
+func (f *flight) join() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.canceled || f.closed {
+		return false
+	}
+	f.refs++
+	return true
+}
+
+func (f *flight) release() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.refs--
+	if f.refs == 0 && f.bodyErr == nil {
+		f.canceled = true
+		f.cancel()
+		if f.resp != nil && !f.pulling {
+			f.finish(context.Canceled)
+		}
+	}
+	f.closeIfDone()
+}
+
+func (f *flight) closeIfDone() {
+	if f.refs == 0 && f.bodyErr != nil && !f.closed {
+		f.closed = true
+		_ = f.buf.Close()
+	}
+}
+
+// response return a copy of the shared response for req, the body holds the caller until closed
+func (f *flight) response(req *http.Request) *http.Response {
+	resp := *f.resp
+	resp.Header = f.resp.Header.Clone()
+	resp.Request = req
+	r := &flightReader{f: f, done: make(chan struct{})}
+	resp.Body = r
+	// unblock the read when the caller is gone
+	go func() {
+		select {
+		case <-req.Context().Done():
+			f.mu.Lock()
+			r.err = req.Context().Err()
+			f.cond.Broadcast()
+			f.mu.Unlock()
+		case <-r.done:
+		}
+	}()
+	return &resp
+}
+
+// flightReader reads the shared body from its own offset, blocks until more data arrived
+type flightReader struct {
+	f    *flight
+	off  int64
+	err  error
+	done chan struct{}
+	once sync.Once
+}
+
+func (r *flightReader) Read(p []byte) (n int, err error) {
+	f := r.f
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for r.err == nil && r.off >= f.buf.Size() && f.bodyErr == nil {
+		if f.pulling {
+			f.cond.Wait()
+		} else {
+			f.pull()
+		}
+	}
+	switch {
+	case r.err != nil:
+		return 0, r.err
+	case r.off < f.buf.Size():
+		n, err = f.buf.ReadAt(p, r.off)
+		r.off += int64(n)
+		if err == io.EOF {
+			err = nil
+		}
+		return
+	default:
+		return 0, f.bodyErr
+	}
+}
+
+func (r *flightReader) Close() error {
+	r.once.Do(func() {
+		r.f.mu.Lock()
+		r.err = http.ErrBodyReadAfterClose
+		r.f.mu.Unlock()
+		close(r.done)
+		r.f.release()
+	})
+	return nil
+}
+
+// detachedContext keeps the values of the parent without the cancellation
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (deadline time.Time, ok bool) {
+	return
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
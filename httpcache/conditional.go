@@ -0,0 +1,133 @@
+package httpcache
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// checkConditional evaluate the preconditions of req against the cached resp as per RFC 9110 13.2.2,
+// return http.StatusNotModified, http.StatusPreconditionFailed or 0 to serve resp
+func checkConditional(req *http.Request, resp *http.Response) int {
+	if resp.StatusCode != http.StatusOK {
+		return 0
+	}
+	etag := resp.Header.Get("Etag")
+	lastModified := resp.Header.Get("Last-Modified")
+	if im := req.Header.Get("If-Match"); im != "" {
+		if !etagMatches(im, etag, false) {
+			return http.StatusPreconditionFailed
+		}
+	} else if ius := req.Header.Get("If-Unmodified-Since"); ius != "" {
+		if modifiedSince(lastModified, ius) {
+			return http.StatusPreconditionFailed
+		}
+	}
+	get := req.Method == http.MethodGet || req.Method == http.MethodHead
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		if !etagMatches(inm, etag, true) {
+			return 0
+		}
+		if get {
+			return http.StatusNotModified
+		}
+		return http.StatusPreconditionFailed
+	}
+	if ims := req.Header.Get("If-Modified-Since"); ims != "" && get && lastModified != "" && !modifiedSince(lastModified, ims) {
+		return http.StatusNotModified
+	}
+	return 0
+}
+
+// etagMatches return true if etag is in the list, `*` matches any, weak comparison ignores the W/ prefix
+func etagMatches(list string, etag string, weak bool) bool {
+	if strings.TrimSpace(list) == "*" {
+		return etag != ""
+	}
+	if etag == "" || (!weak && strings.HasPrefix(etag, "W/")) {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, v := range strings.Split(list, ",") {
+		v = textproto.TrimString(v)
+		if !weak && strings.HasPrefix(v, "W/") {
+			continue
+		}
+		if strings.TrimPrefix(v, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// modifiedSince return true if lastModified is after the date, false if any is invalid
+func modifiedSince(lastModified string, date string) bool {
+	lm, err := http.ParseTime(lastModified)
+	if err != nil {
+		return false
+	}
+	t, err := http.ParseTime(date)
+	return err == nil && lm.After(t)
+}
+
+// clientValidators are the preconditions evaluated by the cache instead of upstream
+var clientValidators = []string{"If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since"}
+
+// hasValidators return true if req has any client validator
+func hasValidators(req *http.Request) bool {
+	for _, h := range clientValidators {
+		if req.Header.Get(h) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutValidators return req without the client validators, so upstream answers the full response of the cached one
+func withoutValidators(req *http.Request) *http.Request {
+	if !hasValidators(req) {
+		return req
+	}
+	req = cloneRequest(req)
+	for _, h := range clientValidators {
+		req.Header.Del(h)
+	}
+	return req
+}
+
+// conditionalResponse answer the conditional req from resp, return resp if the preconditions pass,
+// drain reads the body to EOF before closing so it can be stored, only if resp is being stored
+func conditionalResponse(req *http.Request, resp *http.Response, drain bool) *http.Response {
+	status := checkConditional(req, resp)
+	if status == 0 {
+		return resp
+	}
+	header := http.Header{}
+	if v := resp.Header.Get(XFromCache); v != "" {
+		header.Set(XFromCache, v)
+	}
+	if status == http.StatusNotModified {
+		// the validators and the cache headers of the selected response
+		header = resp.Header.Clone()
+		for _, h := range []string{"Content-Length", "Content-Encoding", "Content-Range", "Transfer-Encoding"} {
+			header.Del(h)
+		}
+	}
+	if drain {
+		_, _ = io.Copy(io.Discard, resp.Body)
+	}
+	_ = resp.Body.Close()
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          http.NoBody,
+		ContentLength: 0,
+		Request:       req,
+	}
+}
@@ -0,0 +1,239 @@
+package dbcache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/wenerme/proxc/httpcache/dbcache/models"
+	"gorm.io/gorm"
+)
+
+// ErrBlobNotFound is returned by BlobStore.GetBlob when the blob does not exist
+var ErrBlobNotFound = errors.New("blob not found")
+
+// BlobStore stores file content by sha256 hash
+type BlobStore interface {
+	// PutBlob stores the content of r by hash, do nothing if exists
+	PutBlob(hash string, r io.Reader) error
+	// GetBlob returns the content of hash, ErrBlobNotFound if not exists
+	GetBlob(hash string) (io.ReadCloser, error)
+	HasBlob(hash string) (bool, error)
+	DeleteBlob(hash string) error
+}
+
+// DBBlobStore stores blob as models.FileChunk in DB
+type DBBlobStore struct {
+	DB        *gorm.DB
+	ChunkSize int
+}
+
+func (s *DBBlobStore) PutBlob(hash string, r io.Reader) (err error) {
+	ok, err := s.HasBlob(hash)
+	if err != nil || ok {
+		return
+	}
+	return s.DB.Transaction(func(tx *gorm.DB) error {
+		_, err := WriteFileChunks(tx, hash, r, s.ChunkSize)
+		return err
+	})
+}
+
+func (s *DBBlobStore) GetBlob(hash string) (io.ReadCloser, error) {
+	n, err := s.count(hash)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, ErrBlobNotFound
+	}
+	return NewFileChunkReader(s.DB, hash, int(n)), nil
+}
+
+func (s *DBBlobStore) HasBlob(hash string) (bool, error) {
+	n, err := s.count(hash)
+	return n > 0, err
+}
+
+func (s *DBBlobStore) DeleteBlob(hash string) error {
+	return s.DB.Where(models.FileChunk{Hash: hash}).Delete(&models.FileChunk{}).Error
+}
+
+// ListBlobs implements BlobLister
+func (s *DBBlobStore) ListBlobs(fn func(hash string, createdAt time.Time) error) error {
+	var chunks []*models.FileChunk
+	return s.DB.Select("id", "hash", "created_at").Where("seq = 0").FindInBatches(&chunks, 500, func(tx *gorm.DB, batch int) error {
+		for _, v := range chunks {
+			if err := fn(v.Hash, v.CreatedAt); err != nil {
+				return err
+			}
+		}
+		return nil
+	}).Error
+}
+
+func (s *DBBlobStore) count(hash string) (n int64, err error) {
+	err = s.DB.Model(&models.FileChunk{}).Where(models.FileChunk{Hash: hash}).Count(&n).Error
+	return
+}
+
+// FSBlobStore stores blob as `<Dir>/ab/cd/<sha256>` file
+type FSBlobStore struct {
+	Dir string
+}
+
+func (s *FSBlobStore) Path(hash string) string {
+	if len(hash) < 4 {
+		return filepath.Join(s.Dir, hash)
+	}
+	return filepath.Join(s.Dir, hash[:2], hash[2:4], hash)
+}
+
+// PutBlob write to a temp file then rename, the content must match the hash
+func (s *FSBlobStore) PutBlob(hash string, r io.Reader) (err error) {
+	ok, err := s.HasBlob(hash)
+	if err != nil || ok {
+		return
+	}
+	fn := s.Path(hash)
+	dir := filepath.Dir(fn)
+	if err = os.MkdirAll(dir, 0o755); err != nil {
+		return
+	}
+	f, err := os.CreateTemp(dir, ".tmp-"+filepath.Base(fn)+"-*")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = f.Close()
+			_ = os.Remove(f.Name())
+		}
+	}()
+
+	sum := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(f, sum), r); err != nil {
+		return
+	}
+	if actual := hex.EncodeToString(sum.Sum(nil)); actual != hash {
+		return errors.Errorf("blob hash mismatch: expected %s, got %s", hash, actual)
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+	if err = os.Chmod(f.Name(), 0o644); err != nil {
+		return
+	}
+	return os.Rename(f.Name(), fn)
+}
+
+func (s *FSBlobStore) GetBlob(hash string) (io.ReadCloser, error) {
+	f, err := os.Open(s.Path(hash))
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+	return f, err
+}
+
+func (s *FSBlobStore) HasBlob(hash string) (bool, error) {
+	_, err := os.Stat(s.Path(hash))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *FSBlobStore) DeleteBlob(hash string) error {
+	err := os.Remove(s.Path(hash))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// ListBlobs implements BlobLister, the modification time is used as creation time
+func (s *FSBlobStore) ListBlobs(fn func(hash string, createdAt time.Time) error) error {
+	err := filepath.WalkDir(s.Dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return fn(d.Name(), fi.ModTime())
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+type MigrateBlobsOptions struct {
+	FileDB *gorm.DB
+	Blobs  BlobStore
+	// BatchSize of FileContent to process, default to 100
+	BatchSize int
+	// Migrated is the number of migrated files
+	Migrated int
+}
+
+// MigrateBlobs move inline models.FileContent Content and models.FileChunk in FileDB to Blobs
+func MigrateBlobs(o *MigrateBlobsOptions) (err error) {
+	if o.BatchSize <= 0 {
+		o.BatchSize = 100
+	}
+	chunks := &DBBlobStore{DB: o.FileDB}
+	_, toDB := o.Blobs.(*DBBlobStore)
+
+	var lastID uint
+	for {
+		var files []*models.FileContent
+		err = o.FileDB.Where("id > ?", lastID).Order("id").Limit(o.BatchSize).Find(&files).Error
+		if err != nil || len(files) == 0 {
+			return
+		}
+		lastID = files[len(files)-1].ID
+		for _, fc := range files {
+			switch {
+			case fc.Content != nil:
+				err = o.Blobs.PutBlob(fc.Hash, bytes.NewReader(fc.Content))
+				if err == nil {
+					err = o.FileDB.Model(fc).Update("content", nil).Error
+				}
+			case !toDB:
+				err = migrateChunks(chunks, o.Blobs, fc.Hash)
+			default:
+				continue
+			}
+			if err == ErrBlobNotFound {
+				err = nil
+				continue
+			}
+			if err != nil {
+				return errors.Wrapf(err, "migrate blob %s", fc.Hash)
+			}
+			o.Migrated++
+		}
+	}
+}
+
+func migrateChunks(from *DBBlobStore, to BlobStore, hash string) (err error) {
+	r, err := from.GetBlob(hash)
+	if err != nil {
+		return
+	}
+	err = to.PutBlob(hash, r)
+	_ = r.Close()
+	if err == nil {
+		err = from.DeleteBlob(hash)
+	}
+	return
+}
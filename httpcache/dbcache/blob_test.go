@@ -0,0 +1,52 @@
+package dbcache_test
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wenerme/proxc/httpcache"
+	"github.com/wenerme/proxc/httpcache/dbcache"
+	"github.com/wenerme/proxc/httpcache/dbcache/models"
+	"github.com/wenerme/proxc/httpcache/dbcache/sqlitecache"
+	"github.com/wenerme/wego/testx"
+)
+
+func TestFSBlobStore(t *testing.T) {
+	server := newTestServer()
+	defer server.Close()
+	dir := t.TempDir()
+	cache := sqlitecache.NewSQLiteCache(dir)
+	tp := httpcache.NewTransport(cache)
+	client := http.Client{Transport: tp}
+
+	resp := testx.Must(client.Get(server.URL + "/file"))
+	_, _ = io.ReadAll(resp.Body)
+	resp = testx.Must(client.Get(server.URL + "/file"))
+	assert.Equal(t, "1", resp.Header.Get(httpcache.XFromCache))
+	assert.True(t, bytes.Equal(testData, testx.Must(io.ReadAll(resp.Body))))
+
+	hash := models.ContentHashBytes(testData)
+	blobs := cache.Blobs.(*dbcache.FSBlobStore)
+	assert.Equal(t, filepath.Join(dir, "blobs", hash[:2], hash[2:4], hash), blobs.Path(hash))
+	assert.True(t, bytes.Equal(testData, testx.Must(os.ReadFile(blobs.Path(hash)))))
+
+	// legacy inline content
+	_, fdb, _ := cache.GetDB(resp.Request)
+	legacy := []byte("legacy content")
+	legacyHash := models.ContentHashBytes(legacy)
+	testx.NoErr(fdb.Create(&models.FileContent{Hash: legacyHash, Content: legacy}).Error)
+	mo := &dbcache.MigrateBlobsOptions{FileDB: fdb, Blobs: blobs}
+	testx.NoErr(dbcache.MigrateBlobs(mo))
+	assert.Equal(t, 1, mo.Migrated)
+	assert.True(t, bytes.Equal(legacy, testx.Must(os.ReadFile(blobs.Path(legacyHash)))))
+	fc := &models.FileContent{}
+	testx.NoErr(fdb.Where(models.FileContent{Hash: legacyHash}).First(fc).Error)
+	assert.Nil(t, fc.Content)
+
+	assert.Error(t, blobs.PutBlob(models.ContentHashBytes([]byte("a")), bytes.NewReader([]byte("b"))))
+}
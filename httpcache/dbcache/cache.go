@@ -2,13 +2,37 @@ package dbcache
 
 import (
 	"net/http"
+	"time"
 
+	"github.com/wenerme/proxc/httpcache/cachekey"
 	"github.com/wenerme/proxc/httpcache/dbcache/models"
 	"gorm.io/gorm"
 )
 
 type Cache struct {
 	GetDB func(r *http.Request) (*gorm.DB, *gorm.DB, error)
+	// Blobs stores the file content, default to DBBlobStore of file db
+	Blobs BlobStore
+	// LargeBodySize is the size of body to store as file, default to DefaultLargeBodySize
+	LargeBodySize int64
+	// SpoolDir is the temp dir for large body
+	SpoolDir string
+	// KeepPrevious archive the previous response as models.HTTPResponseVersion instead of overwriting
+	KeepPrevious bool
+	// History record every distinct response as models.HTTPResponseVersion
+	History bool
+	// RedactHeaders are the request headers to redact, default to models.DefaultRedactHeaders, empty to keep all
+	RedactHeaders []string
+	// Observer is notified after each get and set, optional
+	Observer Observer
+}
+
+// Observer is notified of the operations of Cache, called concurrently
+type Observer interface {
+	// ObserveGet is called after GetResponse, resp is nil on miss
+	ObserveGet(req *http.Request, resp *http.Response, d time.Duration, err error)
+	// ObserveSet is called after SetResponse, hr is the stored response, nil on error
+	ObserveSet(req *http.Request, hr *models.HTTPResponse, d time.Duration, err error)
 }
 
 func (d *Cache) SetResponse(resp *http.Response) (err error) {
@@ -16,11 +40,23 @@ func (d *Cache) SetResponse(resp *http.Response) (err error) {
 	if err != nil {
 		return err
 	}
-	return SetResponse(&SetResponseOptions{
-		DB:       db,
-		FileDB:   file,
-		Response: resp,
-	})
+	o := &SetResponseOptions{
+		DB:            db,
+		FileDB:        file,
+		Response:      resp,
+		Blobs:         d.Blobs,
+		LargeBodySize: d.LargeBodySize,
+		SpoolDir:      d.SpoolDir,
+		KeepPrevious:  d.KeepPrevious,
+		History:       d.History,
+		RedactHeaders: d.RedactHeaders,
+	}
+	start := time.Now()
+	err = SetResponse(o)
+	if d.Observer != nil {
+		d.Observer.ObserveSet(resp.Request, o.Stored, time.Since(start), err)
+	}
+	return
 }
 
 func (d *Cache) GetResponse(req *http.Request) (resp *http.Response, err error) {
@@ -28,22 +64,34 @@ func (d *Cache) GetResponse(req *http.Request) (resp *http.Response, err error)
 	if err != nil {
 		return
 	}
-	return GetResponse(&GetResponseOptions{
+	start := time.Now()
+	resp, err = GetResponse(&GetResponseOptions{
 		DB:      db,
 		FileDB:  file,
+		Blobs:   d.Blobs,
 		Request: req,
 	})
+	if d.Observer != nil {
+		d.Observer.ObserveGet(req, resp, time.Since(start), err)
+	}
+	return
 }
 
-func (d *Cache) DeleteResponse(req *http.Request) error {
-	db, _, err := d.GetDB(req)
+// DeleteResponse delete the responses of req and the file refs no longer referenced, pinned responses are kept,
+// the file content is collected by GCFiles
+func (d *Cache) DeleteResponse(req *http.Request) (err error) {
+	db, file, err := d.GetDB(req)
 	if err != nil {
 		return err
 	}
-	// delete file ?
-	out := models.HTTPResponse{}
-	return db.Where(models.HTTPResponse{
-		Method: req.Method,
-		URL:    req.URL.String(),
-	}).Delete(&out).Error
+	key := cachekey.FromRequest(req)
+	var deleted []*models.HTTPResponse
+	err = db.Select("content_hash", "url").Where("method = ? AND cache_key = ? AND content_hash != '' AND coalesce(pinned, false) = false", req.Method, key).Find(&deleted).Error
+	if err != nil {
+		return
+	}
+	if err = db.Where("method = ? AND cache_key = ? AND coalesce(pinned, false) = false", req.Method, key).Delete(&models.HTTPResponse{}).Error; err != nil || file == nil {
+		return
+	}
+	return deleteFileRefs(db, file, deleted)
 }
@@ -0,0 +1,196 @@
+package dbcache
+
+import (
+	"bytes"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/wenerme/proxc/httpcache/dbcache/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// DefaultChunkSize is the default size of models.FileChunk
+const DefaultChunkSize = 1 << 20
+
+// WriteFileChunks split r into models.FileChunk of hash, return the number of chunks
+func WriteFileChunks(db *gorm.DB, hash string, r io.Reader, size int) (n int, err error) {
+	return splitChunks(r, size, func(chunk *models.FileChunk) error {
+		chunk.Hash = hash
+		return db.Clauses(clause.OnConflict{Columns: chunk.ConflictColumns(), UpdateAll: true}).Create(chunk).Error
+	})
+}
+
+func splitChunks(r io.Reader, size int, fn func(chunk *models.FileChunk) error) (n int, err error) {
+	if size <= 0 {
+		size = DefaultChunkSize
+	}
+	for {
+		buf := make([]byte, size)
+		var l int
+		l, err = io.ReadFull(r, buf)
+		if l > 0 {
+			if err := fn(&models.FileChunk{Seq: n, Data: buf[:l]}); err != nil {
+				return n, err
+			}
+			n++
+		}
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			return n, nil
+		default:
+			return n, err
+		}
+	}
+}
+
+// NewFileChunkReader read chunks of hash sequentially, only one chunk is loaded at a time,
+// the reader is also an io.ReaderAt and io.Seeker
+func NewFileChunkReader(db *gorm.DB, hash string, chunks int) io.ReadCloser {
+	return &chunkReader{db: db, hash: hash, chunks: chunks}
+}
+
+type chunkReader struct {
+	db     *gorm.DB
+	hash   string
+	chunks int
+	seq    int
+	cur    bytes.Reader
+	offset int64
+	skip   int64
+
+	mu        sync.Mutex
+	stated    bool
+	chunkSize int64
+	size      int64
+	at        *models.FileChunk // last chunk loaded by ReadAt
+}
+
+func (r *chunkReader) Read(p []byte) (n int, err error) {
+	for r.cur.Len() == 0 {
+		if r.seq >= r.chunks {
+			return 0, io.EOF
+		}
+		var chunk *models.FileChunk
+		if chunk, err = r.load(r.seq); err != nil {
+			return 0, err
+		}
+		r.cur.Reset(chunk.Data)
+		if r.skip > 0 {
+			_, _ = r.cur.Seek(r.skip, io.SeekStart)
+			r.skip = 0
+		}
+		r.seq++
+	}
+	n, err = r.cur.Read(p)
+	r.offset += int64(n)
+	return
+}
+
+// ReadAt implements io.ReaderAt, only the chunks of the section are loaded
+func (r *chunkReader) ReadAt(p []byte, off int64) (n int, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err = r.stat(); err != nil {
+		return
+	}
+	if off < 0 {
+		return 0, errors.New("chunk reader: negative offset")
+	}
+	for n < len(p) {
+		if off >= r.size {
+			return n, io.EOF
+		}
+		seq := int(off / r.chunkSize)
+		if r.at == nil || r.at.Seq != seq {
+			if r.at, err = r.load(seq); err != nil {
+				return
+			}
+		}
+		m := copy(p[n:], r.at.Data[off%r.chunkSize:])
+		n += m
+		off += int64(m)
+	}
+	return
+}
+
+// Seek implements io.Seeker, the chunk of the offset is loaded by the next Read
+func (r *chunkReader) Seek(offset int64, whence int) (abs int64, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err = r.stat(); err != nil {
+		return
+	}
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = r.offset + offset
+	case io.SeekEnd:
+		abs = r.size + offset
+	default:
+		return 0, errors.New("chunk reader: invalid whence")
+	}
+	if abs < 0 {
+		return 0, errors.New("chunk reader: negative position")
+	}
+	r.offset = abs
+	r.cur.Reset(nil)
+	r.seq, r.skip = r.chunks, 0
+	if abs < r.size {
+		r.seq, r.skip = int(abs/r.chunkSize), abs%r.chunkSize
+	}
+	return
+}
+
+// stat load the chunk size and the total size, the chunks are of the same size except the last one
+func (r *chunkReader) stat() (err error) {
+	if r.stated || r.chunks == 0 {
+		return
+	}
+	var sizes []struct {
+		Seq  int
+		Size int64
+	}
+	err = r.db.Model(&models.FileChunk{}).Select("seq, length(data) AS size").
+		Where("hash = ? AND seq IN ?", r.hash, []int{0, r.chunks - 1}).Scan(&sizes).Error
+	if err != nil {
+		return
+	}
+	last := int64(-1)
+	for _, v := range sizes {
+		if v.Seq == 0 {
+			r.chunkSize = v.Size
+		}
+		if v.Seq == r.chunks-1 {
+			last = v.Size
+		}
+	}
+	if r.chunkSize == 0 || last < 0 {
+		return errors.Errorf("file %s chunks not found", r.hash)
+	}
+	r.size = r.chunkSize*int64(r.chunks-1) + last
+	r.stated = true
+	return
+}
+
+func (r *chunkReader) load(seq int) (chunk *models.FileChunk, err error) {
+	chunk = &models.FileChunk{}
+	err = r.db.Where("hash = ? AND seq = ?", r.hash, seq).Limit(1).Find(chunk).Error
+	if err != nil {
+		return nil, err
+	}
+	if chunk.ID == 0 {
+		return nil, errors.Errorf("file %s chunk %d not found", r.hash, seq)
+	}
+	return
+}
+
+func (r *chunkReader) Close() error {
+	r.seq = r.chunks
+	r.cur.Reset(nil)
+	r.at = nil
+	return nil
+}
@@ -0,0 +1,39 @@
+package dbcache_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+
+	"github.com/wenerme/proxc/httpencoding"
+	"github.com/wenerme/wego/testx"
+)
+
+var testData = bytes.Repeat([]byte("Hello proxc\n"), 1000)
+
+// newTestServer serves testData as an attachment at /file, and encoded by Accept-Encoding at /encoding
+func newTestServer() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Disposition", "attachment; filename=data.txt")
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Length", strconv.Itoa(len(testData)))
+		testx.Must(w.Write(testData))
+	})
+	mux.HandleFunc("/encoding", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Cache-Control", "max-age=3600")
+		writer := httpencoding.AcceptEncodingWriter(w, r)
+		testx.Must(writer.Write(testData))
+		testx.NoErr(writer.Close())
+	})
+	return httptest.NewServer(mux)
+}
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
@@ -0,0 +1,290 @@
+package dbcache
+
+import (
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/wenerme/proxc/httpcache/dbcache/models"
+	"gorm.io/gorm"
+)
+
+const (
+	// EvictLRU evicts the least recently accessed responses first
+	EvictLRU = "lru"
+	// EvictLFU evicts the least frequently accessed responses first, then the least recently accessed
+	EvictLFU = "lfu"
+)
+
+// DefaultFileGrace is the default age of files to collect, the file is stored before the response referencing it
+const DefaultFileGrace = 10 * time.Minute
+
+type EvictOptions struct {
+	// DBs of responses by host
+	DBs    map[string]*gorm.DB
+	FileDB *gorm.DB
+	// Blobs stores the file content, default to DBBlobStore of FileDB
+	Blobs BlobStore
+	// MaxSize is the max total size of responses and versions, 0 for no limit
+	MaxSize int64
+	// MaxHostSize is the max size of responses and versions per host, 0 for no limit
+	MaxHostSize int64
+	// MaxEntries is the max number of responses and versions, 0 for no limit
+	MaxEntries int64
+	// MaxAge evicts responses not accessed within, 0 for no limit
+	MaxAge time.Duration
+	// Policy to pick victims, EvictLRU or EvictLFU, default to EvictLRU
+	Policy string
+	// Now default to time.Now
+	Now time.Time
+
+	// Evicted is the number of evicted responses and versions
+	Evicted int64
+	// EvictedSize is the size of evicted responses and versions
+	EvictedSize int64
+	// Files is the result of collecting the unreferenced files
+	Files *GCFilesOptions
+}
+
+// evictEntry is the response or version to pick victims, the version is accessed when it's last seen
+type evictEntry struct {
+	ID         uint
+	UpdatedAt  time.Time
+	AccessedAt *time.Time
+	Hits       int64
+	Pinned     bool
+	Size       int64
+
+	host    string
+	version bool
+}
+
+// evictSize is the size of the body stored in db plus the file
+const evictSize = `coalesce(body_size, 0) + coalesce(length(request_body), 0) + (case when content_hash != '' then raw_size else 0 end) as size`
+
+// evictVictim is the table of the evicted entry
+type evictVictim struct {
+	host    string
+	version bool
+}
+
+func (e *evictEntry) lastAccess() time.Time {
+	if e.AccessedAt != nil && e.AccessedAt.After(e.UpdatedAt) {
+		return *e.AccessedAt
+	}
+	return e.UpdatedAt
+}
+
+// Evict remove responses and versions exceed the limits, pinned responses are never evicted but are counted,
+// the size of a response or version is the body stored in db plus the file, then collect the unreferenced files
+func Evict(o *EvictOptions) (err error) {
+	if o.Now.IsZero() {
+		o.Now = time.Now()
+	}
+	var less func(a, b *evictEntry) bool
+	switch o.Policy {
+	case "", EvictLRU:
+		less = func(a, b *evictEntry) bool {
+			return a.lastAccess().Before(b.lastAccess())
+		}
+	case EvictLFU:
+		less = func(a, b *evictEntry) bool {
+			if a.Hits != b.Hits {
+				return a.Hits < b.Hits
+			}
+			return a.lastAccess().Before(b.lastAccess())
+		}
+	default:
+		return errors.Errorf("invalid evict policy %q", o.Policy)
+	}
+
+	victims := map[evictVictim][]uint{}
+	evict := func(e *evictEntry) {
+		k := evictVictim{host: e.host, version: e.version}
+		victims[k] = append(victims[k], e.ID)
+		o.Evicted++
+		o.EvictedSize += e.Size
+	}
+	var all []*evictEntry
+	var total int64
+	for host, db := range o.DBs {
+		var entries, versions []*evictEntry
+		err = db.Model(&models.HTTPResponse{}).Select("id, updated_at, accessed_at, coalesce(hits, 0) as hits, pinned, " + evictSize).
+			Find(&entries).Error
+		if err != nil {
+			return errors.Wrapf(err, "load responses of %s", host)
+		}
+		if db.Migrator().HasTable(&models.HTTPResponseVersion{}) {
+			err = db.Model(&models.HTTPResponseVersion{}).Select("id, updated_at, " + evictSize).Find(&versions).Error
+			if err != nil {
+				return errors.Wrapf(err, "load versions of %s", host)
+			}
+			for _, v := range versions {
+				v.version = true
+			}
+			// the version goes before the response of the same access time
+			entries = append(versions, entries...)
+		}
+		sort.SliceStable(entries, func(i, j int) bool {
+			return less(entries[i], entries[j])
+		})
+
+		var size int64
+		kept := entries[:0]
+		for _, e := range entries {
+			e.host = host
+			if !e.Pinned && o.MaxAge > 0 && o.Now.Sub(e.lastAccess()) > o.MaxAge {
+				evict(e)
+				continue
+			}
+			size += e.Size
+			kept = append(kept, e)
+		}
+		entries = kept
+		if o.MaxHostSize > 0 {
+			kept = entries[:0]
+			for _, e := range entries {
+				if !e.Pinned && size > o.MaxHostSize {
+					size -= e.Size
+					evict(e)
+					continue
+				}
+				kept = append(kept, e)
+			}
+			entries = kept
+		}
+		total += size
+		all = append(all, entries...)
+	}
+
+	if o.MaxSize > 0 || o.MaxEntries > 0 {
+		sort.SliceStable(all, func(i, j int) bool {
+			return less(all[i], all[j])
+		})
+		count := int64(len(all))
+		for _, e := range all {
+			if (o.MaxSize <= 0 || total <= o.MaxSize) && (o.MaxEntries <= 0 || count <= o.MaxEntries) {
+				break
+			}
+			if e.Pinned {
+				continue
+			}
+			total -= e.Size
+			count--
+			evict(e)
+		}
+	}
+
+	for k, ids := range victims {
+		var model interface{} = &models.HTTPResponse{}
+		if k.version {
+			model = &models.HTTPResponseVersion{}
+		}
+		for len(ids) > 0 {
+			n := len(ids)
+			if n > 500 {
+				n = 500
+			}
+			if err = o.DBs[k.host].Where("id IN ?", ids[:n]).Delete(model).Error; err != nil {
+				return errors.Wrapf(err, "evict responses of %s", k.host)
+			}
+			ids = ids[n:]
+		}
+	}
+
+	if o.FileDB == nil {
+		return
+	}
+	o.Files = &GCFilesOptions{FileDB: o.FileDB, Blobs: o.Blobs}
+	for _, db := range o.DBs {
+		o.Files.DBs = append(o.Files.DBs, db)
+	}
+	return GCFiles(o.Files)
+}
+
+type GCFilesOptions struct {
+	// DBs of responses referencing the files, all dbs must be included
+	DBs    []*gorm.DB
+	FileDB *gorm.DB
+	// Blobs stores the file content, default to DBBlobStore of FileDB
+	Blobs BlobStore
+	// Before only collect files created before, default to DefaultFileGrace ago
+	Before time.Time
+
+	// Files is the number of deleted files
+	Files int64
+	// Size is the size of deleted files
+	Size int64
+	// Refs is the number of deleted file refs
+	Refs int64
+}
+
+// GCFiles delete the models.FileContent and models.FileRef not referenced by any response or version
+func GCFiles(o *GCFilesOptions) (err error) {
+	if o.Blobs == nil {
+		o.Blobs = &DBBlobStore{DB: o.FileDB}
+	}
+	if o.Before.IsZero() {
+		o.Before = time.Now().Add(-DefaultFileGrace)
+	}
+
+	// hash -> url
+	refs := map[string]map[string]bool{}
+	for _, db := range o.DBs {
+		for _, model := range []interface{}{&models.HTTPResponse{}, &models.HTTPResponseVersion{}} {
+			var rows []struct {
+				ContentHash string
+				URL         string
+			}
+			if err = db.Model(model).Distinct("content_hash", "url").Where("content_hash != ''").Find(&rows).Error; err != nil {
+				return
+			}
+			for _, v := range rows {
+				if refs[v.ContentHash] == nil {
+					refs[v.ContentHash] = map[string]bool{}
+				}
+				refs[v.ContentHash][v.URL] = true
+			}
+		}
+	}
+
+	var fileRefs []*models.FileRef
+	err = o.FileDB.Select("id", "hash", "url").Where("created_at < ?", o.Before).
+		FindInBatches(&fileRefs, 500, func(tx *gorm.DB, batch int) error {
+			var ids []uint
+			for _, v := range fileRefs {
+				if !refs[v.Hash][v.URL] {
+					ids = append(ids, v.ID)
+				}
+			}
+			if len(ids) == 0 {
+				return nil
+			}
+			r := o.FileDB.Where("id IN ?", ids).Delete(&models.FileRef{})
+			o.Refs += r.RowsAffected
+			return r.Error
+		}).Error
+	if err != nil {
+		return errors.Wrap(err, "collect file refs")
+	}
+
+	var files []*models.FileContent
+	err = o.FileDB.Select("id", "hash", "size").Where("created_at < ?", o.Before).
+		FindInBatches(&files, 500, func(tx *gorm.DB, batch int) error {
+			for _, v := range files {
+				if refs[v.Hash] != nil {
+					continue
+				}
+				if err := o.Blobs.DeleteBlob(v.Hash); err != nil {
+					return errors.Wrapf(err, "delete blob %s", v.Hash)
+				}
+				if err := o.FileDB.Delete(&models.FileContent{}, v.ID).Error; err != nil {
+					return err
+				}
+				o.Files++
+				o.Size += v.Size
+			}
+			return nil
+		}).Error
+	return errors.Wrap(err, "collect files")
+}
@@ -0,0 +1,171 @@
+package dbcache_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wenerme/proxc/httpcache"
+	"github.com/wenerme/proxc/httpcache/dbcache"
+	"github.com/wenerme/proxc/httpcache/dbcache/models"
+	"github.com/wenerme/proxc/httpcache/dbcache/sqlitecache"
+	"github.com/wenerme/wego/testx"
+	"gorm.io/gorm"
+)
+
+func TestEvict(t *testing.T) {
+	set := &sqlitecache.Set{Dir: t.TempDir()}
+	defer set.Close()
+	cache := sqlitecache.NewSetCache(set)
+	cache.LargeBodySize = 1000
+	tp := httpcache.NewTransport(cache)
+	tp.Transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		n := 500
+		if req.URL.Path == "/file" {
+			n = 5000
+		}
+		data := make([]byte, n)
+		testx.Must(rand.Read(data))
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header: http.Header{
+				"Cache-Control": {"max-age=3600"},
+				"Content-Type":  {"application/octet-stream"},
+				"Date":          {time.Now().UTC().Format(http.TimeFormat)},
+			},
+			Body:          io.NopCloser(bytes.NewReader(data)),
+			ContentLength: int64(n),
+			Request:       req,
+		}, nil
+	})
+	client := http.Client{Transport: tp}
+	get := func(u string) {
+		resp := testx.Must(client.Get(u))
+		_, _ = io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+	}
+	for _, u := range []string{"http://a.test/1", "http://a.test/2", "http://a.test/3", "http://a.test/4", "http://b.test/1", "http://b.test/2", "http://a.test/file"} {
+		get(u)
+	}
+	for _, u := range []string{"http://a.test/1", "http://a.test/1", "http://a.test/1", "http://a.test/2"} {
+		get(u)
+	}
+
+	adb := testx.Must(sqlitecache.OpenHostDB(set, "a.test"))
+	bdb := testx.Must(sqlitecache.OpenHostDB(set, "b.test"))
+	fdb := testx.Must(sqlitecache.OpenFileDB(set))
+	var autoVacuum int
+	testx.NoErr(adb.Raw("PRAGMA auto_vacuum").Scan(&autoVacuum).Error)
+	assert.Equal(t, 2, autoVacuum)
+	hr := testx.Must(dbcache.FindResponse(adb, "GET", "http://a.test/1"))
+	assert.Equal(t, int64(3), hr.Hits)
+	assert.True(t, hr.AccessedAt.After(hr.UpdatedAt))
+	urls := func() (out []string) {
+		for _, db := range []*gorm.DB{adb, bdb} {
+			var list []string
+			testx.NoErr(db.Model(&models.HTTPResponse{}).Order("url").Pluck("url", &list).Error)
+			out = append(out, list...)
+		}
+		return
+	}
+
+	// by age
+	old := time.Now().Add(-2 * time.Hour)
+	testx.NoErr(bdb.Model(&models.HTTPResponse{}).Where("url = ?", "http://b.test/2").
+		UpdateColumns(map[string]interface{}{"accessed_at": old, "updated_at": old}).Error)
+	o := &dbcache.EvictOptions{MaxAge: time.Hour}
+	testx.NoErr(sqlitecache.Evict(set, o))
+	assert.Equal(t, int64(1), o.Evicted)
+	assert.Len(t, urls(), 6)
+
+	// by entries, least frequently used first, pinned never evicted
+	testx.NoErr(adb.Model(&models.HTTPResponse{}).Where("url = ?", "http://a.test/3").UpdateColumn("pinned", true).Error)
+	o = &dbcache.EvictOptions{MaxEntries: 3, Policy: dbcache.EvictLFU, Blobs: cache.Blobs}
+	testx.NoErr(sqlitecache.Evict(set, o))
+	assert.Equal(t, []string{"http://a.test/1", "http://a.test/2", "http://a.test/3"}, urls())
+	// the file is kept within the grace period
+	assert.Equal(t, int64(0), o.Files.Files)
+
+	hash := testx.Must(dbcache.FindResponse(adb, "GET", "http://a.test/1")).ContentHash
+	assert.Empty(t, hash)
+	var fc models.FileContent
+	testx.NoErr(fdb.First(&fc).Error)
+	blobs := cache.Blobs.(*dbcache.FSBlobStore)
+	assert.True(t, testx.Must(blobs.HasBlob(fc.Hash)))
+	gc := &dbcache.GCFilesOptions{DBs: []*gorm.DB{adb, bdb}, FileDB: fdb, Blobs: blobs, Before: time.Now().Add(time.Minute)}
+	testx.NoErr(dbcache.GCFiles(gc))
+	assert.Equal(t, int64(1), gc.Files)
+	assert.Equal(t, int64(5000), gc.Size)
+	assert.Equal(t, int64(1), gc.Refs)
+	assert.False(t, testx.Must(blobs.HasBlob(fc.Hash)))
+	var files int64
+	testx.NoErr(fdb.Model(&models.FileContent{}).Count(&files).Error)
+	assert.Equal(t, int64(0), files)
+
+	// by host size, least recently used first
+	o = &dbcache.EvictOptions{MaxHostSize: 600}
+	testx.NoErr(sqlitecache.Evict(set, o))
+	assert.Equal(t, []string{"http://a.test/3"}, urls())
+	assert.Error(t, sqlitecache.Evict(set, &dbcache.EvictOptions{Policy: "fifo"}))
+}
+
+func TestEvictVersions(t *testing.T) {
+	set := &sqlitecache.Set{Dir: t.TempDir()}
+	defer set.Close()
+	cache := sqlitecache.NewSetCache(set)
+	cache.History = true
+	tp := httpcache.NewTransport(cache)
+	tp.Mode = httpcache.ModeRecord
+	tp.Transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		data := make([]byte, 500)
+		testx.Must(rand.Read(data))
+		return &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        http.Header{"Content-Type": {"application/octet-stream"}},
+			Body:          io.NopCloser(bytes.NewReader(data)),
+			ContentLength: int64(len(data)),
+			Request:       req,
+		}, nil
+	})
+	client := tp.Client()
+	for i := 0; i < 10; i++ {
+		for _, u := range []string{"http://a.test/1", "http://a.test/2"} {
+			resp := testx.Must(client.Get(u))
+			_, _ = io.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+		}
+	}
+
+	db := testx.Must(sqlitecache.OpenHostDB(set, "a.test"))
+	size := func() (n int64) {
+		for _, model := range []interface{}{&models.HTTPResponse{}, &models.HTTPResponseVersion{}} {
+			var v int64
+			testx.NoErr(db.Model(model).Select("coalesce(sum(body_size), 0)").Scan(&v).Error)
+			n += v
+		}
+		return
+	}
+	var versions int64
+	testx.NoErr(db.Model(&models.HTTPResponseVersion{}).Count(&versions).Error)
+	assert.Equal(t, int64(20), versions)
+	assert.Greater(t, size(), int64(10000))
+
+	// the versions are counted and evicted before the current responses
+	o := &dbcache.EvictOptions{MaxSize: 3000}
+	testx.NoErr(sqlitecache.Evict(set, o))
+	assert.LessOrEqual(t, size(), o.MaxSize)
+	assert.NotNil(t, testx.Must(dbcache.FindResponse(db, "GET", "http://a.test/1")))
+	assert.NotNil(t, testx.Must(dbcache.FindResponse(db, "GET", "http://a.test/2")))
+
+	o = &dbcache.EvictOptions{MaxEntries: 2}
+	testx.NoErr(sqlitecache.Evict(set, o))
+	var responses int64
+	testx.NoErr(db.Model(&models.HTTPResponse{}).Count(&responses).Error)
+	testx.NoErr(db.Model(&models.HTTPResponseVersion{}).Count(&versions).Error)
+	assert.Equal(t, int64(2), responses+versions)
+	assert.NotNil(t, testx.Must(dbcache.FindResponse(db, "GET", "http://a.test/2")))
+}
@@ -0,0 +1,273 @@
+package dbcache
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/wenerme/proxc/httpcache/dbcache/models"
+	"go.uber.org/multierr"
+	"gorm.io/gorm"
+)
+
+// kinds of FsckProblem
+const (
+	// ProblemDangling is a response or version references the missing file content
+	ProblemDangling = "dangling"
+	// ProblemHashMismatch is the file content not matches the hash
+	ProblemHashMismatch = "hash-mismatch"
+	// ProblemOrphanFile is the models.FileContent not referenced
+	ProblemOrphanFile = "orphan-file"
+	// ProblemOrphanRef is the models.FileRef not referenced
+	ProblemOrphanRef = "orphan-ref"
+	// ProblemOrphanBlob is the blob without models.FileContent and not referenced
+	ProblemOrphanBlob = "orphan-blob"
+)
+
+type FsckOptions struct {
+	// DBs of responses by host, all dbs must be included
+	DBs    map[string]*gorm.DB
+	FileDB *gorm.DB
+	// Blobs stores the file content, default to DBBlobStore of FileDB, orphan blobs are checked if it's BlobLister
+	Blobs BlobStore
+	// Repair deletes the orphans, the corrupted files and the responses referencing them
+	Repair bool
+	// Before only check orphans created before, default to DefaultFileGrace ago
+	Before time.Time
+
+	// Files is the number of checked files
+	Files int
+	// Problems found
+	Problems []*FsckProblem
+}
+
+type FsckProblem struct {
+	Kind     string `json:"kind"`
+	Hash     string `json:"hash"`
+	Host     string `json:"host,omitempty"`
+	URL      string `json:"url,omitempty"`
+	Detail   string `json:"detail,omitempty"`
+	Repaired bool   `json:"repaired"`
+}
+
+// BlobLister is implemented by the BlobStore can list the blobs
+type BlobLister interface {
+	// ListBlobs call fn with the hash and creation time of every blob
+	ListBlobs(fn func(hash string, createdAt time.Time) error) error
+}
+
+// state of the file content
+const (
+	fileOK        = "ok"
+	fileMissing   = "missing"
+	fileCorrupted = "corrupted"
+)
+
+// fileUse is a response or version referencing the file content
+type fileUse struct {
+	Host    string
+	Version bool
+	ID      uint
+	URL     string
+	Hash    string
+}
+
+func loadFileUses(dbs map[string]*gorm.DB) (out map[string][]*fileUse, err error) {
+	out = map[string][]*fileUse{}
+	for host, db := range dbs {
+		for _, model := range []interface{}{&models.HTTPResponse{}, &models.HTTPResponseVersion{}} {
+			var rows []struct {
+				ID          uint
+				URL         string
+				ContentHash string
+			}
+			if err = db.Model(model).Select("id", "url", "content_hash").Where("content_hash != ''").Find(&rows).Error; err != nil {
+				return
+			}
+			_, version := model.(*models.HTTPResponseVersion)
+			for _, v := range rows {
+				out[v.ContentHash] = append(out[v.ContentHash], &fileUse{Host: host, Version: version, ID: v.ID, URL: v.URL, Hash: v.ContentHash})
+			}
+		}
+	}
+	return
+}
+
+func (u *fileUse) delete(db *gorm.DB) error {
+	if u.Version {
+		return db.Delete(&models.HTTPResponseVersion{}, u.ID).Error
+	}
+	return db.Delete(&models.HTTPResponse{}, u.ID).Error
+}
+
+// Fsck check the file contents of responses, see FsckProblem kinds
+func Fsck(o *FsckOptions) (err error) {
+	if o.Blobs == nil {
+		o.Blobs = &DBBlobStore{DB: o.FileDB}
+	}
+	if o.Before.IsZero() {
+		o.Before = time.Now().Add(-DefaultFileGrace)
+	}
+	uses, err := loadFileUses(o.DBs)
+	if err != nil {
+		return errors.Wrap(err, "load file references")
+	}
+	add := func(p *FsckProblem, repair func() error) (err error) {
+		o.Problems = append(o.Problems, p)
+		if o.Repair && repair != nil {
+			if err = repair(); err == nil {
+				p.Repaired = true
+			}
+		}
+		return errors.Wrapf(err, "repair %s %s", p.Kind, p.Hash)
+	}
+	deleteUses := func(hash string) (err error) {
+		for _, u := range uses[hash] {
+			err = multierr.Append(err, u.delete(o.DBs[u.Host]))
+		}
+		return
+	}
+	deleteFile := func(hash string) error {
+		return multierr.Combine(
+			o.Blobs.DeleteBlob(hash),
+			o.FileDB.Where("hash = ?", hash).Delete(&models.FileContent{}).Error,
+			o.FileDB.Where("hash = ?", hash).Delete(&models.FileRef{}).Error,
+		)
+	}
+
+	// state of the file content by hash
+	files := map[string]string{}
+	var list []*models.FileContent
+	err = o.FileDB.Select("id", "hash", "created_at").FindInBatches(&list, 100, func(tx *gorm.DB, batch int) error {
+		for _, fc := range list {
+			o.Files++
+			hash, err := o.hashFile(fc)
+			switch {
+			case err == ErrBlobNotFound:
+				files[fc.Hash] = fileMissing
+				err = nil
+				if len(uses[fc.Hash]) == 0 && fc.CreatedAt.Before(o.Before) {
+					fc := fc
+					err = add(&FsckProblem{Kind: ProblemOrphanFile, Hash: fc.Hash, Detail: "missing content"}, func() error {
+						return deleteFile(fc.Hash)
+					})
+				}
+			case err != nil:
+				return errors.Wrapf(err, "read file %s", fc.Hash)
+			case hash != fc.Hash:
+				files[fc.Hash] = fileCorrupted
+				fc := fc
+				err = add(&FsckProblem{Kind: ProblemHashMismatch, Hash: fc.Hash, Detail: "actual " + hash}, func() error {
+					return multierr.Combine(deleteFile(fc.Hash), deleteUses(fc.Hash))
+				})
+			default:
+				files[fc.Hash] = fileOK
+				if len(uses[fc.Hash]) == 0 && fc.CreatedAt.Before(o.Before) {
+					fc := fc
+					err = add(&FsckProblem{Kind: ProblemOrphanFile, Hash: fc.Hash}, func() error {
+						return deleteFile(fc.Hash)
+					})
+				}
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}).Error
+	if err != nil {
+		return
+	}
+
+	hashes := make([]string, 0, len(uses))
+	for hash := range uses {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	for _, hash := range hashes {
+		switch files[hash] {
+		case fileOK, fileCorrupted:
+			continue
+		case "":
+			// the blob without the file row is still served
+			var ok bool
+			if ok, err = o.Blobs.HasBlob(hash); err != nil {
+				return
+			} else if ok {
+				continue
+			}
+		}
+		for i, u := range uses[hash] {
+			u, last := u, i == len(uses[hash])-1
+			if err = add(&FsckProblem{Kind: ProblemDangling, Hash: hash, Host: u.Host, URL: u.URL}, func() error {
+				err := u.delete(o.DBs[u.Host])
+				if err == nil && last {
+					// the file row without content
+					err = deleteFile(hash)
+				}
+				return err
+			}); err != nil {
+				return
+			}
+		}
+	}
+
+	var refs []*models.FileRef
+	err = o.FileDB.Select("id", "hash", "url", "created_at").FindInBatches(&refs, 500, func(tx *gorm.DB, batch int) error {
+		for _, ref := range refs {
+			if !ref.CreatedAt.Before(o.Before) || used(uses[ref.Hash], ref.URL) {
+				continue
+			}
+			id := ref.ID
+			if err := add(&FsckProblem{Kind: ProblemOrphanRef, Hash: ref.Hash, URL: ref.URL}, func() error {
+				return o.FileDB.Delete(&models.FileRef{}, id).Error
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}).Error
+	if err != nil {
+		return
+	}
+
+	lister, ok := o.Blobs.(BlobLister)
+	if !ok {
+		return
+	}
+	return lister.ListBlobs(func(hash string, createdAt time.Time) error {
+		if _, found := files[hash]; found || len(uses[hash]) > 0 || !createdAt.Before(o.Before) {
+			return nil
+		}
+		return add(&FsckProblem{Kind: ProblemOrphanBlob, Hash: hash}, func() error {
+			return o.Blobs.DeleteBlob(hash)
+		})
+	})
+}
+
+// hashFile return the hash of the file content, ErrBlobNotFound if the content is missing
+func (o *FsckOptions) hashFile(fc *models.FileContent) (hash string, err error) {
+	var content []byte
+	if err = o.FileDB.Model(fc).Select("content").Where("id = ?", fc.ID).Row().Scan(&content); err != nil {
+		return
+	}
+	var r io.ReadCloser
+	if content != nil {
+		r = io.NopCloser(bytes.NewReader(content))
+	} else if r, err = o.Blobs.GetBlob(fc.Hash); err != nil {
+		return
+	}
+	defer r.Close()
+	return models.ContentHash(r)
+}
+
+func used(uses []*fileUse, url string) bool {
+	for _, u := range uses {
+		if u.URL == url {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,131 @@
+package dbcache_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wenerme/proxc/httpcache"
+	"github.com/wenerme/proxc/httpcache/dbcache"
+	"github.com/wenerme/proxc/httpcache/dbcache/models"
+	"github.com/wenerme/proxc/httpcache/dbcache/sqlitecache"
+	"github.com/wenerme/wego/testx"
+)
+
+func TestFsck(t *testing.T) {
+	set := &sqlitecache.Set{Dir: t.TempDir()}
+	defer set.Close()
+	cache := sqlitecache.NewSetCache(set)
+	cache.LargeBodySize = 1000
+	blobs := cache.Blobs.(*dbcache.FSBlobStore)
+	tp := httpcache.NewTransport(cache)
+	fetched := map[string]int{}
+	tp.Transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		fetched[req.URL.Path]++
+		data := make([]byte, 5000)
+		testx.Must(rand.Read(data))
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header: http.Header{
+				"Cache-Control": {"max-age=3600"},
+				"Content-Type":  {"application/octet-stream"},
+				"Date":          {time.Now().UTC().Format(http.TimeFormat)},
+			},
+			Body:          io.NopCloser(bytes.NewReader(data)),
+			ContentLength: int64(len(data)),
+			Request:       req,
+		}, nil
+	})
+	client := http.Client{Transport: tp}
+	get := func(u string) []byte {
+		resp := testx.Must(client.Get(u))
+		defer resp.Body.Close()
+		return testx.Must(io.ReadAll(resp.Body))
+	}
+	for _, u := range []string{"http://a.test/1", "http://a.test/2", "http://a.test/3", "http://a.test/4"} {
+		get(u)
+	}
+	adb := testx.Must(sqlitecache.OpenHostDB(set, "a.test"))
+	fdb := testx.Must(sqlitecache.OpenFileDB(set))
+	hashOf := func(u string) string {
+		return testx.Must(dbcache.FindResponse(adb, "GET", u)).ContentHash
+	}
+
+	// missing blob is a miss
+	h4 := hashOf("http://a.test/4")
+	testx.NoErr(blobs.DeleteBlob(h4))
+	assert.Len(t, get("http://a.test/4"), 5000)
+	assert.Equal(t, 2, fetched["/4"])
+	assert.True(t, testx.Must(blobs.HasBlob(hashOf("http://a.test/4"))))
+
+	// delete the file ref with the response
+	h3 := hashOf("http://a.test/3")
+	testx.NoErr(cache.DeleteResponse(testx.Must(http.NewRequest("GET", "http://a.test/3", nil))))
+	var refs int64
+	testx.NoErr(fdb.Model(&models.FileRef{}).Where("hash = ?", h3).Count(&refs).Error)
+	assert.Equal(t, int64(0), refs)
+
+	h1 := hashOf("http://a.test/1")
+	testx.NoErr(os.WriteFile(blobs.Path(h1), []byte("corrupted"), 0o644))
+	h2 := hashOf("http://a.test/2")
+	testx.NoErr(blobs.DeleteBlob(h2))
+	orphan := []byte("orphan blob")
+	testx.NoErr(blobs.PutBlob(models.ContentHashBytes(orphan), bytes.NewReader(orphan)))
+	testx.NoErr(fdb.Create(&models.FileRef{Hash: hashOf("http://a.test/4"), URL: "http://a.test/gone"}).Error)
+
+	kinds := func(o *dbcache.FsckOptions) map[string]string {
+		out := map[string]string{}
+		for _, p := range o.Problems {
+			out[p.Hash+" "+p.URL] = p.Kind
+		}
+		return out
+	}
+	before := time.Now().Add(time.Minute)
+	// within the grace period
+	o := &dbcache.FsckOptions{Blobs: blobs}
+	testx.NoErr(sqlitecache.Fsck(set, o))
+	assert.Equal(t, 5, o.Files)
+	assert.Equal(t, map[string]string{
+		h1 + " ":                dbcache.ProblemHashMismatch,
+		h2 + " http://a.test/2": dbcache.ProblemDangling,
+	}, kinds(o))
+
+	o = &dbcache.FsckOptions{Blobs: blobs, Before: before}
+	testx.NoErr(sqlitecache.Fsck(set, o))
+	assert.Equal(t, map[string]string{
+		h1 + " ":                dbcache.ProblemHashMismatch,
+		h2 + " http://a.test/2": dbcache.ProblemDangling,
+		h3 + " ":                dbcache.ProblemOrphanFile,
+		hashOf("http://a.test/4") + " http://a.test/gone": dbcache.ProblemOrphanRef,
+		models.ContentHashBytes(orphan) + " ":             dbcache.ProblemOrphanBlob,
+		// the previous file of the refetched response
+		h4 + " ":                dbcache.ProblemOrphanFile,
+		h4 + " http://a.test/4": dbcache.ProblemOrphanRef,
+	}, kinds(o))
+	for _, p := range o.Problems {
+		assert.False(t, p.Repaired)
+	}
+
+	o = &dbcache.FsckOptions{Blobs: blobs, Before: before, Repair: true}
+	testx.NoErr(sqlitecache.Fsck(set, o))
+	// the refs of h4 are deleted with the file
+	assert.Len(t, o.Problems, 6)
+	for _, p := range o.Problems {
+		assert.True(t, p.Repaired, p.Kind)
+	}
+	o = &dbcache.FsckOptions{Blobs: blobs, Before: before}
+	testx.NoErr(sqlitecache.Fsck(set, o))
+	assert.Empty(t, kinds(o))
+	assert.Equal(t, 1, o.Files)
+
+	// the responses of the corrupted and missing files are fetched again
+	assert.Len(t, get("http://a.test/1"), 5000)
+	assert.Len(t, get("http://a.test/2"), 5000)
+	assert.Equal(t, 2, fetched["/1"])
+	assert.Equal(t, 2, fetched["/2"])
+}
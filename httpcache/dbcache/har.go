@@ -0,0 +1,267 @@
+package dbcache
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/wenerme/proxc/har"
+	"github.com/wenerme/proxc/httpcache/cachekey"
+	"github.com/wenerme/proxc/httpcache/dbcache/models"
+	"github.com/wenerme/proxc/httpcache/reqtrace"
+	"gorm.io/gorm"
+)
+
+type ExportHAROptions struct {
+	DB     *gorm.DB
+	FileDB *gorm.DB
+	Blobs  BlobStore
+	// Prefix filter by url prefix
+	Prefix string
+	// HAR to append entries, create if nil
+	HAR *har.HAR
+	// BatchSize of responses to load, default to 100
+	BatchSize int
+	// MaxBodySize of the body to export, larger body is omitted with a comment, default to DefaultLargeBodySize
+	MaxBodySize int64
+	// Omitted is the number of omitted bodies
+	Omitted int
+}
+
+// ExportHAR export responses in DB as HAR entries, the body is decoded
+func ExportHAR(o *ExportHAROptions) (out *har.HAR, err error) {
+	if o.HAR == nil {
+		o.HAR = har.NewHAR()
+	}
+	if o.BatchSize <= 0 {
+		o.BatchSize = 100
+	}
+	if o.MaxBodySize <= 0 {
+		o.MaxBodySize = DefaultLargeBodySize
+	}
+	out = o.HAR
+	q := o.DB.Model(&models.HTTPResponse{})
+	if o.Prefix != "" {
+		q = q.Where("substr(url, 1, ?) = ?", len(o.Prefix), o.Prefix)
+	}
+	var list []*models.HTTPResponse
+	err = q.Order("id").FindInBatches(&list, o.BatchSize, func(tx *gorm.DB, batch int) error {
+		for _, hr := range list {
+			entry, err := newHAREntry(hr, o)
+			if err != nil {
+				return errors.Wrapf(err, "export %s %s", hr.Method, hr.URL)
+			}
+			if entry.Response.Content.Comment != "" {
+				o.Omitted++
+			}
+			out.Log.Entries = append(out.Log.Entries, entry)
+		}
+		return nil
+	}).Error
+	return
+}
+
+func newHAREntry(hr *models.HTTPResponse, o *ExportHAROptions) (entry *har.Entry, err error) {
+	header := http.Header{}
+	if len(hr.Header) > 0 {
+		if err = json.Unmarshal(hr.Header, &header); err != nil {
+			return
+		}
+	}
+	reqHeader := http.Header{}
+	if len(hr.RequestHeader) > 0 {
+		if err = json.Unmarshal(hr.RequestHeader, &reqHeader); err != nil {
+			return
+		}
+	}
+	var data []byte
+	omitted := hr.RawSize > o.MaxBodySize
+	if !omitted {
+		var body io.ReadCloser
+		if body, err = OpenBody(hr, o.FileDB, o.Blobs); err != nil {
+			return
+		}
+		// the raw size is not trusted to bound the memory
+		data, err = io.ReadAll(io.LimitReader(body, o.MaxBodySize+1))
+		_ = body.Close()
+		if err != nil {
+			return
+		}
+		omitted = int64(len(data)) > o.MaxBodySize
+	}
+
+	var query []*har.NameValue
+	if u, err := url.Parse(hr.URL); err == nil {
+		for k, vv := range u.Query() {
+			for _, v := range vv {
+				query = append(query, &har.NameValue{Name: k, Value: v})
+			}
+		}
+	}
+	if query == nil {
+		query = []*har.NameValue{}
+	}
+
+	mimeType := header.Get("Content-Type")
+	if mimeType == "" {
+		mimeType = hr.ContentType
+	}
+	content := har.NewContent(mimeType, data)
+	if omitted {
+		content = &har.Content{Size: hr.RawSize, MimeType: mimeType, Comment: fmt.Sprintf("body larger than %d bytes is omitted", o.MaxBodySize)}
+	}
+	bodySize := hr.BodySize
+	if hr.ContentHash != "" {
+		bodySize = hr.RawSize
+	} else {
+		content.Compression = hr.RawSize - hr.BodySize
+	}
+
+	entry = &har.Entry{
+		StartedDateTime: hr.UpdatedAt,
+		Request: &har.Request{
+			Method:      hr.Method,
+			URL:         hr.URL,
+			HTTPVersion: hr.Proto,
+			Cookies:     []*har.Cookie{},
+			Headers:     har.NewHeaders(reqHeader),
+			QueryString: query,
+			HeadersSize: -1,
+			BodySize:    0,
+		},
+		Response: &har.Response{
+			Status:      hr.StatusCode,
+			StatusText:  http.StatusText(hr.StatusCode),
+			HTTPVersion: hr.Proto,
+			Cookies:     []*har.Cookie{},
+			Headers:     har.NewHeaders(header),
+			Content:     content,
+			RedirectURL: header.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    bodySize,
+		},
+		Timings: &har.Timings{Send: -1, Wait: -1, Receive: -1},
+	}
+	if len(hr.Timings) > 0 {
+		var t reqtrace.Timings
+		if err = json.Unmarshal(hr.Timings, &t); err != nil {
+			return
+		}
+		entry.Time = ms(t.Total)
+		// connect of HAR includes ssl
+		entry.Timings = &har.Timings{
+			DNS:     ms(t.DNS),
+			Connect: ms(t.Connect + t.TLS),
+			SSL:     ms(t.TLS),
+			Wait:    ms(t.TTFB - t.DNS - t.Connect - t.TLS),
+			Receive: ms(t.Total - t.TTFB),
+		}
+	}
+	if len(hr.RequestBody) > 0 {
+		var reqBody io.ReadCloser
+		if reqBody, err = hr.GetRequestBody(); err != nil {
+			return
+		}
+		data, err = io.ReadAll(reqBody)
+		_ = reqBody.Close()
+		if err != nil {
+			return
+		}
+		entry.Request.PostData = &har.PostData{MimeType: reqHeader.Get("Content-Type"), Text: string(data)}
+		entry.Request.BodySize = hr.RequestBodySize
+	}
+	return
+}
+
+// ms return the milliseconds of d for HAR
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+type ImportHAROptions struct {
+	Cache *Cache
+	HAR   *har.HAR
+	// Methods to import, default to GET
+	Methods []string
+	// KeyFunc of the transport to serve the entries, default to the url, the url and body for methods with body
+	KeyFunc cachekey.Func
+	// Imported is the number of imported entries
+	Imported int
+	// Skipped is the number of entries not imported
+	Skipped int
+}
+
+// ImportHAR store HAR entries through Cache.SetResponse, keyed like the transport, large body or attachment is stored as file
+func ImportHAR(o *ImportHAROptions) (err error) {
+	methods := o.Methods
+	if len(methods) == 0 {
+		methods = []string{http.MethodGet}
+	}
+	for _, e := range o.HAR.Log.Entries {
+		if e.Request == nil || e.Response == nil || e.Response.Status == 0 || !containsString(methods, e.Request.Method) || omittedContent(e.Response.Content) {
+			o.Skipped++
+			continue
+		}
+		var req *http.Request
+		var resp *http.Response
+		req, err = e.NewRequest()
+		if err == nil {
+			req = importKey(req, o.KeyFunc)
+			resp, err = e.NewResponse(req)
+		}
+		if err == nil {
+			setVaried(resp)
+			err = o.Cache.SetResponse(resp)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "import %s %s", e.Request.Method, e.Request.URL)
+		}
+		o.Imported++
+	}
+	return
+}
+
+// omittedContent return true if the body is not included in the archive
+func omittedContent(c *har.Content) bool {
+	return c != nil && c.Size > 0 && c.Text == ""
+}
+
+// importKey set the cache key of req the same as the transport
+func importKey(req *http.Request, keyFunc cachekey.Func) *http.Request {
+	switch {
+	case keyFunc != nil:
+		return cachekey.WithKey(req, keyFunc(req))
+	case req.Method != http.MethodGet && req.Method != http.MethodHead:
+		return cachekey.WithKey(req, req.URL.String()+cachekey.BodyKey(req, cachekey.BodyRaw))
+	}
+	return req
+}
+
+// setVaried set the X-Varied-<Header> of the varied request headers, which the transport matches when serving
+func setVaried(resp *http.Response) {
+	for _, line := range resp.Header.Values("Vary") {
+		for _, name := range strings.Split(line, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "" || name == "*" {
+				continue
+			}
+			if v := resp.Request.Header.Get(name); v != "" {
+				resp.Header.Set("X-Varied-"+name, v)
+			}
+		}
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
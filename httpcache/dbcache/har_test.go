@@ -0,0 +1,119 @@
+package dbcache_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wenerme/proxc/har"
+	"github.com/wenerme/proxc/httpcache"
+	"github.com/wenerme/proxc/httpcache/cachekey"
+	"github.com/wenerme/proxc/httpcache/dbcache"
+	"github.com/wenerme/proxc/httpcache/dbcache/models"
+	"github.com/wenerme/proxc/httpcache/dbcache/sqlitecache"
+	"github.com/wenerme/wego/testx"
+)
+
+func TestHAR(t *testing.T) {
+	server := newTestServer()
+	defer server.Close()
+	cache := sqlitecache.NewSQLiteCache(t.TempDir())
+	client := http.Client{Transport: httpcache.NewTransport(cache)}
+	for _, p := range []string{"/file", "/encoding"} {
+		req := testx.Must(http.NewRequest("GET", server.URL+p, nil))
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := testx.Must(client.Do(req))
+		_, _ = io.ReadAll(resp.Body)
+	}
+
+	db, fdb, err := cache.GetDB(testx.Must(http.NewRequest("GET", server.URL, nil)))
+	testx.NoErr(err)
+	out := testx.Must(dbcache.ExportHAR(&dbcache.ExportHAROptions{DB: db, FileDB: fdb, Blobs: cache.Blobs}))
+	assert.Len(t, out.Log.Entries, 2)
+	for _, e := range out.Log.Entries {
+		assert.Equal(t, "", e.Response.Content.Encoding)
+		assert.Equal(t, string(testData), e.Response.Content.Text)
+	}
+
+	bin := make([]byte, 1024)
+	_, _ = rand.Read(bin)
+	out.Log.Entries = append(out.Log.Entries, &har.Entry{
+		Request: &har.Request{Method: "GET", URL: server.URL + "/image.png"},
+		Response: &har.Response{
+			Status:  200,
+			Headers: []*har.NameValue{{Name: "Content-Type", Value: "image/png"}},
+			Content: har.NewContent("image/png", bin),
+		},
+	}, &har.Entry{
+		Request:  &har.Request{Method: "GET", URL: server.URL + "/blocked"},
+		Response: &har.Response{},
+	})
+	assert.Equal(t, "base64", out.Log.Entries[2].Response.Content.Encoding)
+
+	imported := sqlitecache.NewSQLiteCache(t.TempDir())
+	o := &dbcache.ImportHAROptions{Cache: imported, HAR: out}
+	testx.NoErr(dbcache.ImportHAR(o))
+	assert.Equal(t, 3, o.Imported)
+	assert.Equal(t, 1, o.Skipped)
+
+	for p, data := range map[string][]byte{"/file": testData, "/encoding": testData, "/image.png": bin} {
+		resp := testx.Must(imported.GetResponse(testx.Must(http.NewRequest("GET", server.URL+p, nil))))
+		assert.True(t, bytes.Equal(data, testx.Must(io.ReadAll(resp.Body))), p)
+	}
+	db, fdb, err = imported.GetDB(testx.Must(http.NewRequest("GET", server.URL, nil)))
+	testx.NoErr(err)
+	hr := testx.Must(dbcache.FindResponse(db, "GET", server.URL+"/file"))
+	assert.Equal(t, models.ContentHashBytes(testData), hr.ContentHash)
+	assert.Equal(t, "data.txt", hr.FileName)
+	var files int64
+	testx.NoErr(fdb.Model(&models.FileContent{}).Where("hash = ?", hr.ContentHash).Count(&files).Error)
+	assert.Equal(t, int64(1), files)
+
+	// large bodies are omitted, and not imported as empty
+	eo := &dbcache.ExportHAROptions{DB: db, FileDB: fdb, Blobs: imported.Blobs, MaxBodySize: 1000}
+	out = testx.Must(dbcache.ExportHAR(eo))
+	assert.Equal(t, 3, eo.Omitted)
+	for _, e := range out.Log.Entries {
+		assert.Equal(t, "", e.Response.Content.Text)
+		assert.NotEmpty(t, e.Response.Content.Comment)
+		assert.Greater(t, e.Response.Content.Size, int64(1000))
+	}
+	o = &dbcache.ImportHAROptions{Cache: sqlitecache.NewSQLiteCache(t.TempDir()), HAR: out}
+	testx.NoErr(dbcache.ImportHAR(o))
+	assert.Equal(t, 0, o.Imported)
+	assert.Equal(t, 3, o.Skipped)
+}
+
+func TestHARImportKey(t *testing.T) {
+	h := har.NewHAR()
+	h.Log.Entries = append(h.Log.Entries, &har.Entry{
+		Request: &har.Request{Method: "GET", URL: "http://example.com/?utm_source=a", Headers: []*har.NameValue{{Name: "Accept", Value: "text/html"}}},
+		Response: &har.Response{
+			Status:  200,
+			Headers: []*har.NameValue{{Name: "Content-Type", Value: "text/html"}, {Name: "Vary", Value: "Accept"}},
+			Content: har.NewContent("text/html", []byte("html")),
+		},
+	})
+	keyFunc := cachekey.New(&cachekey.Options{DropParams: []string{"utm_*"}})
+	cache := sqlitecache.NewSQLiteCache(t.TempDir())
+	testx.NoErr(dbcache.ImportHAR(&dbcache.ImportHAROptions{Cache: cache, HAR: h, KeyFunc: keyFunc}))
+
+	tr := httpcache.NewTransport(cache)
+	tr.Mode = httpcache.ModeReplay
+	tr.KeyFunc = keyFunc
+	client := tr.Client()
+	get := func(accept string) *http.Response {
+		req := testx.Must(http.NewRequest("GET", "http://example.com/?utm_source=b", nil))
+		req.Header.Set("Accept", accept)
+		resp := testx.Must(client.Do(req))
+		_ = resp.Body.Close()
+		return resp
+	}
+	resp := get("text/html")
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get(httpcache.XFromCache))
+	assert.Equal(t, http.StatusGatewayTimeout, get("text/plain").StatusCode)
+}
@@ -12,7 +12,7 @@ type FileContent struct {
 	Size        int64 `gorm:"index"`
 	Ext         string
 	ContentType string
-	Content     []byte
+	Content     []byte // legacy inline content, new content is stored in blob store
 	Extension   datatypes.JSON
 	Attributes  datatypes.JSON
 }
@@ -32,3 +32,15 @@ type FileRef struct {
 func (FileRef) ConflictColumns() []clause.Column {
 	return []clause.Column{{Name: "hash"}, {Name: "url"}}
 }
+
+// FileChunk stores a part of FileContent for blob store in DB
+type FileChunk struct {
+	Model
+	Hash string `gorm:"uniqueIndex:idx_file_chunk_hash_seq"`
+	Seq  int    `gorm:"uniqueIndex:idx_file_chunk_hash_seq"`
+	Data []byte
+}
+
+func (FileChunk) ConflictColumns() []clause.Column {
+	return []clause.Column{{Name: "hash"}, {Name: "seq"}}
+}
@@ -10,7 +10,12 @@ import (
 	"mime"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/wenerme/proxc/httpcache/cachekey"
+	"github.com/wenerme/proxc/httpcache/reqtrace"
 	"github.com/wenerme/proxc/httpencoding"
 
 	"github.com/pkg/errors"
@@ -20,10 +25,12 @@ import (
 
 type HTTPResponse struct {
 	Model
-	Method string `gorm:"uniqueIndex:idx_http_responses_method_url"`
-	URL    string `gorm:"uniqueIndex:idx_http_responses_method_url"`
-	Host   string
-	Path   string
+	Method   string `gorm:"uniqueIndex:idx_http_responses_method_key_vary"`
+	URL      string `gorm:"index"`
+	CacheKey string `gorm:"uniqueIndex:idx_http_responses_method_key_vary"` // default to URL, see cachekey.Func
+	VaryKey  string `gorm:"uniqueIndex:idx_http_responses_method_key_vary"` // secondary key of variant, see VaryKey
+	Host     string
+	Path     string
 
 	// Size int
 	// Raw  []byte
@@ -38,10 +45,177 @@ type HTTPResponse struct {
 	ContentEncoding string // gzip, deflate, br, zstd, identity
 	ContentHash     string // sha2-256 for raw data for file
 	FileName        string
+	Pinned          bool `gorm:"default:false"` // pinned response is not overwritten by SetResponse nor deleted
+
+	// originating request, see SetRequest
+	RequestHeader       datatypes.JSON // sensitive headers are redacted
+	RequestBody         []byte         // encoded by RequestBodyEncoding
+	RequestBodyEncoding string
+	RequestBodySize     int64  // size before encoding
+	RequestBodyHash     string // sha2-256 of the request body as sent
+	ClientAddr          string
+	Timings             datatypes.JSON // reqtrace.Timings of the upstream request
+
+	// access tracking for eviction, see dbcache.Evict
+	AccessedAt *time.Time `gorm:"index"`
+	Hits       int64
 }
 
 func (HTTPResponse) ConflictColumns() []clause.Column {
-	return []clause.Column{{Name: "method"}, {Name: "url"}}
+	return []clause.Column{{Name: "method"}, {Name: "cache_key"}, {Name: "vary_key"}}
+}
+
+// PayloadColumns are the columns of the response and the originating request,
+// the creation and access tracking are not included
+func (HTTPResponse) PayloadColumns() []string {
+	return []string{
+		"updated_at", "url", "host", "path",
+		"proto", "status_code", "header", "raw_size", "body_size", "body",
+		"content_type", "content_encoding", "content_hash", "file_name", "pinned",
+		"request_header", "request_body", "request_body_encoding", "request_body_size", "request_body_hash",
+		"client_addr", "timings",
+	}
+}
+
+// VaryKey return the secondary key of the response variant selected by the request header,
+// Accept-Encoding is ignored as the body is transcoded on demand, return `*` if vary to anything
+func VaryKey(respHeader http.Header, reqHeader http.Header) string {
+	v := url.Values{}
+	for _, line := range respHeader.Values("Vary") {
+		for _, name := range strings.Split(line, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			switch name {
+			case "":
+			case "*":
+				return "*"
+			case "Accept-Encoding":
+			default:
+				v.Set(name, varyValue(reqHeader, name))
+			}
+		}
+	}
+	return v.Encode()
+}
+
+// VaryMatches return true if the variant of key is selected by the request header
+func VaryMatches(key string, reqHeader http.Header) bool {
+	switch key {
+	case "":
+		return true
+	case "*":
+		return false
+	}
+	v, err := url.ParseQuery(key)
+	if err != nil {
+		return false
+	}
+	for name := range v {
+		if v.Get(name) != varyValue(reqHeader, name) {
+			return false
+		}
+	}
+	return true
+}
+
+func varyValue(h http.Header, name string) string {
+	values := h.Values(name)
+	for i, v := range values {
+		values[i] = strings.TrimSpace(v)
+	}
+	return strings.Join(values, ", ")
+}
+
+// HTTPResponseVersion is a previous version of HTTPResponse
+type HTTPResponseVersion struct {
+	Model
+	ResponseID uint   `gorm:"index"`
+	Method     string `gorm:"index:idx_http_response_versions_method_url"`
+	URL        string `gorm:"index:idx_http_response_versions_method_url"`
+	CacheKey   string
+	VaryKey    string
+	Host       string
+	Path       string
+
+	Proto           string
+	StatusCode      int
+	Header          datatypes.JSON
+	RawSize         int64
+	BodySize        int64
+	Body            []byte
+	ContentType     string
+	ContentEncoding string
+	ContentHash     string
+	FileName        string
+	BodyHash        string // sha2-256 of decoded body
+
+	RequestHeader       datatypes.JSON
+	RequestBody         []byte
+	RequestBodyEncoding string
+	RequestBodySize     int64
+	RequestBodyHash     string
+	ClientAddr          string
+	Timings             datatypes.JSON
+}
+
+// NewHTTPResponseVersion create a version of m, the version is created at the time m updated
+func NewHTTPResponseVersion(m *HTTPResponse) *HTTPResponseVersion {
+	return &HTTPResponseVersion{
+		Model:               Model{CreatedAt: m.UpdatedAt, UpdatedAt: m.UpdatedAt},
+		ResponseID:          m.ID,
+		Method:              m.Method,
+		URL:                 m.URL,
+		CacheKey:            m.CacheKey,
+		VaryKey:             m.VaryKey,
+		Host:                m.Host,
+		Path:                m.Path,
+		Proto:               m.Proto,
+		StatusCode:          m.StatusCode,
+		Header:              m.Header,
+		RawSize:             m.RawSize,
+		BodySize:            m.BodySize,
+		Body:                m.Body,
+		ContentType:         m.ContentType,
+		ContentEncoding:     m.ContentEncoding,
+		ContentHash:         m.ContentHash,
+		FileName:            m.FileName,
+		RequestHeader:       m.RequestHeader,
+		RequestBody:         m.RequestBody,
+		RequestBodyEncoding: m.RequestBodyEncoding,
+		RequestBodySize:     m.RequestBodySize,
+		RequestBodyHash:     m.RequestBodyHash,
+		ClientAddr:          m.ClientAddr,
+		Timings:             m.Timings,
+	}
+}
+
+// GetHTTPResponse return the HTTPResponse of this version
+func (v *HTTPResponseVersion) GetHTTPResponse() *HTTPResponse {
+	return &HTTPResponse{
+		Model:               Model{CreatedAt: v.CreatedAt, UpdatedAt: v.UpdatedAt},
+		Method:              v.Method,
+		URL:                 v.URL,
+		CacheKey:            v.CacheKey,
+		VaryKey:             v.VaryKey,
+		Host:                v.Host,
+		Path:                v.Path,
+		Proto:               v.Proto,
+		StatusCode:          v.StatusCode,
+		Header:              v.Header,
+		RawSize:             v.RawSize,
+		BodySize:            v.BodySize,
+		Body:                v.Body,
+		ContentType:         v.ContentType,
+		ContentEncoding:     v.ContentEncoding,
+		ContentHash:         v.ContentHash,
+		FileName:            v.FileName,
+		RequestHeader:       v.RequestHeader,
+		RequestBody:         v.RequestBody,
+		RequestBodyEncoding: v.RequestBodyEncoding,
+		RequestBodySize:     v.RequestBodySize,
+		RequestBodyHash:     v.RequestBodyHash,
+		ClientAddr:          v.ClientAddr,
+		Timings:             v.Timings,
+	}
 }
 
 func ContentHashBytes(v []byte) string {
@@ -77,11 +251,26 @@ func (m *HTTPResponse) GetBody() (rc io.ReadCloser, err error) {
 }
 
 func (m *HTTPResponse) SetResponse(resp *http.Response) (err error) {
+	if err = m.SetResponseMeta(resp); err != nil {
+		return
+	}
+	var body io.Reader
+	body, resp.Body, err = drainBody(resp.Body)
+	if err != nil {
+		return errors.Wrap(err, "drain body")
+	}
+	return m.SetBody(ResponseEncoding(resp), body)
+}
+
+// SetResponseMeta set everything except the body
+func (m *HTTPResponse) SetResponseMeta(resp *http.Response) (err error) {
 	res := resp.Request
 	m.Method = res.Method
 	m.URL = res.URL.String()
+	m.CacheKey = cachekey.FromRequest(res)
 	m.Host = res.URL.Host
 	m.Path = res.URL.Path
+	m.VaryKey = VaryKey(resp.Header, res.Header)
 
 	m.Proto = resp.Proto
 	m.StatusCode = resp.StatusCode
@@ -92,21 +281,94 @@ func (m *HTTPResponse) SetResponse(resp *http.Response) (err error) {
 
 	m.ContentType, _, _ = mime.ParseMediaType(resp.Header.Get("Content-Type"))
 
-	bodyEncoding := resp.Header.Get("Content-Encoding")
-	if resp.Uncompressed {
-		bodyEncoding = ""
+	if hdr := resp.Header.Get("Content-Disposition"); hdr != "" {
+		_, params, _ := mime.ParseMediaType(hdr)
+		filename := params["filename"]
+		if filename != "" {
+			m.FileName = filename
+		}
 	}
+	return
+}
+
+// DefaultRedactHeaders are the request headers redacted by default
+var DefaultRedactHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// Redacted is the value of redacted header
+const Redacted = "REDACTED"
+
+// SetRequest set the originating request, values of redact headers are replaced by Redacted,
+// the body is read by req.GetBody, client address and timings are read from the reqtrace.Trace
+func (m *HTTPResponse) SetRequest(req *http.Request, redact []string) (err error) {
+	header := req.Header.Clone()
+	for _, name := range redact {
+		if values := header.Values(name); len(values) > 0 {
+			header.Del(name)
+			for range values {
+				header.Add(name, Redacted)
+			}
+		}
+	}
+	if m.RequestHeader, err = json.Marshal(header); err != nil {
+		return
+	}
+
+	if req.GetBody != nil {
+		var body io.ReadCloser
+		if body, err = req.GetBody(); err != nil {
+			return errors.Wrap(err, "get request body")
+		}
+		defer body.Close()
+		if err = m.SetRequestBody(req.Header, body); err != nil {
+			return errors.Wrap(err, "set request body")
+		}
+	}
+
+	if t := reqtrace.FromRequest(req); t != nil {
+		m.ClientAddr = t.ClientAddr
+		m.Timings, err = json.Marshal(t.Timings())
+	}
+	return
+}
+
+// SetRequestBody encode the request body like SetBody
+func (m *HTTPResponse) SetRequestBody(header http.Header, body io.Reader) (err error) {
+	hash := sha256.New()
+	raw := bytes.NewBuffer(nil)
+	if _, err = io.Copy(io.MultiWriter(raw, hash), body); err != nil || raw.Len() == 0 {
+		return
+	}
+	encoding := header.Get("Content-Encoding")
+	contentType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	m.RequestBodyEncoding = encoding
+	if encoding == "" && shouldCompress[contentType] {
+		m.RequestBodyEncoding = DefaultEncoding
+	}
+	buf := bytes.NewBuffer(nil)
+	if m.RequestBodySize, err = httpencoding.Transfer(encoding, bytes.NewReader(raw.Bytes()), m.RequestBodyEncoding, buf); err != nil {
+		return
+	}
+	m.RequestBody = buf.Bytes()
+	m.RequestBodyHash = hex.EncodeToString(hash.Sum(nil))
+	return
+}
+
+// GetRequestBody return the decoded request body
+func (m *HTTPResponse) GetRequestBody() (rc io.ReadCloser, err error) {
+	if len(m.RequestBody) == 0 {
+		return http.NoBody, nil
+	}
+	return httpencoding.NewReader(m.RequestBodyEncoding, bytes.NewReader(m.RequestBody))
+}
+
+// SetBody encode the body which is encoded by bodyEncoding
+func (m *HTTPResponse) SetBody(bodyEncoding string, body io.Reader) (err error) {
 	// reduce an encoding process
 	m.ContentEncoding = bodyEncoding
 
 	if m.ContentEncoding == "" && shouldCompress[m.ContentType] {
 		m.ContentEncoding = DefaultEncoding
 	}
-	var body io.Reader
-	body, resp.Body, err = drainBody(resp.Body)
-	if err != nil {
-		return errors.Wrap(err, "drain body")
-	}
 	buf := bytes.NewBuffer(nil)
 	m.RawSize, err = httpencoding.Transfer(bodyEncoding, body, m.ContentEncoding, buf)
 	if err != nil {
@@ -114,16 +376,15 @@ func (m *HTTPResponse) SetResponse(resp *http.Response) (err error) {
 	}
 	m.Body = buf.Bytes()
 	m.BodySize = int64(len(m.Body))
+	return
+}
 
-	if hdr := resp.Header.Get("Content-Disposition"); hdr != "" {
-		_, params, _ := mime.ParseMediaType(hdr)
-		filename := params["filename"]
-		if filename != "" {
-			m.FileName = filename
-		}
+// ResponseEncoding return the encoding of resp.Body
+func ResponseEncoding(resp *http.Response) string {
+	if resp.Uncompressed {
+		return ""
 	}
-
-	return
+	return resp.Header.Get("Content-Encoding")
 }
 
 func (m *HTTPResponse) GetResponse(req *http.Request) (resp *http.Response, err error) {
@@ -169,6 +430,33 @@ func (m *HTTPResponse) GetResponse(req *http.Request) (resp *http.Response, err
 	return
 }
 
+// GetHeadResponse return the response of HEAD req without body, Content-Length is the raw size
+func (m *HTTPResponse) GetHeadResponse(req *http.Request) (resp *http.Response, err error) {
+	resp = &http.Response{
+		StatusCode:    m.StatusCode,
+		Proto:         m.Proto,
+		Request:       req,
+		ContentLength: m.RawSize,
+		Body:          http.NoBody,
+	}
+	resp.ProtoMajor, resp.ProtoMinor, _ = http.ParseHTTPVersion(m.Proto)
+	if s := http.StatusText(m.StatusCode); s != "" {
+		resp.Status = fmt.Sprintf("%d %s", m.StatusCode, s)
+	}
+	if err = json.Unmarshal(m.Header, &resp.Header); err != nil {
+		return
+	}
+	if resp.Header == nil {
+		resp.Header = http.Header{}
+	}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Set("Content-Length", strconv.FormatInt(m.RawSize, 10))
+	if m.ContentHash != "" {
+		resp.Header.Set("Content-Hash", m.ContentHash)
+	}
+	return
+}
+
 func drainBody(b io.ReadCloser) (r1 io.ReadCloser, r2 io.ReadCloser, err error) {
 	if b == nil || b == http.NoBody {
 		// No copying needed. Preserve the magic sentinel meaning of NoBody.
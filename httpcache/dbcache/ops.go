@@ -1,31 +1,59 @@
 package dbcache
 
 import (
-	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"io"
 	"net/http"
+	"path"
 	"path/filepath"
+	"strconv"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
 	"github.com/wenerme/proxc/httpcache/dbcache/models"
+	"github.com/wenerme/proxc/httpcache/spool"
+	"github.com/wenerme/proxc/httpencoding"
 	"go.uber.org/multierr"
+	"gorm.io/datatypes"
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
 )
 
+// DefaultLargeBodySize is the default size of body to store as file
+const DefaultLargeBodySize = 5 << 20
+
 type SetResponseOptions struct {
-	DB                  *gorm.DB
-	FileDB              *gorm.DB
-	Response            *http.Response
+	DB       *gorm.DB
+	FileDB   *gorm.DB
+	Response *http.Response
+	// Blobs stores the file content, default to DBBlobStore of FileDB
+	Blobs BlobStore
+	// LargeBodySize is the size of body to stream to Blobs as file, default to DefaultLargeBodySize
+	LargeBodySize int64
+	// SpoolDir is the temp dir for large body
+	SpoolDir            string
 	Dry                 bool
 	Responses           []*models.HTTPResponse
 	FileContents        []*models.FileContent
 	FileRefs            []*models.FileRef
 	OnConflictDoNothing bool
+	// KeepPrevious archive the existing response as models.HTTPResponseVersion before overwrite
+	KeepPrevious bool
+	// History record the response as models.HTTPResponseVersion if the body or status changed
+	History bool
+	// RedactHeaders are the request headers to redact, default to models.DefaultRedactHeaders, empty to keep all
+	RedactHeaders []string
+
+	// Stored is the response stored, not set if Dry
+	Stored *models.HTTPResponse
 }
 type GetResponseOptions struct {
 	DB      *gorm.DB
 	FileDB  *gorm.DB
+	Blobs   BlobStore
 	Request *http.Request
 }
 
@@ -33,32 +61,78 @@ func GetResponse(o *GetResponseOptions) (resp *http.Response, err error) {
 	if o.FileDB == nil {
 		o.FileDB = o.DB
 	}
-	var out models.HTTPResponse
+	if o.Blobs == nil {
+		o.Blobs = &DBBlobStore{DB: o.FileDB}
+	}
 	req := o.Request
-	err = o.DB.Where(models.HTTPResponse{
-		Method: req.Method,
-		URL:    req.URL.String(),
-	}).Limit(1).Find(&out).Error
-	if err != nil || out.URL == "" {
+	if req.Method == http.MethodHead {
+		// answered from the GET response without body
+		get := *req
+		get.Method = http.MethodGet
+		var out *models.HTTPResponse
+		if out, err = SelectVariant(o.DB, &get); err != nil || out != nil {
+			if out != nil {
+				resp, err = out.GetHeadResponse(req)
+				if err := Touch(o.DB, out.ID); err != nil {
+					log.Warn().Err(err).Str("url", out.URL).Msg("touch response error")
+				}
+			}
+			return
+		}
+	}
+	out, err := SelectVariant(o.DB, req)
+	if err != nil || out == nil {
 		return
 	}
 	resp, err = out.GetResponse(req)
 	if err != nil {
 		return
 	}
+	if err := Touch(o.DB, out.ID); err != nil {
+		log.Warn().Err(err).Str("url", out.URL).Msg("touch response error")
+	}
 	if out.ContentHash != "" {
-		var file models.FileContent
-		err = o.FileDB.Where(models.FileContent{
-			Hash: out.ContentHash,
-		}).Limit(1).Find(&file).Error
+		var file *models.FileContent
+		resp.Body, file, err = openFile(o.FileDB, o.Blobs, out.ContentHash)
+		if err == ErrBlobNotFound {
+			// treat as a miss to fetch again, see Fsck
+			log.Warn().Str("hash", out.ContentHash).Str("url", out.URL).Msg("file not found")
+			return nil, nil
+		}
 		if err != nil {
 			return
 		}
-		if file.Content == nil {
-			log.Error().Str("hash", out.ContentHash).Msgf("file not found")
+		// file content is stored as is
+		resp.Header.Del("Content-Encoding")
+		resp.ContentLength = -1
+		if file.ID != 0 {
+			resp.Header.Set("Content-Length", strconv.FormatInt(file.Size, 10))
+			resp.ContentLength = file.Size
+		}
+		resp.Header.Set("Content-Hash", out.ContentHash)
+	}
+	return
+}
+
+// Touch record an access of the response, updated_at is not changed
+func Touch(db *gorm.DB, id uint) error {
+	return db.Model(&models.HTTPResponse{}).Where("id = ?", id).UpdateColumns(map[string]interface{}{
+		"accessed_at": time.Now(),
+		"hits":        gorm.Expr("coalesce(hits, 0) + 1"),
+	}).Error
+}
+
+// updateColumns return the columns to update on conflict, except the primary key, created_at and exclude
+func updateColumns(db *gorm.DB, model interface{}, exclude ...string) (columns []string, err error) {
+	stmt := &gorm.Statement{DB: db}
+	if err = stmt.Parse(model); err != nil {
+		return
+	}
+	for _, name := range stmt.Schema.DBNames {
+		if stmt.Schema.FieldsByDBName[name].PrimaryKey || name == "created_at" || containsString(exclude, name) {
+			continue
 		}
-		resp.Body = io.NopCloser(bytes.NewReader(file.Content))
-		resp.Header.Set("Content-Hash", file.Hash)
+		columns = append(columns, name)
 	}
 	return
 }
@@ -71,63 +145,223 @@ func SetResponse(o *SetResponseOptions) (err error) {
 	if o.FileDB == nil {
 		o.FileDB = o.DB
 	}
+	if o.Blobs == nil {
+		o.Blobs = &DBBlobStore{DB: o.FileDB}
+	}
+	if o.LargeBodySize <= 0 {
+		o.LargeBodySize = DefaultLargeBodySize
+	}
 	hr := &models.HTTPResponse{}
-	err = hr.SetResponse(o.Response)
+	resp := o.Response
+	if err = hr.SetResponseMeta(resp); err != nil {
+		return
+	}
+	redact := o.RedactHeaders
+	if redact == nil {
+		redact = models.DefaultRedactHeaders
+	}
+	if err = hr.SetRequest(resp.Request, redact); err != nil {
+		return
+	}
+	if hr.FileName == "" && resp.ContentLength >= 0 && resp.ContentLength <= o.LargeBodySize {
+		err = hr.SetResponse(resp)
+	} else {
+		err = setStreamBody(o, hr)
+	}
 	if err != nil {
 		return
 	}
-	if hr.FileName != "" && hr.BodySize > 0 {
-		var bodyReader io.ReadCloser
-		bodyReader, err = hr.GetBody()
-		if err != nil {
+
+	now := time.Now()
+	hr.AccessedAt = &now
+
+	if hr.Method == http.MethodHead && !o.Dry {
+		var updated bool
+		if updated, err = updateGetMeta(o, hr); err != nil || updated {
 			return
 		}
-		fc := &models.FileContent{
-			Hash:        "",
-			Name:        hr.FileName,
-			Size:        0,
-			ContentType: hr.ContentType,
-			Content:     nil,
+	}
+
+	if !o.Dry {
+		conflict := clause.OnConflict{Columns: hr.ConflictColumns(), DoNothing: o.OnConflictDoNothing}
+		if !conflict.DoNothing {
+			// hits accumulate across refreshes
+			var columns []string
+			if columns, err = updateColumns(o.DB, hr, "hits"); err != nil {
+				return
+			}
+			conflict.DoUpdates = clause.AssignmentColumns(columns)
+			// keep the pinned response
+			conflict.Where = clause.Where{Exprs: []clause.Expression{clause.Expr{SQL: "coalesce(pinned, ?) = ?", Vars: []interface{}{false, false}}}}
 		}
-		fc.Content, err = io.ReadAll(bodyReader)
-		if err != nil {
+		if !o.KeepPrevious && !o.History {
+			if err = o.DB.Clauses(conflict).Create(hr).Error; err == nil {
+				o.Stored = hr
+			}
 			return
 		}
-		fc.Size = int64(len(fc.Content))
-		fc.Hash = models.ContentHashBytes(fc.Content)
-		hr.ContentHash = fc.Hash
+		err = o.DB.Transaction(func(tx *gorm.DB) error {
+			if o.KeepPrevious {
+				prev, err := FindVariant(tx, hr.Method, hr.CacheKey, hr.VaryKey)
+				if err == nil && prev != nil && !prev.Pinned {
+					err = AddVersion(tx, prev)
+				}
+				if err != nil {
+					return errors.Wrap(err, "keep previous response")
+				}
+			}
+			if err := tx.Clauses(conflict).Create(hr).Error; err != nil {
+				return err
+			}
+			if o.History {
+				return errors.Wrap(AddVersion(tx, hr), "add response version")
+			}
+			return nil
+		})
+		if err == nil {
+			o.Stored = hr
+		}
+	} else {
+		o.Responses = append(o.Responses, hr)
+	}
 
-		fc.Ext = DetectExt(fc.Name, fc.Content)
-		ref := &models.FileRef{
-			Hash: fc.Hash,
-			Name: fc.Name,
-			URL:  hr.URL,
+	return
+}
+
+// updateGetMeta update the header of the stored GET response by the HEAD response, RFC 9111 4.3.5,
+// the GET response is deleted if the validators changed, return true if updated
+func updateGetMeta(o *SetResponseOptions, hr *models.HTTPResponse) (updated bool, err error) {
+	get, err := FindVariant(o.DB, http.MethodGet, hr.CacheKey, hr.VaryKey)
+	if err != nil || get == nil {
+		return
+	}
+	header := http.Header{}
+	if err = json.Unmarshal(get.Header, &header); err != nil {
+		return
+	}
+	resp := o.Response
+	changed := false
+	for _, h := range []string{"Etag", "Last-Modified"} {
+		if v := resp.Header.Get(h); v != "" && v != header.Get(h) {
+			changed = true
 		}
-		if !o.Dry {
-			err = multierr.Combine(
-				o.FileDB.Clauses(clause.OnConflict{Columns: fc.ConflictColumns(), DoNothing: true}).Create(fc).Error,
-				o.FileDB.Clauses(clause.OnConflict{Columns: ref.ConflictColumns(), DoNothing: true}).Create(ref).Error,
-			)
-		} else {
-			o.FileContents = append(o.FileContents, fc)
-			o.FileRefs = append(o.FileRefs, ref)
+	}
+	if v := resp.Header.Get("Content-Length"); v != "" && resp.Header.Get("Content-Encoding") == "" && v != strconv.FormatInt(get.RawSize, 10) {
+		changed = true
+	}
+	if get.Pinned {
+		// pinned response is not overwritten, nor the HEAD response stored
+		return !changed, nil
+	}
+	if changed {
+		if err = o.DB.Delete(&models.HTTPResponse{}, get.ID).Error; err != nil {
+			return
+		}
+		if get.ContentHash != "" {
+			err = deleteFileRefs(o.DB, o.FileDB, []*models.HTTPResponse{get})
+		}
+		return
+	}
+
+	for k, v := range resp.Header {
+		switch k {
+		case "Content-Length", "Content-Encoding", "Content-Range", "Transfer-Encoding":
+		default:
+			header[k] = v
 		}
+	}
+	data, err := json.Marshal(header)
+	if err != nil {
+		return
+	}
+	err = o.DB.Model(&models.HTTPResponse{}).Where("id = ?", get.ID).UpdateColumns(map[string]interface{}{
+		"header":      datatypes.JSON(data),
+		"updated_at":  time.Now(),
+		"accessed_at": hr.AccessedAt,
+	}).Error
+	if err == nil {
+		get.Header = data
+		o.Stored = get
+	}
+	return err == nil, err
+}
 
+// deleteFileRefs delete the file refs of the deleted responses no longer referenced by versions
+func deleteFileRefs(db *gorm.DB, file *gorm.DB, deleted []*models.HTTPResponse) (err error) {
+	for _, v := range deleted {
+		var n int64
+		err = db.Model(&models.HTTPResponseVersion{}).Where("content_hash = ? AND url = ?", v.ContentHash, v.URL).Count(&n).Error
+		if err == nil && n == 0 {
+			err = file.Where("hash = ? AND url = ?", v.ContentHash, v.URL).Delete(&models.FileRef{}).Error
+		}
 		if err != nil {
 			return
 		}
-		hr.Body = nil
-		hr.BodySize = 0
 	}
-	if !o.Dry {
-		conflict := clause.OnConflict{Columns: hr.ConflictColumns(), DoNothing: o.OnConflictDoNothing}
-		if !conflict.DoNothing {
-			conflict.UpdateAll = true
+	return
+}
+
+// setStreamBody spool the decoded body to disk and hash as it goes,
+// store to blob store if the body is too large or has a file name.
+func setStreamBody(o *SetResponseOptions, hr *models.HTTPResponse) (err error) {
+	resp := o.Response
+	var body io.ReadCloser = http.NoBody
+	if resp.Body != nil {
+		body, err = httpencoding.NewReader(models.ResponseEncoding(resp), resp.Body)
+		if err != nil {
+			return
 		}
-		err = o.DB.Clauses(conflict).Create(hr).Error
-	} else {
-		o.Responses = append(o.Responses, hr)
+		defer body.Close()
 	}
 
-	return
+	buf := &spool.Buffer{Limit: o.LargeBodySize, Dir: o.SpoolDir}
+	defer buf.Close()
+	hash := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(buf, hash), body); err != nil {
+		return errors.Wrap(err, "spool body")
+	}
+
+	if buf.Size() == 0 || (hr.FileName == "" && buf.InMemory()) {
+		return hr.SetBody("", buf.Reader())
+	}
+
+	fc := &models.FileContent{
+		Hash:        hex.EncodeToString(hash.Sum(nil)),
+		Name:        hr.FileName,
+		Size:        buf.Size(),
+		ContentType: hr.ContentType,
+	}
+	if fc.Name == "" {
+		fc.Name = path.Base(hr.Path)
+	}
+	hr.ContentHash = fc.Hash
+	hr.ContentEncoding = ""
+	hr.RawSize = fc.Size
+	hr.Body = nil
+	hr.BodySize = 0
+
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(buf.Reader(), head)
+	fc.Ext = DetectExt(fc.Name, head[:n])
+	ref := &models.FileRef{
+		Hash: fc.Hash,
+		Name: fc.Name,
+		URL:  hr.URL,
+	}
+
+	if o.Dry {
+		// large content is dropped
+		fc.Content = buf.Bytes()
+		o.FileContents = append(o.FileContents, fc)
+		o.FileRefs = append(o.FileRefs, ref)
+		return
+	}
+
+	if err = o.Blobs.PutBlob(fc.Hash, buf.Reader()); err != nil {
+		return errors.Wrap(err, "put blob")
+	}
+	return multierr.Combine(
+		o.FileDB.Clauses(clause.OnConflict{Columns: fc.ConflictColumns(), DoNothing: true}).Create(fc).Error,
+		o.FileDB.Clauses(clause.OnConflict{Columns: ref.ConflictColumns(), DoNothing: true}).Create(ref).Error,
+	)
 }
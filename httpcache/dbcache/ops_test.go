@@ -0,0 +1,81 @@
+package dbcache_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wenerme/proxc/httpcache"
+	"github.com/wenerme/proxc/httpcache/dbcache"
+	"github.com/wenerme/proxc/httpcache/dbcache/models"
+	"github.com/wenerme/proxc/httpcache/dbcache/sqlitecache"
+	"github.com/wenerme/proxc/httpcache/reqtrace"
+	"github.com/wenerme/wego/testx"
+)
+
+func TestRequestInfo(t *testing.T) {
+	var upstream http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream = r.Header.Clone()
+		w.Header().Set("Cache-Control", "max-age=3600")
+		_, _ = io.Copy(w, r.Body)
+	}))
+	defer server.Close()
+
+	cache := sqlitecache.NewMemoryCache()
+	tp := httpcache.NewTransport(cache)
+	tp.Cacheable = func(req *http.Request) bool {
+		return true
+	}
+	client := http.Client{Transport: tp}
+	body := strings.Repeat(`{"q":"proxc"}`, 100)
+	req := testx.Must(http.NewRequest("POST", server.URL+"/search", strings.NewReader(body)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Add("Cookie", "a=1")
+	req.Header.Add("Cookie", "b=2")
+	req.Header.Set(reqtrace.XClientAddr, "10.0.0.1:1234")
+	resp := testx.Must(client.Do(req))
+	_, _ = io.ReadAll(resp.Body)
+	assert.Empty(t, upstream.Get(reqtrace.XClientAddr))
+	assert.Equal(t, "Bearer secret", upstream.Get("Authorization"))
+
+	db, _, err := cache.GetDB(req)
+	testx.NoErr(err)
+	hr := testx.Must(dbcache.FindResponse(db, "POST", server.URL+"/search"))
+	header := http.Header{}
+	testx.NoErr(json.Unmarshal(hr.RequestHeader, &header))
+	assert.Equal(t, []string{models.Redacted}, header.Values("Authorization"))
+	assert.Equal(t, []string{models.Redacted, models.Redacted}, header.Values("Cookie"))
+	assert.Equal(t, "application/json", header.Get("Content-Type"))
+	assert.Empty(t, header.Get(reqtrace.XClientAddr))
+	assert.Equal(t, "10.0.0.1:1234", hr.ClientAddr)
+
+	assert.Equal(t, models.DefaultEncoding, hr.RequestBodyEncoding)
+	assert.Less(t, len(hr.RequestBody), len(body))
+	assert.Equal(t, int64(len(body)), hr.RequestBodySize)
+	assert.Equal(t, body, string(testx.Must(io.ReadAll(testx.Must(hr.GetRequestBody())))))
+
+	var timings reqtrace.Timings
+	testx.NoErr(json.Unmarshal(hr.Timings, &timings))
+	assert.Greater(t, int64(timings.TTFB), int64(0))
+	assert.GreaterOrEqual(t, int64(timings.Total), int64(timings.TTFB))
+
+	// keep all headers
+	cache.RedactHeaders = []string{}
+	req = testx.Must(http.NewRequest("GET", server.URL+"/keep", nil))
+	req.Header.Set("Authorization", "Bearer secret")
+	resp = testx.Must(client.Do(req))
+	_, _ = io.ReadAll(resp.Body)
+	hr = testx.Must(dbcache.FindResponse(db, "GET", server.URL+"/keep"))
+	header = http.Header{}
+	testx.NoErr(json.Unmarshal(hr.RequestHeader, &header))
+	assert.Equal(t, "Bearer secret", header.Get("Authorization"))
+	assert.Empty(t, hr.RequestBody)
+	assert.Empty(t, hr.ClientAddr)
+	assert.NotEmpty(t, hr.Timings)
+}
@@ -0,0 +1,188 @@
+package dbcache
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+
+	"github.com/wenerme/proxc/httpcache/cachekey"
+	"github.com/wenerme/proxc/httpcache/dbcache/models"
+	"gorm.io/gorm"
+)
+
+type ListResponsesOptions struct {
+	DB *gorm.DB
+	// Prefix filter by url prefix
+	Prefix string
+	Offset int
+	Limit  int
+	// Total is the number of matched responses
+	Total int64
+}
+
+// ListResponses list responses without body
+func ListResponses(o *ListResponsesOptions) (out []*models.HTTPResponse, err error) {
+	q := o.DB.Model(&models.HTTPResponse{})
+	if o.Prefix != "" {
+		q = q.Where("substr(url, 1, ?) = ?", len(o.Prefix), o.Prefix)
+	}
+	if err = q.Count(&o.Total).Error; err != nil {
+		return
+	}
+	if o.Limit > 0 {
+		q = q.Limit(o.Limit)
+	}
+	err = q.Omit("body").Order("id").Offset(o.Offset).Find(&out).Error
+	return
+}
+
+// FindResponse find the response by method and url, return nil if not found
+func FindResponse(db *gorm.DB, method string, url string) (out *models.HTTPResponse, err error) {
+	out = &models.HTTPResponse{}
+	err = db.Where(models.HTTPResponse{Method: method, URL: url}).Limit(1).Find(out).Error
+	if err != nil || out.ID == 0 {
+		return nil, err
+	}
+	return
+}
+
+// FindVariant find the response variant by method, cache key and vary key, return nil if not found
+func FindVariant(db *gorm.DB, method string, key string, varyKey string) (out *models.HTTPResponse, err error) {
+	out = &models.HTTPResponse{}
+	err = db.Where("method = ? AND cache_key = ? AND vary_key = ?", method, key, varyKey).Limit(1).Find(out).Error
+	if err != nil || out.ID == 0 {
+		return nil, err
+	}
+	return
+}
+
+// SelectVariant find the response variant selected by the request, latest first, return nil if not found
+func SelectVariant(db *gorm.DB, req *http.Request) (out *models.HTTPResponse, err error) {
+	var variants []*models.HTTPResponse
+	err = db.Select("id", "vary_key").Where("method = ? AND cache_key = ?", req.Method, cachekey.FromRequest(req)).
+		Order("updated_at desc").Find(&variants).Error
+	if err != nil {
+		return
+	}
+	for _, v := range variants {
+		if models.VaryMatches(v.VaryKey, req.Header) {
+			out = &models.HTTPResponse{}
+			err = db.Where("id = ?", v.ID).Limit(1).Find(out).Error
+			return
+		}
+	}
+	return
+}
+
+type DeleteResponsesOptions struct {
+	DB *gorm.DB
+	// Method to delete, empty for all
+	Method string
+	// URL to delete
+	URL string
+	// Prefix delete by url prefix
+	Prefix string
+	// PathPrefix delete by url path prefix
+	PathPrefix string
+	// Deleted is the number of deleted responses
+	Deleted int64
+}
+
+// DeleteResponses delete by url, url prefix or path prefix, delete all if empty, pinned responses are kept
+func DeleteResponses(o *DeleteResponsesOptions) (err error) {
+	q := o.DB.Where("coalesce(pinned, false) = false")
+	if o.Method != "" {
+		q = q.Where("method = ?", o.Method)
+	}
+	if o.URL != "" {
+		q = q.Where("url = ?", o.URL)
+	}
+	if o.Prefix != "" {
+		q = q.Where("substr(url, 1, ?) = ?", len(o.Prefix), o.Prefix)
+	}
+	if o.PathPrefix != "" {
+		q = q.Where("substr(path, 1, ?) = ?", len(o.PathPrefix), o.PathPrefix)
+	}
+	r := q.Delete(&models.HTTPResponse{})
+	o.Deleted = r.RowsAffected
+	return r.Error
+}
+
+// DeleteAll delete all responses and versions in db, include the pinned, the db is kept open
+func DeleteAll(db *gorm.DB) (deleted int64, err error) {
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for _, model := range []interface{}{&models.HTTPResponse{}, &models.HTTPResponseVersion{}} {
+			if !tx.Migrator().HasTable(model) {
+				continue
+			}
+			r := tx.Where("1 = 1").Delete(model)
+			if r.Error != nil {
+				return r.Error
+			}
+			deleted += r.RowsAffected
+		}
+		return nil
+	})
+	return
+}
+
+// Stats of responses in a db
+type Stats struct {
+	Count    int64 `json:"count"`
+	Files    int64 `json:"files"`     // responses stored as file
+	RawSize  int64 `json:"raw_size"`  // raw size of responses stored in db
+	BodySize int64 `json:"body_size"` // encoded size of responses stored in db
+	FileSize int64 `json:"file_size"` // raw size of responses stored as file
+}
+
+// Ratio is the compression ratio of responses stored in db
+func (s *Stats) Ratio() float64 {
+	if s.BodySize == 0 {
+		return 0
+	}
+	return float64(s.RawSize) / float64(s.BodySize)
+}
+
+func (s *Stats) Add(o *Stats) {
+	s.Count += o.Count
+	s.Files += o.Files
+	s.RawSize += o.RawSize
+	s.BodySize += o.BodySize
+	s.FileSize += o.FileSize
+}
+
+func GetStats(db *gorm.DB) (out *Stats, err error) {
+	out = &Stats{}
+	err = db.Model(&models.HTTPResponse{}).Select(`count(*) as count,
+coalesce(sum(case when content_hash != '' then 1 else 0 end), 0) as files,
+coalesce(sum(case when content_hash = '' then raw_size else 0 end), 0) as raw_size,
+coalesce(sum(body_size), 0) as body_size,
+coalesce(sum(case when content_hash != '' then raw_size else 0 end), 0) as file_size`).Scan(out).Error
+	return
+}
+
+// OpenBody return the decoded body of the response
+func OpenBody(hr *models.HTTPResponse, fileDB *gorm.DB, blobs BlobStore) (rc io.ReadCloser, err error) {
+	if hr.ContentHash == "" {
+		return hr.GetBody()
+	}
+	rc, _, err = openFile(fileDB, blobs, hr.ContentHash)
+	return
+}
+
+// openFile return the content of file, ErrBlobNotFound if not exists
+func openFile(fileDB *gorm.DB, blobs BlobStore, hash string) (rc io.ReadCloser, file *models.FileContent, err error) {
+	file = &models.FileContent{}
+	err = fileDB.Where(models.FileContent{Hash: hash}).Limit(1).Find(file).Error
+	if err != nil {
+		return
+	}
+	if file.Content != nil {
+		return io.NopCloser(bytes.NewReader(file.Content)), file, nil
+	}
+	if blobs == nil {
+		blobs = &DBBlobStore{DB: fileDB}
+	}
+	rc, err = blobs.GetBlob(hash)
+	return
+}
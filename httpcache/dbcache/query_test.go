@@ -0,0 +1,38 @@
+package dbcache_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wenerme/proxc/httpcache"
+	"github.com/wenerme/proxc/httpcache/dbcache"
+	"github.com/wenerme/proxc/httpcache/dbcache/sqlitecache"
+	"github.com/wenerme/wego/testx"
+)
+
+func TestDeleteResponses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.URL.Path)
+	}))
+	defer server.Close()
+	cache := sqlitecache.NewSQLiteCache(t.TempDir())
+	client := httpcache.NewTransport(cache).Client()
+	for _, p := range []string{"/a/1", "/a/2", "/ab", "/b/1"} {
+		resp := testx.Must(client.Get(server.URL + p))
+		_, _ = io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+	}
+	db, _, err := cache.GetDB(testx.Must(http.NewRequest("GET", server.URL, nil)))
+	testx.NoErr(err)
+
+	o := &dbcache.DeleteResponsesOptions{DB: db, PathPrefix: "/a/"}
+	testx.NoErr(dbcache.DeleteResponses(o))
+	assert.Equal(t, int64(2), o.Deleted)
+	o = &dbcache.DeleteResponsesOptions{DB: db, Prefix: server.URL + "/a"}
+	testx.NoErr(dbcache.DeleteResponses(o))
+	assert.Equal(t, int64(1), o.Deleted)
+	assert.NotNil(t, testx.Must(dbcache.FindResponse(db, "GET", server.URL+"/b/1")))
+}
@@ -2,35 +2,144 @@ package sqlitecache
 
 import (
 	"net/http"
+	"path/filepath"
 
+	"github.com/pkg/errors"
 	"github.com/wenerme/proxc/httpcache/dbcache"
 	"github.com/wenerme/proxc/httpcache/dbcache/models"
 	"gorm.io/gorm"
 )
 
-// NewSQLiteCache create a cache for per host sqlite db plus a file db
+// FileDBKey is the key of the shared file db in Set
+const FileDBKey = "file"
+
+// Hosts list hosts which has db in set
+func Hosts(set *Set) (hosts []string, err error) {
+	keys, err := set.Keys()
+	for _, v := range keys {
+		if v != FileDBKey {
+			hosts = append(hosts, v)
+		}
+	}
+	return
+}
+
+// NewSQLiteCache create a cache for per host sqlite db plus a file db, file content is stored in `<dir>/blobs`
 func NewSQLiteCache(dir string) *dbcache.Cache {
-	set := &Set{Dir: dir}
-	return &dbcache.Cache{GetDB: GetDBByHost(set)}
+	return NewSetCache(&Set{Dir: dir})
+}
+
+// NewSetCache create a cache for per host sqlite db plus a file db of set
+func NewSetCache(set *Set) *dbcache.Cache {
+	return &dbcache.Cache{
+		GetDB: GetDBByHost(set),
+		Blobs: &dbcache.FSBlobStore{Dir: BlobDir(set.Dir)},
+	}
+}
+
+// BlobDir return the default blob dir of db dir
+func BlobDir(dir string) string {
+	return filepath.Join(dir, "blobs")
 }
 
 func GetDBByHost(set *Set) func(r *http.Request) (db *gorm.DB, file *gorm.DB, err error) {
 	return func(r *http.Request) (db *gorm.DB, file *gorm.DB, err error) {
-		db, err = set.Get(r.URL.Hostname(), func(o *GetDBOptions) {
-			o.OnInit = func(db *gorm.DB) error {
-				return db.AutoMigrate(models.HTTPResponse{})
-			}
-		})
+		db, err = OpenHostDB(set, r.URL.Hostname())
 		if err != nil {
 			return
 		}
-		file, err = set.Get("file", func(o *GetDBOptions) {
-			o.OnInit = func(db *gorm.DB) error {
-				return db.AutoMigrate(models.FileContent{}, models.FileRef{})
+		file, err = OpenFileDB(set)
+		return
+	}
+}
+
+// OpenHostDB open the response db of host
+func OpenHostDB(set *Set, host string) (*gorm.DB, error) {
+	return set.Get(host, func(o *GetDBOptions) {
+		o.OnInit = migrateHostDB
+	})
+}
+
+func migrateHostDB(db *gorm.DB) (err error) {
+	m := db.Migrator()
+	// fill the keys of legacy responses before creating the unique index, NULL never matches
+	for _, col := range []struct {
+		Field  string
+		Column string
+		Value  interface{}
+	}{
+		{"VaryKey", "vary_key", ""},
+		{"CacheKey", "cache_key", gorm.Expr("url")},
+	} {
+		for _, model := range []interface{}{models.HTTPResponse{}, models.HTTPResponseVersion{}} {
+			if !m.HasTable(model) || m.HasColumn(model, col.Field) {
+				continue
+			}
+			if err = m.AddColumn(model, col.Field); err != nil {
+				return
+			}
+			if err = db.Model(model).Where("1 = 1").UpdateColumn(col.Column, col.Value).Error; err != nil {
+				return
+			}
+		}
+	}
+	// replaced by idx_http_responses_method_key_vary
+	for _, name := range []string{"idx_http_responses_method_url", "idx_http_responses_method_url_vary"} {
+		if m.HasIndex(models.HTTPResponse{}, name) {
+			if err = m.DropIndex(models.HTTPResponse{}, name); err != nil {
+				return
 			}
-		})
+		}
+	}
+	return db.AutoMigrate(models.HTTPResponse{}, models.HTTPResponseVersion{})
+}
+
+// OpenFileDB open the shared file db
+func OpenFileDB(set *Set) (*gorm.DB, error) {
+	return set.Get(FileDBKey, func(o *GetDBOptions) {
+		o.OnInit = func(db *gorm.DB) error {
+			return db.AutoMigrate(models.FileContent{}, models.FileRef{}, models.FileChunk{})
+		}
+	})
+}
+
+// Evict responses of all hosts in set exceed the limits of o, then collect the unreferenced files and reclaim the space
+func Evict(set *Set, o *dbcache.EvictOptions) (err error) {
+	if o.DBs, o.FileDB, err = openAll(set); err != nil {
+		return
+	}
+	if err = dbcache.Evict(o); err != nil {
+		return
+	}
+	for host, db := range o.DBs {
+		if err = IncrementalVacuum(db); err != nil {
+			return errors.Wrapf(err, "vacuum %s", host)
+		}
+	}
+	return IncrementalVacuum(o.FileDB)
+}
+
+// Fsck check the files of all hosts, see dbcache.Fsck
+func Fsck(set *Set, o *dbcache.FsckOptions) (err error) {
+	if o.DBs, o.FileDB, err = openAll(set); err != nil {
 		return
 	}
+	return dbcache.Fsck(o)
+}
+
+func openAll(set *Set) (dbs map[string]*gorm.DB, file *gorm.DB, err error) {
+	hosts, err := Hosts(set)
+	if err != nil {
+		return
+	}
+	dbs = map[string]*gorm.DB{}
+	for _, host := range hosts {
+		if dbs[host], err = OpenHostDB(set, host); err != nil {
+			return
+		}
+	}
+	file, err = OpenFileDB(set)
+	return
 }
 
 // NewMemoryCache create a cache use memory sqlite
@@ -41,7 +150,10 @@ func NewMemoryCache() *dbcache.Cache {
 			db, err := set.Get("mem", func(opts *GetDBOptions) {
 				opts.Params["mode"] = "memory"
 				opts.OnInit = func(db *gorm.DB) error {
-					return db.AutoMigrate(models.HTTPResponse{}, models.FileContent{}, models.FileRef{})
+					if err := migrateHostDB(db); err != nil {
+						return err
+					}
+					return db.AutoMigrate(models.FileContent{}, models.FileRef{}, models.FileChunk{})
 				}
 			})
 			return db, db, err
@@ -3,10 +3,15 @@ package sqlitecache
 import (
 	"fmt"
 	"net/url"
+	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 
+	"github.com/pkg/errors"
+	"go.uber.org/multierr"
+
 	_ "github.com/glebarez/go-sqlite" //nolint:revive
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
@@ -51,7 +56,7 @@ func (d *Set) Get(key string, opts ...func(*GetDBOptions)) (db *gorm.DB, err err
 			"synchronous":        0,
 			"journal_mode":       "WAL",
 			"page_size":          8192, // 8K
-			"auto_vacuum":        0,
+			"auto_vacuum":        2,    // incremental, existing db converts on VACUUM
 			"busy_timeout":       3000, // 3s
 			"wal_autocheckpoint": 2000, // 16MB
 		},
@@ -87,6 +92,9 @@ func (d *Set) Get(key string, opts ...func(*GetDBOptions)) (db *gorm.DB, err err
 		DSN:        dsn.String(),
 		// Conn: db,
 	}, o.Config)
+	if err == nil {
+		err = initAutoVacuum(db)
+	}
 	if err == nil {
 		err = o.OnInit(db)
 	}
@@ -95,3 +103,123 @@ func (d *Set) Get(key string, opts ...func(*GetDBOptions)) (db *gorm.DB, err err
 	}
 	return
 }
+
+// Keys list keys of db files in Dir
+func (d *Set) Keys() (keys []string, err error) {
+	matches, err := filepath.Glob(filepath.Join(d.Dir, "*.sqlite"))
+	if err != nil {
+		return
+	}
+	for _, v := range matches {
+		keys = append(keys, strings.TrimSuffix(filepath.Base(v), ".sqlite"))
+	}
+	sort.Strings(keys)
+	return
+}
+
+// Opened list keys of opened db
+func (d *Set) Opened() (keys []string) {
+	d.l.RLock()
+	defer d.l.RUnlock()
+	for k := range d.DBs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return
+}
+
+// Size return the size of db files of key, include the wal file
+func (d *Set) Size(key string) (size int64, err error) {
+	if !ValidKey(key) {
+		return 0, errors.Errorf("invalid key %q", key)
+	}
+	fn := filepath.Join(d.Dir, key+".sqlite")
+	for _, v := range []string{fn, fn + "-wal"} {
+		fi, err := os.Stat(v)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+		size += fi.Size()
+	}
+	return
+}
+
+// Has return true if db file of key exists
+func (d *Set) Has(key string) bool {
+	if !ValidKey(key) {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(d.Dir, key+".sqlite"))
+	return err == nil
+}
+
+// Remove close the db of key and remove the db files
+func (d *Set) Remove(key string) (err error) {
+	if !ValidKey(key) {
+		return errors.Errorf("invalid key %q", key)
+	}
+	d.l.Lock()
+	defer d.l.Unlock()
+
+	if db := d.DBs[key]; db != nil {
+		delete(d.DBs, key)
+		if sqlDB, _ := db.DB(); sqlDB != nil {
+			err = sqlDB.Close()
+		}
+	}
+	fn := filepath.Join(d.Dir, key+".sqlite")
+	for _, v := range []string{fn, fn + "-wal", fn + "-shm"} {
+		if rmErr := os.Remove(v); rmErr != nil && !os.IsNotExist(rmErr) {
+			err = multierr.Append(err, rmErr)
+		}
+	}
+	return
+}
+
+// Close all opened db
+func (d *Set) Close() (err error) {
+	d.l.Lock()
+	defer d.l.Unlock()
+	for k, db := range d.DBs {
+		delete(d.DBs, k)
+		if sqlDB, _ := db.DB(); sqlDB != nil {
+			err = multierr.Append(err, sqlDB.Close())
+		}
+	}
+	return
+}
+
+// ValidKey return false if key can not be used as a file name
+func ValidKey(key string) bool {
+	return key != "" && key != "." && key != ".." && !strings.ContainsAny(key, `/\`)
+}
+
+// Vacuum rebuild the db to reclaim space and truncate the wal file
+func Vacuum(db *gorm.DB) error {
+	if err := db.Exec("VACUUM").Error; err != nil {
+		return err
+	}
+	return db.Exec("PRAGMA wal_checkpoint(TRUNCATE)").Error
+}
+
+// initAutoVacuum enable the incremental auto vacuum of new db, the mode can only be changed before any table created or by VACUUM
+func initAutoVacuum(db *gorm.DB) (err error) {
+	var mode, tables int
+	if err = db.Raw("PRAGMA auto_vacuum").Scan(&mode).Error; err != nil || mode == 2 {
+		return
+	}
+	if err = db.Raw("SELECT count(*) FROM sqlite_master").Scan(&tables).Error; err != nil || tables > 0 {
+		return
+	}
+	if err = db.Exec("PRAGMA auto_vacuum = 2").Error; err != nil {
+		return
+	}
+	return db.Exec("VACUUM").Error
+}
+
+// IncrementalVacuum reclaim the free pages, only works for auto_vacuum incremental db
+func IncrementalVacuum(db *gorm.DB) error {
+	return db.Exec("PRAGMA incremental_vacuum").Error
+}
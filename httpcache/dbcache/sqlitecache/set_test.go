@@ -0,0 +1,53 @@
+package sqlitecache
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wenerme/proxc/httpcache"
+	"github.com/wenerme/proxc/httpcache/dbcache"
+	"github.com/wenerme/wego/testx"
+)
+
+func TestReopenHostDB(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "Hello proxc")
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	set := &Set{Dir: dir}
+	client := http.Client{Transport: httpcache.NewTransport(NewSetCache(set))}
+	resp := testx.Must(client.Get(server.URL))
+	_, _ = io.ReadAll(resp.Body)
+	testx.NoErr(set.Close())
+
+	// migrate again must keep the data
+	for i := 0; i < 2; i++ {
+		set = &Set{Dir: dir}
+		db := testx.Must(OpenHostDB(set, resp.Request.URL.Hostname()))
+		hr := testx.Must(dbcache.FindResponse(db, "GET", resp.Request.URL.String()))
+		if assert.NotNil(t, hr) {
+			assert.Equal(t, http.StatusOK, hr.StatusCode)
+			assert.NotEmpty(t, hr.Header)
+		}
+		testx.NoErr(set.Close())
+	}
+}
+
+func TestSetRemove(t *testing.T) {
+	set := &Set{Dir: t.TempDir()}
+	defer set.Close()
+	testx.Must(OpenHostDB(set, "a.test"))
+	testx.Must(OpenFileDB(set))
+	assert.Equal(t, []string{"a.test"}, testx.Must(Hosts(set)))
+	assert.Equal(t, []string{"a.test", FileDBKey}, set.Opened())
+
+	testx.NoErr(set.Remove("a.test"))
+	assert.False(t, set.Has("a.test"))
+	assert.Equal(t, []string{FileDBKey}, set.Opened())
+	assert.Empty(t, testx.Must(Hosts(set)))
+	assert.Error(t, set.Remove("../a.test"))
+}
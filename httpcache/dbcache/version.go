@@ -0,0 +1,260 @@
+package dbcache
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/pmezard/go-difflib/difflib"
+	"github.com/wenerme/proxc/har"
+	"github.com/wenerme/proxc/httpcache/dbcache/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// AddVersion record hr as models.HTTPResponseVersion,
+// only update the time of the latest version if the status and body are not changed
+func AddVersion(tx *gorm.DB, hr *models.HTTPResponse) (err error) {
+	hash := hr.ContentHash
+	if hash == "" {
+		var body io.ReadCloser
+		if body, err = hr.GetBody(); err != nil {
+			return
+		}
+		hash, err = models.ContentHash(body)
+		_ = body.Close()
+		if err != nil {
+			return
+		}
+	}
+
+	last := &models.HTTPResponseVersion{}
+	err = tx.Select("id", "status_code", "body_hash").Where("method = ? AND cache_key = ? AND vary_key = ?", hr.Method, hr.CacheKey, hr.VaryKey).
+		Order("id desc").Limit(1).Find(last).Error
+	if err != nil {
+		return
+	}
+	if last.ID != 0 && last.StatusCode == hr.StatusCode && last.BodyHash == hash {
+		return tx.Model(last).UpdateColumn("updated_at", hr.UpdatedAt).Error
+	}
+
+	v := models.NewHTTPResponseVersion(hr)
+	v.BodyHash = hash
+	if v.ResponseID == 0 {
+		err = tx.Model(&models.HTTPResponse{}).Where("method = ? AND cache_key = ? AND vary_key = ?", hr.Method, hr.CacheKey, hr.VaryKey).
+			Limit(1).Pluck("id", &v.ResponseID).Error
+		if err != nil {
+			return
+		}
+	}
+	return tx.Create(v).Error
+}
+
+// ListVersions list versions of the response variant by method, cache key and vary key without body, latest first
+func ListVersions(db *gorm.DB, method string, key string, varyKey string) (out []*models.HTTPResponseVersion, err error) {
+	err = db.Omit("body").Where("method = ? AND cache_key = ? AND vary_key = ?", method, key, varyKey).Order("id desc").Find(&out).Error
+	return
+}
+
+// ErrAmbiguousVariant indicates the cache key has multiple variants, the vary key is required
+var ErrAmbiguousVariant = errors.New("multiple variants, the vary key is required")
+
+// VaryKeys return the distinct vary keys of the responses and versions of method and cache key
+func VaryKeys(db *gorm.DB, method string, key string) (out []string, err error) {
+	seen := map[string]bool{}
+	for _, model := range []interface{}{&models.HTTPResponse{}, &models.HTTPResponseVersion{}} {
+		var keys []string
+		if err = db.Model(model).Distinct("vary_key").Where("method = ? AND cache_key = ?", method, key).Pluck("vary_key", &keys).Error; err != nil {
+			return
+		}
+		for _, v := range keys {
+			if !seen[v] {
+				seen[v] = true
+				out = append(out, v)
+			}
+		}
+	}
+	sort.Strings(out)
+	return
+}
+
+// OnlyVaryKey return the vary key of the only variant of method and cache key, ErrAmbiguousVariant if multiple
+func OnlyVaryKey(db *gorm.DB, method string, key string) (varyKey string, err error) {
+	keys, err := VaryKeys(db, method, key)
+	switch {
+	case err != nil || len(keys) == 0:
+		return
+	case len(keys) > 1:
+		return "", errors.Wrapf(ErrAmbiguousVariant, "%s %s vary by %s", method, key, strings.Join(keys, " | "))
+	}
+	return keys[0], nil
+}
+
+// FindVersion find the version by id, return nil if not found
+func FindVersion(db *gorm.DB, id uint) (out *models.HTTPResponseVersion, err error) {
+	out = &models.HTTPResponseVersion{}
+	err = db.Where("id = ?", id).Limit(1).Find(out).Error
+	if err != nil || out.ID == 0 {
+		return nil, err
+	}
+	return
+}
+
+type DiffVersionsOptions struct {
+	DB     *gorm.DB
+	FileDB *gorm.DB
+	Blobs  BlobStore
+	Method string
+	// Key and VaryKey of the response variant
+	Key     string
+	VaryKey string
+	// From version id
+	From uint
+	// To version id, 0 for the current response
+	To uint
+	// Context lines of diff, default to 3
+	Context int
+}
+
+// DiffVersions return the unified diff of status, headers and body of two versions,
+// binary body is compared by hash
+func DiffVersions(o *DiffVersionsOptions) (out string, err error) {
+	if o.Context <= 0 {
+		o.Context = 3
+	}
+	a, err := o.find(o.From, nil)
+	if err != nil {
+		return
+	}
+	b, err := o.find(o.To, a)
+	if err != nil {
+		return
+	}
+	ta, err := o.text(a)
+	if err != nil {
+		return
+	}
+	tb, err := o.text(b)
+	if err != nil {
+		return
+	}
+	return difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(ta),
+		B:        difflib.SplitLines(tb),
+		FromFile: o.name(o.From),
+		ToFile:   o.name(o.To),
+		Context:  o.Context,
+	})
+}
+
+func (o *DiffVersionsOptions) name(id uint) string {
+	if id == 0 {
+		return "current"
+	}
+	return fmt.Sprintf("version %d", id)
+}
+
+// find the version by id, or the current response of the same variant as other if id is 0
+func (o *DiffVersionsOptions) find(id uint, other *models.HTTPResponse) (hr *models.HTTPResponse, err error) {
+	switch {
+	case id == 0 && other != nil:
+		hr, err = FindVariant(o.DB, o.Method, other.CacheKey, other.VaryKey)
+	case id == 0:
+		hr, err = FindVariant(o.DB, o.Method, o.Key, o.VaryKey)
+	default:
+		var v *models.HTTPResponseVersion
+		v, err = FindVersion(o.DB, id)
+		if v != nil {
+			if v.Method != o.Method || v.CacheKey != o.Key || v.VaryKey != o.VaryKey {
+				return nil, errors.Errorf("version %d is not a version of %s %s", id, o.Method, o.Key)
+			}
+			hr = v.GetHTTPResponse()
+		}
+	}
+	if err == nil && hr == nil {
+		err = errors.Errorf("%s not found", o.name(id))
+	}
+	return
+}
+
+func (o *DiffVersionsOptions) text(hr *models.HTTPResponse) (out string, err error) {
+	sb := &strings.Builder{}
+	fmt.Fprintf(sb, "%s %d %s\n", hr.Proto, hr.StatusCode, http.StatusText(hr.StatusCode))
+	header := http.Header{}
+	if len(hr.Header) > 0 {
+		if err = json.Unmarshal(hr.Header, &header); err != nil {
+			return
+		}
+	}
+	keys := make([]string, 0, len(header))
+	for k := range header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range header[k] {
+			fmt.Fprintf(sb, "%s: %s\n", k, v)
+		}
+	}
+	sb.WriteString("\n")
+
+	body, err := OpenBody(hr, o.FileDB, o.Blobs)
+	if err != nil {
+		return
+	}
+	defer body.Close()
+	if !har.IsText(hr.ContentType) {
+		var hash string
+		hash, err = models.ContentHash(body)
+		fmt.Fprintf(sb, "binary body sha256:%s\n", hash)
+		return sb.String(), err
+	}
+	_, err = io.Copy(sb, body)
+	return sb.String(), err
+}
+
+// PinVersion replace the response by the version and keep it from being overwritten,
+// the current response is recorded as a version before replacing
+func PinVersion(db *gorm.DB, id uint) (hr *models.HTTPResponse, err error) {
+	err = db.Transaction(func(tx *gorm.DB) error {
+		v, err := FindVersion(tx, id)
+		if err != nil {
+			return err
+		}
+		if v == nil {
+			return errors.Errorf("version %d not found", id)
+		}
+		cur, err := FindVariant(tx, v.Method, v.CacheKey, v.VaryKey)
+		if err != nil {
+			return err
+		}
+		if cur != nil && !cur.Pinned {
+			if err = AddVersion(tx, cur); err != nil {
+				return err
+			}
+		}
+		hr = v.GetHTTPResponse()
+		hr.Pinned = true
+		hr.UpdatedAt = time.Now()
+		err = tx.Clauses(clause.OnConflict{Columns: hr.ConflictColumns(), DoUpdates: clause.AssignmentColumns(hr.PayloadColumns())}).
+			Create(hr).Error
+		if err != nil {
+			return err
+		}
+		// the access tracking of the replaced response is kept
+		hr, err = FindVariant(tx, v.Method, v.CacheKey, v.VaryKey)
+		return err
+	})
+	return
+}
+
+// UnpinResponse allow the response variant by method, cache key and vary key to be overwritten again
+func UnpinResponse(db *gorm.DB, method string, key string, varyKey string) error {
+	return db.Model(&models.HTTPResponse{}).Where("method = ? AND cache_key = ? AND vary_key = ?", method, key, varyKey).
+		UpdateColumn("pinned", false).Error
+}
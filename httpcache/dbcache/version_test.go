@@ -0,0 +1,90 @@
+package dbcache_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wenerme/proxc/httpcache"
+	"github.com/wenerme/proxc/httpcache/dbcache"
+	"github.com/wenerme/proxc/httpcache/dbcache/models"
+	"github.com/wenerme/proxc/httpcache/dbcache/sqlitecache"
+	"github.com/wenerme/wego/testx"
+)
+
+func TestVersionHistory(t *testing.T) {
+	body := "a"
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(body + "\n"))
+	}))
+	defer server.Close()
+
+	cache := sqlitecache.NewMemoryCache()
+	cache.History = true
+	tp := httpcache.NewTransport(cache)
+	tp.Mode = httpcache.ModeRecord
+	client := http.Client{Transport: tp}
+	fetch := func(v string) {
+		body = v
+		resp := testx.Must(client.Get(server.URL))
+		_, _ = io.ReadAll(resp.Body)
+	}
+	current := func() string {
+		resp := testx.Must(cache.GetResponse(testx.Must(http.NewRequest("GET", server.URL, nil))))
+		if resp == nil {
+			return ""
+		}
+		return string(testx.Must(io.ReadAll(resp.Body)))
+	}
+
+	fetch("a")
+	fetch("a")
+	fetch("b")
+	db, fdb, err := cache.GetDB(testx.Must(http.NewRequest("GET", server.URL, nil)))
+	testx.NoErr(err)
+	versions := testx.Must(dbcache.ListVersions(db, "GET", server.URL, ""))
+	assert.Len(t, versions, 2)
+	first := versions[1]
+	assert.Equal(t, models.ContentHashBytes([]byte("a\n")), first.BodyHash)
+	assert.True(t, first.UpdatedAt.After(first.CreatedAt))
+
+	diff := testx.Must(dbcache.DiffVersions(&dbcache.DiffVersionsOptions{DB: db, FileDB: fdb, Method: "GET", Key: server.URL, From: first.ID}))
+	assert.Contains(t, diff, "-a\n+b\n")
+
+	// the access tracking of the replaced response is kept
+	testx.NoErr(db.Model(&models.HTTPResponse{}).Where("url = ?", server.URL).UpdateColumn("hits", 5).Error)
+	before := testx.Must(dbcache.FindResponse(db, "GET", server.URL))
+	pinned := testx.Must(dbcache.PinVersion(db, first.ID))
+	assert.True(t, pinned.Pinned)
+	assert.Equal(t, int64(5), pinned.Hits)
+	assert.Equal(t, before.ID, pinned.ID)
+	assert.True(t, before.CreatedAt.Equal(pinned.CreatedAt))
+	assert.Equal(t, "a\n", current())
+	fetch("c")
+	assert.Equal(t, "a\n", current())
+	assert.Len(t, testx.Must(dbcache.ListVersions(db, "GET", server.URL, "")), 3)
+
+	// invalidation and error responses keep the pinned response
+	tp.Mode = httpcache.ModeDefault
+	resp := testx.Must(client.Post(server.URL, "text/plain", nil))
+	_ = resp.Body.Close()
+	assert.Equal(t, "a\n", current())
+	status = http.StatusInternalServerError
+	fetch("d")
+	assert.Equal(t, "a\n", current())
+	status = http.StatusOK
+	o := &dbcache.DeleteResponsesOptions{DB: db, URL: server.URL}
+	testx.NoErr(dbcache.DeleteResponses(o))
+	assert.Equal(t, int64(0), o.Deleted)
+	assert.Equal(t, "a\n", current())
+	tp.Mode = httpcache.ModeRecord
+
+	testx.NoErr(dbcache.UnpinResponse(db, "GET", server.URL, ""))
+	fetch("c")
+	assert.Equal(t, "c\n", current())
+}
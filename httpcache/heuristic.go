@@ -0,0 +1,116 @@
+package httpcache
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// DefaultHeuristicFraction of the time since Last-Modified is the heuristic freshness lifetime
+	DefaultHeuristicFraction = 0.1
+	// DefaultHeuristicMaxAge caps the heuristic freshness lifetime
+	DefaultHeuristicMaxAge = 24 * time.Hour
+)
+
+// heuristicStatus are the status codes heuristically cacheable by default, RFC 9110 15.1
+var heuristicStatus = map[int]bool{
+	200: true, 203: true, 204: true, 206: true, 300: true, 301: true, 308: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+// Heuristic freshness of the responses without explicit expiration time, see RFC 9111 4.2.2
+type Heuristic struct {
+	// Fraction of the time between Last-Modified and Date is the lifetime, default to DefaultHeuristicFraction
+	Fraction float64 `yaml:"fraction,omitempty"`
+	// MaxAge caps the lifetime, default to DefaultHeuristicMaxAge
+	MaxAge time.Duration `yaml:"max_age,omitempty"`
+	// Header is set on the responses served fresh by heuristic, default to `Warning: 113 - "Heuristic Expiration"`
+	Header http.Header `yaml:"header,omitempty"`
+}
+
+// Lifetime return the heuristic freshness lifetime of resp, false if resp has explicit expiration or no Last-Modified
+func (h *Heuristic) Lifetime(resp *http.Response) (lifetime time.Duration, ok bool) {
+	cc := parseCacheControl(resp.Header)
+	_, public := cc["public"]
+	if !heuristicStatus[resp.StatusCode] && !public {
+		return
+	}
+	for _, v := range []string{"no-cache", "no-store", "max-age", "s-maxage"} {
+		if _, found := cc[v]; found {
+			return
+		}
+	}
+	if resp.Header.Get("Expires") != "" {
+		return
+	}
+	date, err := Date(resp.Header)
+	if err != nil {
+		return
+	}
+	lastModified, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil || !lastModified.Before(date) {
+		return
+	}
+	fraction, maxAge := h.Fraction, h.MaxAge
+	if fraction <= 0 {
+		fraction = DefaultHeuristicFraction
+	}
+	if maxAge <= 0 {
+		maxAge = DefaultHeuristicMaxAge
+	}
+	lifetime = time.Duration(float64(date.Sub(lastModified)) * fraction)
+	if lifetime > maxAge {
+		lifetime = maxAge
+	}
+	return lifetime, true
+}
+
+// GetFreshness is GetFreshness with the heuristic lifetime, the responses fresh by heuristic get the Age and Header
+func (h *Heuristic) GetFreshness(req *http.Request, resp *http.Response) (freshness int) {
+	return h.freshness(req, resp, GetFreshness(req, resp), false)
+}
+
+// freshness apply the heuristic lifetime to the Stale freshness, the shared cache computes the age by the stored times
+func (h *Heuristic) freshness(req *http.Request, resp *http.Response, freshness int, shared bool) int {
+	if freshness != Stale {
+		return freshness
+	}
+	lifetime, ok := h.Lifetime(resp)
+	if !ok {
+		return freshness
+	}
+	date, err := Date(resp.Header)
+	if err != nil {
+		return freshness
+	}
+	age := clock.since(date)
+	if shared {
+		age = cachedAge(resp.Header)
+	}
+	current := age
+	reqCacheControl := parseCacheControl(req.Header)
+	if v, ok := reqCacheControl["max-age"]; ok {
+		if maxAge, err := strconv.Atoi(v); err != nil || age >= time.Duration(maxAge)*time.Second {
+			return freshness
+		}
+	}
+	if v, ok := reqCacheControl["min-fresh"]; ok {
+		if minFresh, err := strconv.Atoi(v); err == nil {
+			age += time.Duration(minFresh) * time.Second
+		}
+	}
+	if age >= lifetime {
+		return freshness
+	}
+
+	resp.Header.Set("Age", strconv.Itoa(int(current.Seconds())))
+	header := h.Header
+	if header == nil {
+		header = http.Header{"Warning": {`113 - "Heuristic Expiration"`}}
+	}
+	for k, v := range header {
+		resp.Header[http.CanonicalHeaderKey(k)] = v
+	}
+	return Fresh
+}
@@ -1,30 +1,55 @@
 // Package httpcache provides a http.RoundTripper implementation that works as a
 // mostly RFC-compliant cache for http responses.
 //
-// It is only suitable for use as a 'private' cache (i.e. for a web-browser or an API-client
-// and not for a shared proxy).
+// It works as a 'private' cache (i.e. for a web-browser or an API-client) by default,
+// set Transport.Shared to work as a shared proxy cache.
 //
 package httpcache
 
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
+	"github.com/wenerme/proxc/httpcache/cachekey"
+	"github.com/wenerme/proxc/httpcache/reqtrace"
+	"github.com/wenerme/proxc/httpcache/spool"
 )
 
 const (
 	Stale = iota
 	Fresh
 	Transparent
+	// StaleWhileRevalidate indicates the response can be returned while it is revalidated in background
+	StaleWhileRevalidate
 	// XFromCache is the header added to responses that are returned from the cache
 	XFromCache = "X-From-Cache"
+	// XCacheMissKey is the header added to replay mode miss responses, contains the missing cache key
+	XCacheMissKey = "X-Cache-Miss-Key"
+	// XCacheRequestTime and XCacheResponseTime are the times of the upstream request and response stored with the
+	// response to compute the Age, removed before the cached response is returned
+	XCacheRequestTime  = "X-Cache-Request-Time"
+	XCacheResponseTime = "X-Cache-Response-Time"
+)
+
+const (
+	// ModeDefault caches responses and revalidates them with upstream
+	ModeDefault = ""
+	// ModeReplay serves only from the cache, never touches the upstream or deletes entries
+	ModeReplay = "replay"
+	// ModeRecord always fetches from the upstream and stores the response regardless of the cache control
+	ModeRecord = "record"
 )
 
 // A Cache interface is used by the Transport to store and retrieve responses.
@@ -49,6 +74,34 @@ type Transport struct {
 	// If true, responses returned from the cache will be given an extra header, X-From-Cache
 	MarkCachedResponses bool
 	GetFreshness        func(req *http.Request, resp *http.Response) int
+	// SpoolSize is the max size of response body hold in memory before caching,
+	// larger body will spool to temp file in SpoolDir, default to spool.DefaultLimit
+	SpoolSize int64
+	SpoolDir  string
+	// Mode of the transport, ModeDefault, ModeReplay or ModeRecord
+	Mode string
+	// ReplayMissStatus is the status code of replay mode miss response, default to 504
+	ReplayMissStatus int
+	// KeyFunc return the cache key of request, default to the url, see cachekey.New for built-in normalizers
+	KeyFunc cachekey.Func
+	// Cacheable return true if the request other than GET or HEAD can be cached, e.g. idempotent POST,
+	// the request body is buffered, KeyFunc should include the body, default to the url and the body hash
+	Cacheable func(req *http.Request) bool
+	// Revalidator runs the background revalidations of stale-while-revalidate responses,
+	// created with DefaultRevalidateConcurrency if nil
+	Revalidator     *Revalidator
+	revalidatorOnce sync.Once
+	// Observer is notified of the cache results and the served bytes, optional
+	Observer Observer
+	// Heuristic freshness of the responses without explicit expiration time, used when GetFreshness is nil,
+	// disabled if nil, a custom GetFreshness can delegate to RFCFreshness
+	Heuristic *Heuristic
+	// Shared works as a shared cache, RFC 9111 3, honours s-maxage, private, proxy-revalidate, must-revalidate,
+	// does not store the responses of requests with Authorization unless allowed, and sets Age on cached responses
+	Shared bool
+	// flights are the in flight fetches of cache misses by key
+	flights   map[string]*flight
+	flightsMu sync.Mutex
 }
 
 // NewTransport returns a new Transport with the
@@ -85,18 +138,62 @@ func varyMatches(cachedResp *http.Response, req *http.Request) bool {
 // If there is a stale Response, then any validators it contains will be set on the new request
 // to give the server a chance to respond with NotModified. If this happens, then the cached Response
 // will be returned.
-//nolint // todo improve this
 func (t *Transport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
-	// cacheKey := cacheKey(req)
-	cacheable := (req.Method == "GET" || req.Method == "HEAD") && req.Header.Get("range") == ""
+	if t.Observer != nil {
+		resp, err = t.observe(req, t.roundTrip)
+	} else {
+		resp, err = t.roundTrip(req)
+	}
+	if resp != nil {
+		t.setAge(resp)
+	}
+	return
+}
+
+// setAge set the Age of the cached resp in Shared mode and remove the stored times
+func (t *Transport) setAge(resp *http.Response) {
+	if resp.Header.Get(XCacheResponseTime) == "" {
+		return
+	}
+	if t.Shared {
+		resp.Header.Set("Age", strconv.Itoa(int(cachedAge(resp.Header).Seconds())))
+	}
+	resp.Header.Del(XCacheRequestTime)
+	resp.Header.Del(XCacheResponseTime)
+}
+
+//nolint // todo improve this
+func (t *Transport) roundTrip(req *http.Request) (resp *http.Response, err error) {
+	cacheable := t.cacheable(req)
+	if req, err = t.withKey(req, cacheable); err != nil {
+		return
+	}
+	req, _ = reqtrace.WithTrace(req)
+	switch t.Mode {
+	case ModeReplay:
+		return t.replay(req)
+	case ModeRecord:
+		return t.record(req, cacheable)
+	}
+	if req.Method == "GET" && req.Header.Get("range") != "" {
+		var validator string
+		if resp, validator = t.cachedRange(req); resp != nil {
+			setResult(req, EventHit)
+			return resp, nil
+		}
+		return t.fetchRange(req, validator)
+	}
 	var cachedResp *http.Response
 	if cacheable {
-		cachedResp, err = t.Cache.GetResponse(req)
+		cachedResp, err = t.getResponse(req)
 	} else {
 		// Need to invalidate an existing value
-		if err := t.Cache.DeleteResponse(req); err != nil {
-			log.Warn().Err(err).Str("url", req.URL.String()).Msg("delete response error")
-		}
+		t.deleteResponse(req, nil)
+	}
+	// the client validators are evaluated against the cached response, forwarded to upstream on a miss
+	clientReq := req
+	if cachedResp != nil && err == nil && (req.Method == "GET" || req.Method == "HEAD") {
+		req = withoutValidators(req)
 	}
 
 	transport := t.Transport
@@ -111,14 +208,15 @@ func (t *Transport) RoundTrip(req *http.Request) (resp *http.Response, err error
 
 		if varyMatches(cachedResp, req) {
 			// Can only use cached value if the new request doesn't Vary significantly
-			_getFreshness := t.GetFreshness
-			if _getFreshness == nil {
-				_getFreshness = GetFreshness
-			}
-			freshness := _getFreshness(req, cachedResp)
+			freshness := t.freshness(req, cachedResp)
 
+			if freshness == StaleWhileRevalidate {
+				t.revalidate(req, cachedResp)
+				freshness = Fresh
+			}
 			if freshness == Fresh {
-				return cachedResp, nil
+				setResult(req, EventHit)
+				return conditionalResponse(clientReq, cachedResp, false), nil
 			}
 			if freshness == Stale {
 				var req2 *http.Request
@@ -137,28 +235,33 @@ func (t *Transport) RoundTrip(req *http.Request) (resp *http.Response, err error
 				}
 				if req2 != nil {
 					req = req2
+					t.emit(&Event{Type: EventValidate, Request: req, Response: cachedResp, FromCache: true})
 				}
 			}
 		}
 
 		resp, err = transport.RoundTrip(req)
-		if err == nil && req.Method == "GET" && resp.StatusCode == http.StatusNotModified {
+		if err == nil && (req.Method == "GET" || req.Method == "HEAD") && resp.StatusCode == http.StatusNotModified {
 			// Replace the 304 response with the one from cache, but update with some new headers
 			endToEndHeaders := getEndToEndHeaders(resp.Header)
 			for _, header := range endToEndHeaders {
 				cachedResp.Header[header] = resp.Header[header]
 			}
+			setStoredTimes(cachedResp.Header, req)
 			resp = cachedResp
+			t.emit(&Event{Type: EventNotModified, Request: req, Response: resp, FromCache: true})
+			setResult(req, EventRevalidated)
 		} else if (err != nil || (cachedResp != nil && resp.StatusCode >= 500)) &&
-			req.Method == "GET" && canStaleOnError(cachedResp.Header, req.Header) {
+			req.Method == "GET" && canStaleOnError(cachedResp.Header, req.Header) && !t.mustRevalidate(cachedResp.Header) {
 			// In case of transport failure and stale-if-error activated, returns cached content
 			// when available
-			return cachedResp, nil
+			setResult(req, EventStaleOnError)
+			return conditionalResponse(clientReq, cachedResp, false), nil
 		} else {
-			if err != nil || resp.StatusCode != http.StatusOK {
-				if err := t.Cache.DeleteResponse(req); err != nil {
-					log.Warn().Err(err).Str("url", req.URL.String()).Msg("delete response error")
-				}
+			setResult(req, EventMiss)
+			// keep the cached response when the request is canceled, e.g. canceled revalidation
+			if (err != nil && req.Context().Err() == nil) || (err == nil && resp.StatusCode != http.StatusOK) {
+				t.deleteResponse(req, resp)
 			}
 			if err != nil {
 				return nil, err
@@ -166,8 +269,18 @@ func (t *Transport) RoundTrip(req *http.Request) (resp *http.Response, err error
 		}
 	} else {
 		reqCacheControl := parseCacheControl(req.Header)
+		if cacheable {
+			setResult(req, EventMiss)
+		} else {
+			setResult(req, EventBypass)
+		}
 		if _, ok := reqCacheControl["only-if-cached"]; ok {
 			resp = newGatewayTimeoutResponse(req)
+		} else if cacheable && err == nil && req.Method == "GET" && !hasValidators(req) {
+			// concurrent misses of the same key share one upstream fetch, the conditional one is answered by upstream
+			return t.coalesce(req, func(req *http.Request) (*http.Response, error) {
+				return t.fetch(transport, req)
+			})
 		} else {
 			resp, err = transport.RoundTrip(req)
 			if err != nil {
@@ -176,44 +289,467 @@ func (t *Transport) RoundTrip(req *http.Request) (resp *http.Response, err error
 		}
 	}
 
-	if cacheable && canStore(parseCacheControl(req.Header), parseCacheControl(resp.Header)) {
-		for _, varyKey := range headerAllCommaSepValues(resp.Header, "vary") {
-			varyKey = http.CanonicalHeaderKey(varyKey)
-			fakeHeader := "X-Varied-" + varyKey
-			reqValue := req.Header.Get(varyKey)
-			if reqValue != "" {
-				resp.Header.Set(fakeHeader, reqValue)
+	stored := cacheable && t.canStore(req, resp)
+	if stored {
+		t.store(req, resp)
+	} else {
+		t.deleteResponse(req, resp)
+	}
+	if !cacheable {
+		t.invalidate(req, resp)
+	}
+	if req != clientReq {
+		// the body is read to store the response
+		return conditionalResponse(clientReq, resp, stored), nil
+	}
+	return resp, nil
+}
+
+// fetch req from upstream and store the response if allowed
+func (t *Transport) fetch(transport http.RoundTripper, req *http.Request) (resp *http.Response, err error) {
+	if resp, err = transport.RoundTrip(req); err != nil {
+		return
+	}
+	if t.canStore(req, resp) {
+		t.store(req, resp)
+	} else {
+		t.deleteResponse(req, resp)
+	}
+	return
+}
+
+// canStore return true if resp of req can be stored, see canStore, a shared cache never stores private responses,
+// the response of request with Authorization is stored only if must-revalidate, public or s-maxage, RFC 9111 3.5
+func (t *Transport) canStore(req *http.Request, resp *http.Response) bool {
+	respCacheControl := parseCacheControl(resp.Header)
+	// the 304 of the conditional request from client is not the response
+	if resp.StatusCode == http.StatusNotModified || !canStore(parseCacheControl(req.Header), respCacheControl) {
+		return false
+	}
+	if !t.Shared {
+		return true
+	}
+	// the qualified private is not stored either
+	if _, ok := respCacheControl["private"]; ok {
+		return false
+	}
+	if req.Header.Get("Authorization") != "" {
+		for _, v := range []string{"must-revalidate", "public", "s-maxage"} {
+			if _, ok := respCacheControl[v]; ok {
+				return true
 			}
 		}
-		switch req.Method {
-		case "GET":
-			// Delay caching until EOF is reached.
-			resp.Body = &cachingReadCloser{
-				R: resp.Body,
-				OnEOF: func(r io.Reader) {
-					resp := *resp
-					resp.Body = ioutil.NopCloser(r)
-					if err == nil {
-						if resp.Request == nil {
-							resp.Request = req
-						}
-						if err := t.Cache.SetResponse(&resp); err != nil {
-							log.Warn().Err(err).Str("url", req.URL.String()).Msg("set response error")
-						}
-					}
-				},
-			}
+		return false
+	}
+	return true
+}
+
+// mustRevalidate return true if the stale response can not be served without validation in Shared mode
+func (t *Transport) mustRevalidate(respHeaders http.Header) bool {
+	return t.Shared && sharedMustRevalidate(parseCacheControl(respHeaders))
+}
+
+func sharedMustRevalidate(respCacheControl cacheControl) bool {
+	for _, v := range []string{"must-revalidate", "proxy-revalidate", "s-maxage"} {
+		if _, ok := respCacheControl[v]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// RFCFreshness return the freshness by the cache control, honours Shared and Heuristic, used when GetFreshness is nil
+func (t *Transport) RFCFreshness(req *http.Request, resp *http.Response) (freshness int) {
+	freshness = getFreshnessOf(resp.Header, req.Header, t.Shared)
+	if t.Heuristic != nil {
+		freshness = t.Heuristic.freshness(req, resp, freshness, t.Shared)
+	}
+	return
+}
+
+// freshness of the cached response, always Stale when revalidating
+func (t *Transport) freshness(req *http.Request, cachedResp *http.Response) (freshness int) {
+	switch {
+	case req.Context().Value(revalidateKey{}) != nil:
+		freshness = Stale
+	case t.GetFreshness != nil:
+		freshness = t.GetFreshness(req, cachedResp)
+	default:
+		freshness = t.RFCFreshness(req, cachedResp)
+	}
+	t.emit(&Event{Type: EventFreshness, Request: req, Response: cachedResp, FromCache: true, Freshness: freshness})
+	return
+}
+
+// fetchRange forward the range request to upstream, the cached complete response is never deleted,
+// If-Range is set to the validator of the stale cached response, so the changed response is answered in full and stored
+func (t *Transport) fetchRange(req *http.Request, validator string) (resp *http.Response, err error) {
+	transport := t.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	if validator != "" && req.Header.Get("If-Range") == "" {
+		req = cloneRequest(req)
+		req.Header.Set("If-Range", validator)
+	}
+	setResult(req, EventMiss)
+	if resp, err = transport.RoundTrip(req); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		// the range is ignored or the response changed
+		full := cloneRequest(req)
+		full.Header.Del("Range")
+		full.Header.Del("If-Range")
+		if t.canStore(full, resp) {
+			t.store(full, resp)
+		}
+	}
+	return resp, nil
+}
+
+// cachedRange answer the range request from the fresh complete response in cache, return nil if not available,
+// validator is the If-Range of the stale complete response to fetch the range
+func (t *Transport) cachedRange(req *http.Request) (resp *http.Response, validator string) {
+	// the range applies to the identity body
+	full := cloneRequest(req)
+	full.Header.Del("Range")
+	full.Header.Del("If-Range")
+	full.Header.Del("Accept-Encoding")
+	cachedResp, err := t.getResponse(full)
+	if err != nil {
+		log.Warn().Err(err).Str("url", req.URL.String()).Msg("get response error")
+	}
+	if cachedResp == nil {
+		return
+	}
+	if t.Mode != ModeReplay {
+		freshness := Stale
+		if cachedResp.StatusCode == http.StatusOK && varyMatches(cachedResp, req) {
+			freshness = t.freshness(req, cachedResp)
+			validator = rangeValidator(cachedResp.Header)
+		}
+		switch freshness {
+		case Fresh:
+		case StaleWhileRevalidate:
+			t.revalidate(full, cachedResp)
 		default:
-			if err := t.Cache.SetResponse(resp); err != nil {
-				log.Warn().Err(err).Str("url", req.URL.String()).Msg("set response error")
+			_ = cachedResp.Body.Close()
+			return nil, validator
+		}
+	}
+	if t.MarkCachedResponses {
+		cachedResp.Header.Set(XFromCache, "1")
+	}
+	// the preconditions are evaluated before the range
+	if resp = conditionalResponse(req, cachedResp, false); resp != cachedResp {
+		return
+	}
+	resp, err = newRangeResponse(req, cachedResp)
+	if err != nil {
+		log.Warn().Err(err).Str("url", req.URL.String()).Msg("range response error")
+		return nil, ""
+	}
+	return
+}
+
+// rangeValidator return the strong ETag or Last-Modified for If-Range, empty if none
+func rangeValidator(h http.Header) string {
+	if etag := h.Get("Etag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return h.Get("Last-Modified")
+}
+
+// cacheable return true if the response of req can be cached
+func (t *Transport) cacheable(req *http.Request) bool {
+	if req.Header.Get("range") != "" {
+		return false
+	}
+	if req.Method == "GET" || req.Method == "HEAD" {
+		return true
+	}
+	return t.Cacheable != nil && t.Cacheable(req)
+}
+
+// invalidate the cached GET and HEAD responses of the request url, and of the same origin Location and
+// Content-Location, after the unsafe request succeeded, RFC 9111 4.4
+func (t *Transport) invalidate(req *http.Request, resp *http.Response) {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return
+	}
+	urls := []*url.URL{req.URL}
+	for _, h := range []string{"Location", "Content-Location"} {
+		v := resp.Header.Get(h)
+		if v == "" {
+			continue
+		}
+		u, err := req.URL.Parse(v)
+		if err != nil || u.Scheme != req.URL.Scheme || u.Host != req.URL.Host || u.String() == req.URL.String() {
+			continue
+		}
+		urls = append(urls, u)
+	}
+	for _, u := range urls {
+		for _, method := range []string{"GET", "HEAD"} {
+			r := req.Clone(req.Context())
+			r.Method = method
+			r.URL = u
+			r.Host = u.Host
+			r.Body = http.NoBody
+			r.ContentLength = 0
+			key := u.String()
+			if t.KeyFunc != nil {
+				key = t.KeyFunc(r)
 			}
+			t.deleteResponse(cachekey.WithKey(r, key), resp)
+		}
+	}
+}
+
+// withKey put the cache key of req in context, the body of cacheable request other than GET or HEAD is buffered
+func (t *Transport) withKey(req *http.Request, cacheable bool) (*http.Request, error) {
+	withBody := cacheable && req.Method != "GET" && req.Method != "HEAD"
+	if withBody {
+		req = req.Clone(req.Context())
+		if _, err := cachekey.ReadBody(req); err != nil {
+			return nil, errors.Wrap(err, "read request body")
+		}
+	}
+	switch {
+	case t.KeyFunc != nil:
+		req = cachekey.WithKey(req, t.KeyFunc(req))
+	case withBody:
+		req = cachekey.WithKey(req, req.URL.String()+cachekey.BodyKey(req, cachekey.BodyRaw))
+	}
+	return req, nil
+}
+
+// store the resp of req, response with body is stored when the body is read to EOF
+func (t *Transport) store(req *http.Request, resp *http.Response) {
+	for _, varyKey := range headerAllCommaSepValues(resp.Header, "vary") {
+		if varyKey == "*" {
+			// never matches a following request
+			return
+		}
+		varyKey = http.CanonicalHeaderKey(varyKey)
+		fakeHeader := "X-Varied-" + varyKey
+		reqValue := req.Header.Get(varyKey)
+		if reqValue != "" {
+			resp.Header.Set(fakeHeader, reqValue)
+		}
+	}
+	// the stored times are not returned
+	header := resp.Header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	setStoredTimes(header, req)
+	switch req.Method {
+	case "HEAD":
+		finishTrace(req)
+		resp := *resp
+		resp.Header = header
+		t.setResponse(req, &resp)
+	default:
+		// Delay caching until EOF is reached.
+		crc := &cachingReadCloser{
+			R: resp.Body,
+			OnEOF: func(r io.Reader) {
+				finishTrace(req)
+				resp := *resp
+				resp.Header = header
+				resp.Body = ioutil.NopCloser(r)
+				if resp.Request == nil {
+					resp.Request = req
+				}
+				t.setResponse(req, &resp)
+			},
+		}
+		crc.buf.Limit = t.SpoolSize
+		crc.buf.Dir = t.SpoolDir
+		resp.Body = crc
+	}
+}
+
+// setStoredTimes set the request time of req and the response time of now, see currentAge
+func setStoredTimes(h http.Header, req *http.Request) {
+	now := time.Now()
+	requestTime := now
+	if t := reqtrace.FromRequest(req); t != nil {
+		requestTime = t.Start
+	}
+	h.Set(XCacheRequestTime, requestTime.UTC().Format(time.RFC3339Nano))
+	h.Set(XCacheResponseTime, now.UTC().Format(time.RFC3339Nano))
+}
+
+// cachedAge is the current age of the cached response as per RFC 9111 4.2.3 by the stored times,
+// the time since Date if not stored
+func cachedAge(respHeaders http.Header) time.Duration {
+	date, dateErr := Date(respHeaders)
+	responseTime, err := time.Parse(time.RFC3339Nano, respHeaders.Get(XCacheResponseTime))
+	if err != nil {
+		if dateErr != nil {
+			return 0
 		}
+		return clock.since(date)
+	}
+	requestTime, err := time.Parse(time.RFC3339Nano, respHeaders.Get(XCacheRequestTime))
+	if err != nil || requestTime.After(responseTime) {
+		requestTime = responseTime
+	}
+	var apparentAge time.Duration
+	if dateErr == nil && responseTime.After(date) {
+		apparentAge = responseTime.Sub(date)
+	}
+	var ageValue time.Duration
+	if v, err := strconv.Atoi(respHeaders.Get("Age")); err == nil && v > 0 {
+		ageValue = time.Duration(v) * time.Second
+	}
+	age := ageValue + responseTime.Sub(requestTime)
+	if apparentAge > age {
+		age = apparentAge
+	}
+	return age + clock.since(responseTime)
+}
+
+// CurrentAge return the current age of the cached response by the stored times and the Age header,
+// ErrNoDateHeader if neither stored times nor Date exists
+func CurrentAge(respHeaders http.Header) (age time.Duration, err error) {
+	if respHeaders.Get(XCacheResponseTime) == "" {
+		if _, err = Date(respHeaders); err != nil {
+			return
+		}
+	}
+	return cachedAge(respHeaders), nil
+}
+
+func finishTrace(req *http.Request) {
+	if t := reqtrace.FromRequest(req); t != nil {
+		t.Finish()
+	}
+}
+
+// record always fetches req from upstream and stores the response, never deletes
+func (t *Transport) record(req *http.Request, cacheable bool) (resp *http.Response, err error) {
+	transport := t.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	if cacheable {
+		setResult(req, EventMiss)
 	} else {
-		if err := t.Cache.DeleteResponse(req); err != nil {
-			log.Warn().Err(err).Str("url", req.URL.String()).Msg("delete response error")
+		setResult(req, EventBypass)
+	}
+	resp, err = transport.RoundTrip(req)
+	if err != nil {
+		return
+	}
+	if cacheable {
+		t.store(req, resp)
+	}
+	return
+}
+
+// replay serves req from cache only
+func (t *Transport) replay(req *http.Request) (resp *http.Response, err error) {
+	if req.Method == "GET" && req.Header.Get("range") != "" {
+		if resp, _ = t.cachedRange(req); resp != nil {
+			setResult(req, EventHit)
+			return resp, nil
 		}
+		setResult(req, EventMiss)
+		return newReplayMissResponse(req, t.ReplayMissStatus), nil
 	}
-	return resp, nil
+	resp, err = t.getResponse(req)
+	if err != nil {
+		log.Warn().Err(err).Str("url", req.URL.String()).Msg("replay get response error")
+	}
+	if resp == nil {
+		setResult(req, EventMiss)
+		return newReplayMissResponse(req, t.ReplayMissStatus), nil
+	}
+	setResult(req, EventHit)
+	if t.MarkCachedResponses {
+		resp.Header.Set(XFromCache, "1")
+	}
+	return conditionalResponse(req, resp, false), nil
+}
+
+func newReplayMissResponse(req *http.Request, status int) *http.Response {
+	if status == 0 {
+		status = http.StatusGatewayTimeout
+	}
+	key := cacheKey(req)
+	body := "no cached response for " + key + "\n"
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode: status,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			XCacheMissKey:  {key},
+			"Content-Type": {"text/plain; charset=utf-8"},
+		},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// cacheKey return the key of the cached response for req
+func cacheKey(req *http.Request) string {
+	return req.Method + " " + cachekey.FromRequest(req)
+}
+
+type revalidateKey struct{}
+
+// revalidator return the Revalidator, create the default one if not set
+func (t *Transport) revalidator() *Revalidator {
+	t.revalidatorOnce.Do(func() {
+		if t.Revalidator == nil {
+			t.Revalidator = &Revalidator{}
+		}
+	})
+	return t.Revalidator
+}
+
+// revalidate refresh the cached response of req in background, deduplicated by the key and the varied headers
+func (t *Transport) revalidate(req *http.Request, cachedResp *http.Response) {
+	key := cacheKey(req)
+	for _, header := range headerAllCommaSepValues(cachedResp.Header, "vary") {
+		header = http.CanonicalHeaderKey(header)
+		if header != "" && header != "Accept-Encoding" {
+			key += "\n" + header + "=" + req.Header.Get(header)
+		}
+	}
+	t.revalidator().Submit(key, req.URL.String(), func(ctx context.Context) error {
+		return t.doRevalidate(req.Clone(context.WithValue(ctx, revalidateKey{}, true)))
+	})
+}
+
+func (t *Transport) doRevalidate(req *http.Request) (err error) {
+	if req.GetBody != nil {
+		// the body is consumed by the first round trip
+		if req.Body, err = req.GetBody(); err != nil {
+			log.Warn().Err(err).Str("url", req.URL.String()).Msg("revalidate get body error")
+			return
+		}
+	}
+	resp, err := t.RoundTrip(req)
+	if err != nil {
+		log.Warn().Err(err).Str("url", req.URL.String()).Msg("revalidate response error")
+		return
+	}
+	// drain body to trigger caching
+	_, err = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	return
 }
 
 // ErrNoDateHeader indicates that the HTTP headers contained no Date header.
@@ -251,11 +787,17 @@ func GetFreshness(req *http.Request, resp *http.Response) (freshness int) {
 //
 // Fresh indicates the response can be returned
 // Stale indicates that the response needs validating before it is returned
+// StaleWhileRevalidate indicates the stale response can be returned while it is revalidated in background
 // Transparent indicates the response should not be used to fulfil the request
 //
-// Because this is only a private cache, 'public' and 'private' in cache-control aren't
-// significant. Similarly, smax-age isn't used.
+// 'public' and 'private' in cache-control aren't significant for a private cache. Similarly, smax-age isn't used.
 func getFreshness(respHeaders, reqHeaders http.Header) (freshness int) {
+	return getFreshnessOf(respHeaders, reqHeaders, false)
+}
+
+// getFreshnessOf return the freshness as getFreshness, the shared cache honours s-maxage, must-revalidate,
+// proxy-revalidate, and the age is computed by the stored times, see currentAge
+func getFreshnessOf(respHeaders, reqHeaders http.Header, shared bool) (freshness int) {
 	respCacheControl := parseCacheControl(respHeaders)
 	reqCacheControl := parseCacheControl(reqHeaders)
 	if _, ok := reqCacheControl["no-cache"]; ok {
@@ -273,6 +815,11 @@ func getFreshness(respHeaders, reqHeaders http.Header) (freshness int) {
 		return Stale
 	}
 	currentAge := clock.since(date)
+	mustRevalidate := false
+	if shared {
+		currentAge = cachedAge(respHeaders)
+		mustRevalidate = sharedMustRevalidate(respCacheControl)
+	}
 
 	var lifetime time.Duration
 	var zeroDuration time.Duration
@@ -295,6 +842,13 @@ func getFreshness(respHeaders, reqHeaders http.Header) (freshness int) {
 			}
 		}
 	}
+	if sMaxAge, ok := respCacheControl["s-maxage"]; ok && shared {
+		// overrides max-age and Expires for a shared cache
+		lifetime, err = time.ParseDuration(sMaxAge + "s")
+		if err != nil {
+			lifetime = zeroDuration
+		}
+	}
 
 	if maxAge, ok := reqCacheControl["max-age"]; ok {
 		// the client is willing to accept a response whose age is no greater than the specified time in seconds
@@ -311,7 +865,7 @@ func getFreshness(respHeaders, reqHeaders http.Header) (freshness int) {
 		}
 	}
 
-	if maxstale, ok := reqCacheControl["max-stale"]; ok {
+	if maxstale, ok := reqCacheControl["max-stale"]; ok && !mustRevalidate {
 		// Indicates that the client is willing to accept a response that has exceeded its expiration time.
 		// If max-stale is assigned a value, then the client is willing to accept a response that has exceeded
 		// its expiration time by no more than the specified number of seconds.
@@ -333,6 +887,16 @@ func getFreshness(respHeaders, reqHeaders http.Header) (freshness int) {
 		return Fresh
 	}
 
+	// stale-while-revalidate extension: https://tools.ietf.org/html/rfc5861,
+	// not applied when the client asks for the freshness explicitly
+	_, reqMaxAge := reqCacheControl["max-age"]
+	_, reqMinFresh := reqCacheControl["min-fresh"]
+	if swr, ok := respCacheControl["stale-while-revalidate"]; ok && !reqMaxAge && !reqMinFresh && !mustRevalidate {
+		if d, err := time.ParseDuration(swr + "s"); err == nil && lifetime+d > currentAge {
+			return StaleWhileRevalidate
+		}
+	}
+
 	return Stale
 }
 
@@ -490,7 +1054,9 @@ type cachingReadCloser struct {
 	// OnEOF is called with a copy of the content of R when EOF is reached.
 	OnEOF func(io.Reader)
 
-	buf bytes.Buffer // buf stores a copy of the content of R.
+	buf  spool.Buffer // buf stores a copy of the content of R.
+	err  error        // err is the error when copy the content
+	done bool         // done is true after OnEOF is called
 }
 
 // Read reads the next len(p) bytes from R or until R is drained. The
@@ -499,13 +1065,25 @@ type cachingReadCloser struct {
 // has been read so far.
 func (r *cachingReadCloser) Read(p []byte) (n int, err error) {
 	n, err = r.R.Read(p)
-	r.buf.Write(p[:n])
-	if err == io.EOF {
-		r.OnEOF(bytes.NewReader(r.buf.Bytes()))
+	if r.done {
+		return n, err
+	}
+	if r.err == nil {
+		_, r.err = r.buf.Write(p[:n])
+		if r.err != nil {
+			log.Warn().Err(r.err).Msg("spool response body error")
+			_ = r.buf.Close()
+		}
+	}
+	if err == io.EOF && r.err == nil {
+		r.done = true
+		r.OnEOF(r.buf.Reader())
+		_ = r.buf.Close()
 	}
 	return n, err
 }
 
 func (r *cachingReadCloser) Close() error {
+	_ = r.buf.Close()
 	return r.R.Close()
 }
@@ -1154,6 +1154,36 @@ func TestMaxStaleValue(t *testing.T) {
 	}
 }
 
+func TestStaleWhileRevalidateFreshness(t *testing.T) {
+	resetTest()
+	now := time.Now()
+	respHeaders := http.Header{}
+	respHeaders.Set("date", now.Format(time.RFC1123))
+	respHeaders.Set("cache-control", "max-age=10, stale-while-revalidate=20")
+
+	reqHeaders := http.Header{}
+	clock = &fakeClock{elapsed: 5 * time.Second}
+	if getFreshness(respHeaders, reqHeaders) != Fresh {
+		t.Fatal("freshness isn't fresh")
+	}
+
+	clock = &fakeClock{elapsed: 15 * time.Second}
+	if getFreshness(respHeaders, reqHeaders) != StaleWhileRevalidate {
+		t.Fatal("freshness isn't stale-while-revalidate")
+	}
+
+	reqHeaders.Set("cache-control", "max-age=0")
+	if getFreshness(respHeaders, reqHeaders) != Stale {
+		t.Fatal("freshness isn't stale")
+	}
+
+	reqHeaders = http.Header{}
+	clock = &fakeClock{elapsed: 40 * time.Second}
+	if getFreshness(respHeaders, reqHeaders) != Stale {
+		t.Fatal("freshness isn't stale")
+	}
+}
+
 func containsHeader(headers []string, header string) bool {
 	for _, v := range headers {
 		if http.CanonicalHeaderKey(v) == http.CanonicalHeaderKey(header) {
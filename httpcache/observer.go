@@ -0,0 +1,173 @@
+package httpcache
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// types of Event
+const (
+	// EventHit is the response served from cache without contacting upstream
+	EventHit = "hit"
+	// EventMiss is the response fetched from upstream, or the replay miss response
+	EventMiss = "miss"
+	// EventRevalidated is the stale response validated by upstream with 304
+	EventRevalidated = "revalidated"
+	// EventStaleOnError is the stale response served because upstream failed, see stale-if-error
+	EventStaleOnError = "stale-on-error"
+	// EventBypass is the request not cacheable, passed to upstream
+	EventBypass = "bypass"
+	// EventServed is the response body closed by the caller, Bytes is the size read
+	EventServed = "served"
+
+	// EventLookupHit is the cached response found, before checking the freshness
+	EventLookupHit = "lookup-hit"
+	// EventLookupMiss is no cached response found, Err is set if the lookup failed
+	EventLookupMiss = "lookup-miss"
+	// EventFreshness is the freshness of the cached response decided, see Event.Freshness
+	EventFreshness = "freshness"
+	// EventValidate is the conditional request sent to validate the stale response, Request is the conditional request
+	EventValidate = "validate"
+	// EventNotModified is the 304 merged into the cached response
+	EventNotModified = "not-modified"
+	// EventStore is the response stored, a response with body is stored after the body is read
+	EventStore = "store"
+	// EventStoreError is the response failed to store
+	EventStoreError = "store-error"
+	// EventDelete is the cached response deleted, Err is set if failed
+	EventDelete = "delete"
+)
+
+// Event is reported to Observer
+type Event struct {
+	Type     string
+	Request  *http.Request
+	Response *http.Response
+	// Key of the cached response, see cacheKey
+	Key string
+	// FromCache is true if the response is served from cache
+	FromCache bool
+	// Bytes of the body read by the caller, only for EventServed
+	Bytes int64
+	// Err of the round trip or the cache operation
+	Err error
+	// Result is the type of the round trip result, for EventServed
+	Result string
+	// Freshness is Fresh, Stale, Transparent or StaleWhileRevalidate, for EventFreshness
+	Freshness int
+}
+
+// Observer is notified of the cache events of Transport, called concurrently
+type Observer interface {
+	Observe(e *Event)
+}
+
+// ObserverFunc adapts a func to Observer
+type ObserverFunc func(e *Event)
+
+func (f ObserverFunc) Observe(e *Event) {
+	f(e)
+}
+
+type resultKey struct{}
+
+// roundTripResult is the result of the round trip recorded for the observer
+type roundTripResult struct {
+	typ string
+	key string
+}
+
+// setResult record the result of the round trip of req for the observer
+func setResult(req *http.Request, typ string) {
+	if v, ok := req.Context().Value(resultKey{}).(*roundTripResult); ok {
+		v.typ = typ
+		v.key = cacheKey(req)
+	}
+}
+
+// observe the round trip of req, report the result and the served bytes
+func (t *Transport) observe(req *http.Request, roundTrip func(req *http.Request) (*http.Response, error)) (resp *http.Response, err error) {
+	result := &roundTripResult{}
+	resp, err = roundTrip(req.WithContext(context.WithValue(req.Context(), resultKey{}, result)))
+	if result.typ == "" {
+		return
+	}
+	fromCache := result.typ != EventMiss && result.typ != EventBypass
+	t.Observer.Observe(&Event{Type: result.typ, Request: req, Response: resp, Key: result.key, FromCache: fromCache, Err: err})
+	// background revalidation drains the body
+	if err != nil || resp.Body == nil || req.Context().Value(revalidateKey{}) != nil {
+		return
+	}
+	resp.Body = &observedBody{ReadCloser: resp.Body, done: func(n int64) {
+		t.Observer.Observe(&Event{Type: EventServed, Request: req, Response: resp, Key: result.key, FromCache: fromCache, Bytes: n, Result: result.typ})
+	}}
+	return
+}
+
+// emit e to the observer if any, the key is set from the request
+func (t *Transport) emit(e *Event) {
+	if t.Observer == nil {
+		return
+	}
+	if e.Key == "" {
+		e.Key = cacheKey(e.Request)
+	}
+	t.Observer.Observe(e)
+}
+
+// getResponse lookup the cached response of req
+func (t *Transport) getResponse(req *http.Request) (resp *http.Response, err error) {
+	resp, err = t.Cache.GetResponse(req)
+	if resp != nil && err == nil {
+		t.emit(&Event{Type: EventLookupHit, Request: req, Response: resp, FromCache: true})
+	} else {
+		t.emit(&Event{Type: EventLookupMiss, Request: req, Err: err})
+	}
+	return
+}
+
+// setResponse store resp of req, the error is logged
+func (t *Transport) setResponse(req *http.Request, resp *http.Response) {
+	if err := t.Cache.SetResponse(resp); err != nil {
+		log.Warn().Err(err).Str("url", req.URL.String()).Msg("set response error")
+		t.emit(&Event{Type: EventStoreError, Request: req, Response: resp, Err: err})
+		return
+	}
+	t.emit(&Event{Type: EventStore, Request: req, Response: resp})
+}
+
+// deleteResponse delete the cached response of req, the error is logged
+func (t *Transport) deleteResponse(req *http.Request, resp *http.Response) {
+	err := t.Cache.DeleteResponse(req)
+	if err != nil {
+		log.Warn().Err(err).Str("url", req.URL.String()).Msg("delete response error")
+	}
+	t.emit(&Event{Type: EventDelete, Request: req, Response: resp, Err: err})
+}
+
+// observedBody counts the bytes read, report once on EOF or close
+type observedBody struct {
+	io.ReadCloser
+	n    int64
+	done func(n int64)
+	once sync.Once
+}
+
+func (b *observedBody) Read(p []byte) (n int, err error) {
+	n, err = b.ReadCloser.Read(p)
+	b.n += int64(n)
+	if err == io.EOF {
+		b.once.Do(func() { b.done(b.n) })
+	}
+	return
+}
+
+func (b *observedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() { b.done(b.n) })
+	return err
+}
@@ -0,0 +1,254 @@
+package httpcache
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// httpRange specifies the byte range to be sent to the client
+type httpRange struct {
+	start, length int64
+}
+
+func (r httpRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+var errNoOverlap = errors.New("invalid range: failed to overlap")
+
+// parseRange parses a Range header string as per RFC 7233,
+// errNoOverlap is returned if none of the ranges overlap
+func parseRange(s string, size int64) ([]httpRange, error) {
+	const b = "bytes="
+	if !strings.HasPrefix(s, b) {
+		return nil, errors.New("invalid range")
+	}
+	var ranges []httpRange
+	noOverlap := false
+	for _, ra := range strings.Split(s[len(b):], ",") {
+		ra = textproto.TrimString(ra)
+		if ra == "" {
+			continue
+		}
+		i := strings.Index(ra, "-")
+		if i < 0 {
+			return nil, errors.New("invalid range")
+		}
+		start, end := textproto.TrimString(ra[:i]), textproto.TrimString(ra[i+1:])
+		var r httpRange
+		if start == "" {
+			// suffix range, the last n bytes
+			if end == "" || end[0] == '-' {
+				return nil, errors.New("invalid range")
+			}
+			i, err := strconv.ParseInt(end, 10, 64)
+			if i < 0 || err != nil {
+				return nil, errors.New("invalid range")
+			}
+			if i > size {
+				i = size
+			}
+			r.start = size - i
+			r.length = size - r.start
+		} else {
+			i, err := strconv.ParseInt(start, 10, 64)
+			if err != nil || i < 0 {
+				return nil, errors.New("invalid range")
+			}
+			if i >= size {
+				noOverlap = true
+				continue
+			}
+			r.start = i
+			if end == "" {
+				r.length = size - r.start
+			} else {
+				i, err := strconv.ParseInt(end, 10, 64)
+				if err != nil || r.start > i {
+					return nil, errors.New("invalid range")
+				}
+				if i >= size {
+					i = size - 1
+				}
+				r.length = i - r.start + 1
+			}
+		}
+		ranges = append(ranges, r)
+	}
+	if noOverlap && len(ranges) == 0 {
+		return nil, errNoOverlap
+	}
+	return ranges, nil
+}
+
+// ifRangeMatches return true if the If-Range validator matches the cached response,
+// etag uses the strong comparison
+func ifRangeMatches(ifRange string, h http.Header) bool {
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		etag := h.Get("Etag")
+		return etag != "" && !strings.HasPrefix(etag, "W/") && etag == ifRange
+	}
+	t, err := http.ParseTime(ifRange)
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(h.Get("Last-Modified"))
+	return err == nil && t.Equal(lastModified)
+}
+
+type readerAtCloser interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// rangeSource return the random access body of resp, the seekable body like file or db chunks is used directly,
+// others are read to memory
+func rangeSource(resp *http.Response) (body readerAtCloser, size int64, err error) {
+	if rs, ok := resp.Body.(interface {
+		readerAtCloser
+		io.Seeker
+	}); ok {
+		if size, err = rs.Seek(0, io.SeekEnd); err != nil {
+			_ = rs.Close()
+			return
+		}
+		return rs, size, nil
+	}
+	data, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return
+	}
+	return nopReaderAtCloser{bytes.NewReader(data)}, int64(len(data)), nil
+}
+
+type nopReaderAtCloser struct {
+	*bytes.Reader
+}
+
+func (nopReaderAtCloser) Close() error {
+	return nil
+}
+
+// readCloser is the section of body and closes the body
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// newRangeResponse answer the range request from the complete cached response,
+// return the cached response as is if it's not 200 or If-Range does not match
+func newRangeResponse(req *http.Request, cached *http.Response) (resp *http.Response, err error) {
+	if cached.StatusCode != http.StatusOK {
+		return cached, nil
+	}
+	if v := req.Header.Get("If-Range"); v != "" && !ifRangeMatches(v, cached.Header) {
+		return cached, nil
+	}
+	body, size, err := rangeSource(cached)
+	if err != nil {
+		return
+	}
+
+	resp = &http.Response{
+		Proto:      cached.Proto,
+		ProtoMajor: cached.ProtoMajor,
+		ProtoMinor: cached.ProtoMinor,
+		Header:     cached.Header.Clone(),
+		Request:    req,
+	}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Set("Accept-Ranges", "bytes")
+	setStatus := func(status int) {
+		resp.StatusCode = status
+		resp.Status = fmt.Sprintf("%d %s", status, http.StatusText(status))
+	}
+
+	ranges, err := parseRange(req.Header.Get("Range"), size)
+	switch {
+	case err == errNoOverlap:
+		_ = body.Close()
+		setStatus(http.StatusRequestedRangeNotSatisfiable)
+		resp.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		resp.Header.Set("Content-Length", "0")
+		resp.Header.Del("Content-Type")
+		resp.Body = http.NoBody
+		return resp, nil
+	case err != nil || len(ranges) == 0:
+		// the invalid range is ignored
+		setStatus(http.StatusOK)
+		resp.ContentLength = size
+		resp.Body = readCloser{io.NewSectionReader(body, 0, size), body}
+	case len(ranges) == 1:
+		r := ranges[0]
+		setStatus(http.StatusPartialContent)
+		resp.ContentLength = r.length
+		resp.Header.Set("Content-Range", r.contentRange(size))
+		resp.Body = readCloser{io.NewSectionReader(body, r.start, r.length), body}
+	default:
+		setStatus(http.StatusPartialContent)
+		resp.ContentLength, resp.Body = multipartRanges(resp.Header, ranges, body, size)
+	}
+	resp.Header.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	return resp, nil
+}
+
+// multipartRanges write ranges as multipart/byteranges and set the content type of h
+func multipartRanges(h http.Header, ranges []httpRange, body readerAtCloser, size int64) (int64, io.ReadCloser) {
+	contentType := h.Get("Content-Type")
+	partHeader := func(r httpRange) textproto.MIMEHeader {
+		ph := textproto.MIMEHeader{"Content-Range": {r.contentRange(size)}}
+		if contentType != "" {
+			ph.Set("Content-Type", contentType)
+		}
+		return ph
+	}
+
+	// compute the length by writing the part headers only
+	counter := &countingWriter{}
+	mw := multipart.NewWriter(counter)
+	var length int64
+	for _, r := range ranges {
+		_, _ = mw.CreatePart(partHeader(r))
+		length += r.length
+	}
+	_ = mw.Close()
+	length += counter.n
+
+	pr, pw := io.Pipe()
+	// boundaries are of the same length
+	mw = multipart.NewWriter(pw)
+	h.Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	go func() {
+		defer body.Close()
+		for _, r := range ranges {
+			part, err := mw.CreatePart(partHeader(r))
+			if err == nil {
+				_, err = io.Copy(part, io.NewSectionReader(body, r.start, r.length))
+			}
+			if err != nil {
+				_ = pw.CloseWithError(err)
+				return
+			}
+		}
+		_ = pw.CloseWithError(mw.Close())
+	}()
+	return length, pr
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,114 @@
+// Package reqtrace traces the upstream request and passes the trace from the transport to the cache by request context
+package reqtrace
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// XClientAddr is the header to pass the client address to the transport, removed before sending to upstream
+const XClientAddr = "X-Client-Addr"
+
+// Timings of the upstream request, zero if not happened, e.g. connection reused
+type Timings struct {
+	DNS     time.Duration `json:"dns,omitempty"`
+	Connect time.Duration `json:"connect,omitempty"`
+	TLS     time.Duration `json:"tls,omitempty"`
+	// TTFB is the time to the first response byte since the request started
+	TTFB time.Duration `json:"ttfb,omitempty"`
+	// Total is the time until the response body is read to EOF
+	Total time.Duration `json:"total,omitempty"`
+}
+
+// Trace of the upstream request
+type Trace struct {
+	ClientAddr string
+	Start      time.Time
+
+	mu       sync.Mutex
+	timings  Timings
+	dns      time.Time
+	connect  time.Time
+	tls      time.Time
+	finished bool
+}
+
+type contextKey struct{}
+
+// WithTrace return a shallow copy of req with Trace in context, XClientAddr is moved to the trace
+func WithTrace(req *http.Request) (*http.Request, *Trace) {
+	t := &Trace{Start: time.Now(), ClientAddr: req.Header.Get(XClientAddr)}
+	ctx := context.WithValue(req.Context(), contextKey{}, t)
+	ctx = httptrace.WithClientTrace(ctx, t.clientTrace())
+	if t.ClientAddr != "" {
+		req = req.Clone(ctx)
+		req.Header.Del(XClientAddr)
+		return req, t
+	}
+	return req.WithContext(ctx), t
+}
+
+// FromRequest return the Trace in context, nil if not traced
+func FromRequest(req *http.Request) *Trace {
+	t, _ := req.Context().Value(contextKey{}).(*Trace)
+	return t
+}
+
+// Finish set the total time, only the first call takes effect
+func (t *Trace) Finish() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.finished {
+		t.finished = true
+		t.timings.Total = time.Since(t.Start)
+	}
+}
+
+// Timings return a copy of the timings
+func (t *Trace) Timings() Timings {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.timings
+}
+
+func (t *Trace) clientTrace() *httptrace.ClientTrace {
+	since := func(start *time.Time, d *time.Duration) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if !start.IsZero() {
+			*d = time.Since(*start)
+		}
+	}
+	now := func(v *time.Time) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		*v = time.Now()
+	}
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			now(&t.dns)
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			since(&t.dns, &t.timings.DNS)
+		},
+		ConnectStart: func(string, string) {
+			now(&t.connect)
+		},
+		ConnectDone: func(string, string, error) {
+			since(&t.connect, &t.timings.Connect)
+		},
+		TLSHandshakeStart: func() {
+			now(&t.tls)
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			since(&t.tls, &t.timings.TLS)
+		},
+		GotFirstResponseByte: func() {
+			since(&t.Start, &t.timings.TTFB)
+		},
+	}
+}
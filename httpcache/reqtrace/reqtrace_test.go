@@ -0,0 +1,44 @@
+package reqtrace
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wenerme/wego/testx"
+)
+
+func TestWithTrace(t *testing.T) {
+	var upstream http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream = r.Header.Clone()
+		_, _ = io.WriteString(w, "Hello proxc")
+	}))
+	defer server.Close()
+
+	req := testx.Must(http.NewRequest("GET", server.URL, nil))
+	assert.Nil(t, FromRequest(req))
+	req.Header.Set(XClientAddr, "10.0.0.1:1234")
+	traced, tr := WithTrace(req)
+	assert.Same(t, tr, FromRequest(traced))
+	assert.Equal(t, "10.0.0.1:1234", tr.ClientAddr)
+	// the header of the original request is kept
+	assert.Equal(t, "10.0.0.1:1234", req.Header.Get(XClientAddr))
+	assert.Empty(t, traced.Header.Get(XClientAddr))
+
+	resp := testx.Must(http.DefaultTransport.RoundTrip(traced))
+	_, _ = io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	assert.Empty(t, upstream.Get(XClientAddr))
+	tr.Finish()
+	timings := tr.Timings()
+	assert.Greater(t, int64(timings.Connect), int64(0))
+	assert.Greater(t, int64(timings.TTFB), int64(0))
+	assert.GreaterOrEqual(t, int64(timings.Total), int64(timings.TTFB))
+
+	// only the first finish takes effect
+	tr.Finish()
+	assert.Equal(t, timings, tr.Timings())
+}
@@ -0,0 +1,147 @@
+package httpcache
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultRevalidateConcurrency is the default max number of background revalidations in flight
+const DefaultRevalidateConcurrency = 4
+
+// Revalidator runs background revalidations, the same key is revalidated only once at a time,
+// pending revalidations wait for a free slot
+type Revalidator struct {
+	// Concurrency is the max number of running revalidations, default to DefaultRevalidateConcurrency
+	Concurrency int
+	// OnDone is called after a revalidation finished, canceled or failed, concurrently from the revalidation goroutines
+	OnDone func(r *Revalidation)
+
+	mu       sync.Mutex
+	once     sync.Once
+	sem      chan struct{}
+	inflight map[string]*Revalidation
+	wg       sync.WaitGroup
+}
+
+// Revalidation is a background revalidation of a cached response
+type Revalidation struct {
+	Key       string    `json:"key"`
+	URL       string    `json:"url"`
+	CreatedAt time.Time `json:"created_at"`
+	// StartedAt is zero while waiting for a free slot
+	StartedAt time.Time `json:"started_at,omitempty"`
+	// Err of the revalidation, only set after Done
+	Err error `json:"-"`
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Cancel the revalidation, the cache is not updated
+func (r *Revalidation) Cancel() {
+	r.cancel()
+}
+
+// Done is closed when the revalidation finished
+func (r *Revalidation) Done() <-chan struct{} {
+	return r.done
+}
+
+func NewRevalidator(concurrency int) *Revalidator {
+	return &Revalidator{Concurrency: concurrency}
+}
+
+func (v *Revalidator) init() {
+	v.once.Do(func() {
+		n := v.Concurrency
+		if n <= 0 {
+			n = DefaultRevalidateConcurrency
+		}
+		v.sem = make(chan struct{}, n)
+		v.inflight = map[string]*Revalidation{}
+	})
+}
+
+// Submit run fn in background unless the key is already in flight, return the in flight revalidation and
+// false if deduplicated
+func (v *Revalidator) Submit(key string, url string, fn func(ctx context.Context) error) (r *Revalidation, ok bool) {
+	v.init()
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if r = v.inflight[key]; r != nil {
+		return r, false
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r = &Revalidation{Key: key, URL: url, CreatedAt: time.Now(), cancel: cancel, done: make(chan struct{})}
+	v.inflight[key] = r
+	v.wg.Add(1)
+	go v.run(ctx, r, fn)
+	return r, true
+}
+
+func (v *Revalidator) run(ctx context.Context, r *Revalidation, fn func(ctx context.Context) error) {
+	defer v.wg.Done()
+	select {
+	case v.sem <- struct{}{}:
+		v.mu.Lock()
+		r.StartedAt = time.Now()
+		v.mu.Unlock()
+		r.Err = fn(ctx)
+		<-v.sem
+	case <-ctx.Done():
+		r.Err = ctx.Err()
+	}
+	r.cancel()
+
+	v.mu.Lock()
+	delete(v.inflight, r.Key)
+	v.mu.Unlock()
+	close(r.done)
+	if v.OnDone != nil {
+		v.OnDone(r)
+	}
+}
+
+// List the in flight revalidations ordered by creation
+func (v *Revalidator) List() (out []Revalidation) {
+	v.init()
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, r := range v.inflight {
+		out = append(out, Revalidation{Key: r.Key, URL: r.URL, CreatedAt: r.CreatedAt, StartedAt: r.StartedAt})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].CreatedAt.Before(out[j].CreatedAt)
+	})
+	return
+}
+
+// Cancel the in flight revalidation of key, return false if not found
+func (v *Revalidator) Cancel(key string) bool {
+	v.init()
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	r := v.inflight[key]
+	if r != nil {
+		r.cancel()
+	}
+	return r != nil
+}
+
+// CancelAll in flight revalidations, return the number canceled
+func (v *Revalidator) CancelAll() int {
+	v.init()
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, r := range v.inflight {
+		r.cancel()
+	}
+	return len(v.inflight)
+}
+
+// Wait for all in flight revalidations
+func (v *Revalidator) Wait() {
+	v.wg.Wait()
+}
@@ -0,0 +1,116 @@
+// Package spool provides a buffer hold data in memory until exceed the limit, then spill to a temp file.
+package spool
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// DefaultLimit is the default max size hold in memory
+const DefaultLimit = 1 << 20
+
+// Buffer is an append only buffer, data exceed Limit will spill to a temp file in Dir.
+// Caller must call Close to remove the temp file.
+type Buffer struct {
+	// Limit is the max size hold in memory, default to DefaultLimit
+	Limit int64
+	// Dir for temp file, default to os.TempDir
+	Dir string
+
+	buf  bytes.Buffer
+	file *os.File
+	size int64
+}
+
+func (b *Buffer) Write(p []byte) (n int, err error) {
+	if b.file == nil {
+		limit := b.Limit
+		if limit <= 0 {
+			limit = DefaultLimit
+		}
+		if b.size+int64(len(p)) <= limit {
+			n, _ = b.buf.Write(p)
+			b.size += int64(n)
+			return
+		}
+		if err = b.spill(); err != nil {
+			return
+		}
+	}
+	n, err = b.file.Write(p)
+	b.size += int64(n)
+	return
+}
+
+func (b *Buffer) spill() (err error) {
+	b.file, err = os.CreateTemp(b.Dir, "spool-*")
+	if err != nil {
+		return
+	}
+	_, err = b.file.Write(b.buf.Bytes())
+	b.buf = bytes.Buffer{}
+	return
+}
+
+// Size return the total size written
+func (b *Buffer) Size() int64 {
+	return b.size
+}
+
+// InMemory return true if no data spilled to file
+func (b *Buffer) InMemory() bool {
+	return b.file == nil
+}
+
+// Bytes return the in memory data, nil if spilled to file
+func (b *Buffer) Bytes() []byte {
+	if b.file != nil {
+		return nil
+	}
+	return b.buf.Bytes()
+}
+
+// Reader return a new reader from the start of the buffer,
+// the reader is valid until Close.
+func (b *Buffer) Reader() io.ReadSeeker {
+	if b.file != nil {
+		return io.NewSectionReader(b.file, 0, b.size)
+	}
+	return bytes.NewReader(b.buf.Bytes())
+}
+
+// ReadAt read the data written at off, must not be called concurrently with Write
+func (b *Buffer) ReadAt(p []byte, off int64) (n int, err error) {
+	if off >= b.size {
+		return 0, io.EOF
+	}
+	if remain := b.size - off; int64(len(p)) > remain {
+		p = p[:remain]
+		err = io.EOF
+	}
+	if b.file != nil {
+		var rerr error
+		if n, rerr = b.file.ReadAt(p, off); rerr != nil {
+			err = rerr
+		}
+		return
+	}
+	n = copy(p, b.buf.Bytes()[off:])
+	return
+}
+
+// Close release the buffer and remove the temp file
+func (b *Buffer) Close() error {
+	b.buf = bytes.Buffer{}
+	if b.file == nil {
+		return nil
+	}
+	f := b.file
+	b.file = nil
+	err := f.Close()
+	if rmErr := os.Remove(f.Name()); err == nil {
+		err = rmErr
+	}
+	return err
+}
@@ -0,0 +1,83 @@
+package spool
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wenerme/wego/testx"
+)
+
+func TestBufferLimit(t *testing.T) {
+	dir := t.TempDir()
+	b := &Buffer{Limit: 4, Dir: dir}
+	defer b.Close()
+
+	// exactly the limit is held in memory
+	testx.Must(b.Write([]byte("ab")))
+	testx.Must(b.Write([]byte("cd")))
+	assert.True(t, b.InMemory())
+	assert.Equal(t, "abcd", string(b.Bytes()))
+	assert.Empty(t, testx.Must(os.ReadDir(dir)))
+
+	// one more byte spills all data to the temp file
+	testx.Must(b.Write([]byte("e")))
+	assert.False(t, b.InMemory())
+	assert.Nil(t, b.Bytes())
+	assert.Equal(t, int64(5), b.Size())
+	assert.Len(t, testx.Must(os.ReadDir(dir)), 1)
+
+	testx.Must(b.Write([]byte("fg")))
+	assert.Equal(t, "abcdefg", string(testx.Must(io.ReadAll(b.Reader()))))
+	p := make([]byte, 4)
+	n, err := b.ReadAt(p, 5)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, "fg", string(p[:n]))
+}
+
+func TestBufferDefaultLimit(t *testing.T) {
+	b := &Buffer{Dir: t.TempDir()}
+	defer b.Close()
+	testx.Must(b.Write(make([]byte, DefaultLimit)))
+	assert.True(t, b.InMemory())
+	testx.Must(b.Write([]byte{0}))
+	assert.False(t, b.InMemory())
+}
+
+func TestBufferReadAt(t *testing.T) {
+	b := &Buffer{Limit: 10}
+	defer b.Close()
+	testx.Must(b.Write([]byte("hello")))
+	p := make([]byte, 3)
+	n, err := b.ReadAt(p, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "ell", string(p[:n]))
+	n, err = b.ReadAt(p, 3)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, "lo", string(p[:n]))
+	_, err = b.ReadAt(p, 5)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestBufferClose(t *testing.T) {
+	dir := t.TempDir()
+	b := &Buffer{Limit: 1, Dir: dir}
+	testx.Must(b.Write([]byte("spilled")))
+	files := testx.Must(filepath.Glob(filepath.Join(dir, "spool-*")))
+	assert.Len(t, files, 1)
+
+	testx.NoErr(b.Close())
+	_, err := os.Stat(files[0])
+	assert.True(t, os.IsNotExist(err))
+	assert.Empty(t, testx.Must(os.ReadDir(dir)))
+	// close again is a no-op
+	testx.NoErr(b.Close())
+
+	// in memory buffer has no file to remove
+	b = &Buffer{Limit: 10, Dir: dir}
+	testx.Must(b.Write([]byte("memory")))
+	testx.NoErr(b.Close())
+	assert.Empty(t, testx.Must(os.ReadDir(dir)))
+}
@@ -0,0 +1,603 @@
+package proxc
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/wenerme/proxc/httpcache"
+	"github.com/wenerme/proxc/httpcache/cachekey"
+	"github.com/wenerme/proxc/httpcache/dbcache"
+	"github.com/wenerme/proxc/httpcache/dbcache/models"
+	"github.com/wenerme/proxc/httpcache/dbcache/sqlitecache"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+// API serves the cache management JSON API
+//
+//	GET    /api/hosts
+//	GET    /api/hosts/{host}/stats
+//	GET    /api/hosts/{host}/responses?prefix=&offset=&limit=
+//	DELETE /api/hosts/{host}
+//	GET    /api/response?url=&method=
+//	GET    /api/response/body?url=&method=
+//	GET    /api/response/request/body?url=&method=
+//	DELETE /api/response?url=&method=
+//	DELETE /api/responses?prefix=&url=
+//	GET    /api/response/versions?url=&method=&vary=
+//	GET    /api/response/diff?url=&method=&vary=&from=&to=
+//	POST   /api/response/pin?url=&method=&version=
+//	DELETE /api/response/pin?url=&method=&vary=
+//	GET    /api/revalidations
+//	DELETE /api/revalidations?key=
+//	GET    /metrics
+//
+// The url is resolved to the cache key by KeyFunc, vary selects the variant, required if there are multiple.
+// The prefix of responses is the url prefix, or the path prefix of the url host if the url is given.
+// Requests must carry "Authorization: Bearer <Token>" if Token is set.
+type API struct {
+	Set   *sqlitecache.Set
+	Cache *dbcache.Cache
+	// KeyFunc of the transport, resolves the url to the cache key, default to the url
+	KeyFunc cachekey.Func
+	// Revalidator of the transport, optional
+	Revalidator *httpcache.Revalidator
+	// Metrics serves the prometheus metrics, optional
+	Metrics http.Handler
+	// Token is the bearer token required by all requests, optional
+	Token string
+}
+
+var (
+	errNotFound     = errors.New("not found")
+	errUnauthorized = errors.New("unauthorized")
+)
+
+// badRequestError is the validation error of the request
+type badRequestError struct {
+	error
+}
+
+// badRequest wrap err as badRequestError, nil if err is nil
+func badRequest(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &badRequestError{err}
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// HostStats is the stats of a host db
+type HostStats struct {
+	Host string `json:"host"`
+	*dbcache.Stats
+	Ratio float64 `json:"ratio"`
+}
+
+// ResponseInfo is the cached response without body
+type ResponseInfo struct {
+	ID              uint           `json:"id"`
+	Method          string         `json:"method"`
+	URL             string         `json:"url"`
+	VaryKey         string         `json:"vary_key,omitempty"`
+	StatusCode      int            `json:"status_code"`
+	Header          datatypes.JSON `json:"header,omitempty"`
+	ContentType     string         `json:"content_type"`
+	ContentEncoding string         `json:"content_encoding"`
+	ContentHash     string         `json:"content_hash,omitempty"`
+	FileName        string         `json:"file_name,omitempty"`
+	RawSize         int64          `json:"raw_size"`
+	BodySize        int64          `json:"body_size"`
+	Pinned          bool           `json:"pinned,omitempty"`
+	Request         *RequestInfo   `json:"request,omitempty"`
+	CreatedAt       time.Time      `json:"created_at"`
+	UpdatedAt       time.Time      `json:"updated_at"`
+}
+
+// RequestInfo is the originating request of the response without body
+type RequestInfo struct {
+	Header     datatypes.JSON `json:"header,omitempty"`
+	BodySize   int64          `json:"body_size,omitempty"`
+	BodyHash   string         `json:"body_hash,omitempty"`
+	ClientAddr string         `json:"client_addr,omitempty"`
+	Timings    datatypes.JSON `json:"timings,omitempty"`
+}
+
+// VersionInfo is the response version without body
+type VersionInfo struct {
+	ID          uint      `json:"id"`
+	StatusCode  int       `json:"status_code"`
+	ContentType string    `json:"content_type"`
+	BodyHash    string    `json:"body_hash"`
+	RawSize     int64     `json:"raw_size"`
+	CreatedAt   time.Time `json:"created_at"` // first seen
+	UpdatedAt   time.Time `json:"updated_at"` // last seen
+}
+
+func NewVersionInfo(v *models.HTTPResponseVersion) *VersionInfo {
+	return &VersionInfo{
+		ID:          v.ID,
+		StatusCode:  v.StatusCode,
+		ContentType: v.ContentType,
+		BodyHash:    v.BodyHash,
+		RawSize:     v.RawSize,
+		CreatedAt:   v.CreatedAt,
+		UpdatedAt:   v.UpdatedAt,
+	}
+}
+
+func NewResponseInfo(hr *models.HTTPResponse) *ResponseInfo {
+	return &ResponseInfo{
+		ID:              hr.ID,
+		Method:          hr.Method,
+		URL:             hr.URL,
+		VaryKey:         hr.VaryKey,
+		StatusCode:      hr.StatusCode,
+		Header:          hr.Header,
+		ContentType:     hr.ContentType,
+		ContentEncoding: hr.ContentEncoding,
+		ContentHash:     hr.ContentHash,
+		FileName:        hr.FileName,
+		RawSize:         hr.RawSize,
+		BodySize:        hr.BodySize,
+		Pinned:          hr.Pinned,
+		Request:         NewRequestInfo(hr),
+		CreatedAt:       hr.CreatedAt,
+		UpdatedAt:       hr.UpdatedAt,
+	}
+}
+
+// NewRequestInfo return nil if the request is not stored
+func NewRequestInfo(hr *models.HTTPResponse) *RequestInfo {
+	if len(hr.RequestHeader) == 0 {
+		return nil
+	}
+	return &RequestInfo{
+		Header:     hr.RequestHeader,
+		BodySize:   hr.RequestBodySize,
+		BodyHash:   hr.RequestBodyHash,
+		ClientAddr: hr.ClientAddr,
+		Timings:    hr.Timings,
+	}
+}
+
+func (api *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := strings.TrimSuffix(r.URL.Path, "/")
+	authorized := api.authorized(r)
+	if authorized && p == "/metrics" && api.Metrics != nil {
+		api.Metrics.ServeHTTP(w, r)
+		return
+	}
+	var out interface{}
+	var err error
+	switch {
+	case !authorized:
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		err = errUnauthorized
+	case p == "/api/hosts" && r.Method == http.MethodGet:
+		out, err = api.listHosts()
+	case strings.HasPrefix(p, "/api/hosts/"):
+		host, action := splitHostPath(strings.TrimPrefix(p, "/api/hosts/"))
+		switch {
+		case action == "stats" && r.Method == http.MethodGet:
+			out, err = api.hostStats(host)
+		case action == "responses" && r.Method == http.MethodGet:
+			out, err = api.listResponses(host, r.URL.Query())
+		case action == "" && r.Method == http.MethodDelete:
+			out, err = api.deleteHost(host)
+		default:
+			err = errNotFound
+		}
+	case p == "/api/response" && r.Method == http.MethodGet:
+		out, err = api.getResponse(r.URL.Query())
+	case p == "/api/response/body" && r.Method == http.MethodGet:
+		err = api.getResponseBody(w, r.URL.Query())
+		if err == nil {
+			return
+		}
+	case p == "/api/response/request/body" && r.Method == http.MethodGet:
+		err = api.getRequestBody(w, r.URL.Query())
+		if err == nil {
+			return
+		}
+	case p == "/api/response" && r.Method == http.MethodDelete:
+		out, err = api.deleteResponses(r.URL.Query().Get("url"), "", r.URL.Query().Get("method"))
+	case p == "/api/responses" && r.Method == http.MethodDelete:
+		out, err = api.deleteResponses(r.URL.Query().Get("url"), r.URL.Query().Get("prefix"), r.URL.Query().Get("method"))
+	case p == "/api/response/versions" && r.Method == http.MethodGet:
+		out, err = api.listVersions(r.URL.Query())
+	case p == "/api/response/diff" && r.Method == http.MethodGet:
+		out, err = api.diffVersions(r.URL.Query())
+	case p == "/api/response/pin" && r.Method == http.MethodPost:
+		out, err = api.pinVersion(r.URL.Query())
+	case p == "/api/response/pin" && r.Method == http.MethodDelete:
+		out, err = api.unpinResponse(r.URL.Query())
+	case p == "/api/revalidations" && api.Revalidator != nil && r.Method == http.MethodGet:
+		out, err = api.listRevalidations()
+	case p == "/api/revalidations" && api.Revalidator != nil && r.Method == http.MethodDelete:
+		out, err = api.cancelRevalidations(r.URL.Query().Get("key"))
+	default:
+		err = errNotFound
+	}
+
+	status := http.StatusOK
+	var badReq *badRequestError
+	switch {
+	case err == errNotFound:
+		status = http.StatusNotFound
+	case err == errUnauthorized:
+		status = http.StatusUnauthorized
+	case errors.As(err, &badReq), errors.Is(err, dbcache.ErrAmbiguousVariant):
+		status = http.StatusBadRequest
+	case err != nil:
+		status = http.StatusInternalServerError
+		log.Error().Err(err).Str("method", r.Method).Str("url", r.URL.String()).Msg("api error")
+	}
+	if err != nil {
+		out = &apiError{Error: err.Error()}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err = json.NewEncoder(w).Encode(out); err != nil {
+		log.Warn().Err(err).Msg("api write response error")
+	}
+}
+
+// authorized return true if the request carries the Token
+func (api *API) authorized(r *http.Request) bool {
+	if api.Token == "" {
+		return true
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(api.Token)) == 1
+}
+
+func splitHostPath(p string) (host string, action string) {
+	host = p
+	if i := strings.IndexByte(p, '/'); i >= 0 {
+		host, action = p[:i], p[i+1:]
+	}
+	return
+}
+
+func (api *API) hostDB(host string) (*gorm.DB, error) {
+	if host == sqlitecache.FileDBKey || !api.Set.Has(host) {
+		return nil, errNotFound
+	}
+	return sqlitecache.OpenHostDB(api.Set, host)
+}
+
+func (api *API) urlDB(u string) (*gorm.DB, *gorm.DB, error) {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return nil, nil, badRequest(err)
+	}
+	if _, err = api.hostDB(pu.Hostname()); err != nil {
+		return nil, nil, err
+	}
+	return api.Cache.GetDB(&http.Request{URL: pu})
+}
+
+func (api *API) listHosts() (out map[string]interface{}, err error) {
+	hosts, err := sqlitecache.Hosts(api.Set)
+	if hosts == nil {
+		hosts = []string{}
+	}
+	return map[string]interface{}{"hosts": hosts}, err
+}
+
+func (api *API) hostStats(host string) (out *HostStats, err error) {
+	db, err := api.hostDB(host)
+	if err != nil {
+		return
+	}
+	stats, err := dbcache.GetStats(db)
+	if err != nil {
+		return
+	}
+	return &HostStats{Host: host, Stats: stats, Ratio: stats.Ratio()}, nil
+}
+
+func (api *API) listResponses(host string, q url.Values) (out map[string]interface{}, err error) {
+	db, err := api.hostDB(host)
+	if err != nil {
+		return
+	}
+	o := &dbcache.ListResponsesOptions{DB: db, Prefix: q.Get("prefix"), Limit: 100}
+	if v := q.Get("offset"); v != "" {
+		if o.Offset, err = strconv.Atoi(v); err != nil {
+			return nil, badRequest(errors.Wrap(err, "invalid offset"))
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if o.Limit, err = strconv.Atoi(v); err != nil {
+			return nil, badRequest(errors.Wrap(err, "invalid limit"))
+		}
+	}
+	list, err := dbcache.ListResponses(o)
+	if err != nil {
+		return
+	}
+	items := make([]*ResponseInfo, 0, len(list))
+	for _, v := range list {
+		info := NewResponseInfo(v)
+		info.Header = nil
+		items = append(items, info)
+	}
+	return map[string]interface{}{"total": o.Total, "offset": o.Offset, "items": items}, nil
+}
+
+func (api *API) findResponse(q url.Values) (hr *models.HTTPResponse, file *gorm.DB, err error) {
+	u := q.Get("url")
+	db, file, err := api.urlDB(u)
+	if err != nil {
+		return
+	}
+	hr, err = dbcache.FindResponse(db, queryMethod(q), u)
+	if err == nil && hr == nil {
+		err = errNotFound
+	}
+	return
+}
+
+func (api *API) getResponse(q url.Values) (out *ResponseInfo, err error) {
+	hr, _, err := api.findResponse(q)
+	if err != nil {
+		return
+	}
+	return NewResponseInfo(hr), nil
+}
+
+func (api *API) getResponseBody(w http.ResponseWriter, q url.Values) (err error) {
+	hr, file, err := api.findResponse(q)
+	if err != nil {
+		return
+	}
+	body, err := dbcache.OpenBody(hr, file, api.Cache.Blobs)
+	if err == dbcache.ErrBlobNotFound {
+		return errNotFound
+	}
+	if err != nil {
+		return
+	}
+	defer body.Close()
+	if hr.ContentType != "" {
+		w.Header().Set("Content-Type", hr.ContentType)
+	}
+	_, err = io.Copy(w, body)
+	if err != nil {
+		log.Warn().Err(err).Str("url", hr.URL).Msg("api write body error")
+	}
+	return nil
+}
+
+func (api *API) getRequestBody(w http.ResponseWriter, q url.Values) (err error) {
+	hr, _, err := api.findResponse(q)
+	if err != nil {
+		return
+	}
+	body, err := hr.GetRequestBody()
+	if err != nil {
+		return
+	}
+	defer body.Close()
+	header := http.Header{}
+	if len(hr.RequestHeader) > 0 {
+		_ = json.Unmarshal(hr.RequestHeader, &header)
+	}
+	if v := header.Get("Content-Type"); v != "" {
+		w.Header().Set("Content-Type", v)
+	}
+	_, err = io.Copy(w, body)
+	if err != nil {
+		log.Warn().Err(err).Str("url", hr.URL).Msg("api write request body error")
+	}
+	return nil
+}
+
+func (api *API) deleteResponses(u string, prefix string, method string) (out map[string]interface{}, err error) {
+	if u == "" && prefix == "" {
+		return nil, badRequest(errors.New("url or prefix is required"))
+	}
+	o := &dbcache.DeleteResponsesOptions{Method: method}
+	switch {
+	case u == "":
+		o.Prefix, u = prefix, prefix
+	case prefix != "":
+		// the prefix is the path prefix of the url host
+		o.PathPrefix = prefix
+	default:
+		o.URL = u
+	}
+	if o.DB, _, err = api.urlDB(u); err != nil {
+		return
+	}
+	err = dbcache.DeleteResponses(o)
+	return map[string]interface{}{"deleted": o.Deleted}, err
+}
+
+// deleteHost delete the responses of host, the db is shared with the transport so it is cleared instead of removed
+func (api *API) deleteHost(host string) (out map[string]interface{}, err error) {
+	db, err := api.hostDB(host)
+	if err != nil {
+		return
+	}
+	deleted, err := dbcache.DeleteAll(db)
+	if err != nil {
+		return
+	}
+	if err = sqlitecache.IncrementalVacuum(db); err != nil {
+		return
+	}
+	return map[string]interface{}{"host": host, "deleted": deleted}, nil
+}
+
+func (api *API) listRevalidations() (out map[string]interface{}, err error) {
+	list := api.Revalidator.List()
+	if list == nil {
+		list = []httpcache.Revalidation{}
+	}
+	return map[string]interface{}{"revalidations": list}, nil
+}
+
+// cancelRevalidations cancel the revalidation of key, all if key is empty
+func (api *API) cancelRevalidations(key string) (out map[string]interface{}, err error) {
+	if key == "" {
+		return map[string]interface{}{"canceled": api.Revalidator.CancelAll()}, nil
+	}
+	if !api.Revalidator.Cancel(key) {
+		return nil, errNotFound
+	}
+	return map[string]interface{}{"canceled": 1}, nil
+}
+
+func queryMethod(q url.Values) string {
+	if method := q.Get("method"); method != "" {
+		return method
+	}
+	return http.MethodGet
+}
+
+func queryID(q url.Values, key string) (uint, error) {
+	v := q.Get(key)
+	if v == "" {
+		return 0, nil
+	}
+	id, err := strconv.ParseUint(v, 10, 64)
+	return uint(id), badRequest(errors.Wrapf(err, "invalid %s", key))
+}
+
+// findVersion return the version of id, errNotFound if it's not a version of method and cache key
+func findVersion(db *gorm.DB, method string, key string, id uint) (v *models.HTTPResponseVersion, err error) {
+	if v, err = dbcache.FindVersion(db, id); err != nil {
+		return
+	}
+	if v == nil || v.Method != method || v.CacheKey != key {
+		return nil, errNotFound
+	}
+	return
+}
+
+// queryKey return the cache key of the queried url by KeyFunc
+func (api *API) queryKey(q url.Values) (key string, err error) {
+	req, err := http.NewRequest(queryMethod(q), q.Get("url"), nil)
+	if err != nil {
+		return "", badRequest(err)
+	}
+	if api.KeyFunc == nil {
+		return cachekey.FromRequest(req), nil
+	}
+	return api.KeyFunc(req), nil
+}
+
+// queryVaryKey return the vary query, or the vary key of the only variant
+func queryVaryKey(db *gorm.DB, q url.Values, key string) (string, error) {
+	if q.Has("vary") {
+		return q.Get("vary"), nil
+	}
+	return dbcache.OnlyVaryKey(db, queryMethod(q), key)
+}
+
+func (api *API) listVersions(q url.Values) (out map[string]interface{}, err error) {
+	db, _, err := api.urlDB(q.Get("url"))
+	if err != nil {
+		return
+	}
+	key, err := api.queryKey(q)
+	if err != nil {
+		return
+	}
+	vary, err := queryVaryKey(db, q, key)
+	if err != nil {
+		return
+	}
+	list, err := dbcache.ListVersions(db, queryMethod(q), key, vary)
+	if err != nil {
+		return
+	}
+	items := make([]*VersionInfo, 0, len(list))
+	for _, v := range list {
+		items = append(items, NewVersionInfo(v))
+	}
+	return map[string]interface{}{"items": items}, nil
+}
+
+func (api *API) diffVersions(q url.Values) (out map[string]interface{}, err error) {
+	db, file, err := api.urlDB(q.Get("url"))
+	if err != nil {
+		return
+	}
+	o := &dbcache.DiffVersionsOptions{DB: db, FileDB: file, Blobs: api.Cache.Blobs, Method: queryMethod(q)}
+	if o.Key, err = api.queryKey(q); err != nil {
+		return
+	}
+	if o.VaryKey, err = queryVaryKey(db, q, o.Key); err != nil {
+		return
+	}
+	if o.From, err = queryID(q, "from"); err != nil {
+		return
+	}
+	if o.To, err = queryID(q, "to"); err != nil {
+		return
+	}
+	for _, id := range []uint{o.From, o.To} {
+		if id == 0 {
+			continue
+		}
+		if _, err = findVersion(db, o.Method, o.Key, id); err != nil {
+			return
+		}
+	}
+	diff, err := dbcache.DiffVersions(o)
+	return map[string]interface{}{"diff": diff}, err
+}
+
+func (api *API) pinVersion(q url.Values) (out *ResponseInfo, err error) {
+	db, _, err := api.urlDB(q.Get("url"))
+	if err != nil {
+		return
+	}
+	id, err := queryID(q, "version")
+	if err != nil {
+		return
+	}
+	key, err := api.queryKey(q)
+	if err != nil {
+		return
+	}
+	if _, err = findVersion(db, queryMethod(q), key, id); err != nil {
+		return
+	}
+	hr, err := dbcache.PinVersion(db, id)
+	if err != nil {
+		return
+	}
+	return NewResponseInfo(hr), nil
+}
+
+func (api *API) unpinResponse(q url.Values) (out map[string]interface{}, err error) {
+	db, _, err := api.urlDB(q.Get("url"))
+	if err != nil {
+		return
+	}
+	key, err := api.queryKey(q)
+	if err != nil {
+		return
+	}
+	vary, err := queryVaryKey(db, q, key)
+	if err != nil {
+		return
+	}
+	return map[string]interface{}{"pinned": false}, dbcache.UnpinResponse(db, queryMethod(q), key, vary)
+}
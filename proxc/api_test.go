@@ -0,0 +1,296 @@
+package proxc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wenerme/proxc/httpcache"
+	"github.com/wenerme/proxc/httpcache/cachekey"
+	"github.com/wenerme/proxc/httpcache/dbcache/models"
+	"github.com/wenerme/proxc/httpcache/dbcache/sqlitecache"
+	"github.com/wenerme/wego/testx"
+)
+
+func TestAPI(t *testing.T) {
+	content := strings.Repeat("Hello proxc\n", 100)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = io.WriteString(w, content)
+	}))
+	defer upstream.Close()
+
+	set := &sqlitecache.Set{Dir: t.TempDir()}
+	defer set.Close()
+	cache := sqlitecache.NewSetCache(set)
+	client := httpcache.NewTransport(cache).Client()
+	for _, p := range []string{"/a/1", "/a/2", "/b/1"} {
+		resp := testx.Must(client.Get(upstream.URL + p))
+		_, _ = io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+	}
+
+	svr := httptest.NewServer(&API{Set: set, Cache: cache})
+	defer svr.Close()
+	host := testx.Must(url.Parse(upstream.URL)).Hostname()
+	call := func(method string, p string, out interface{}) int {
+		req := testx.Must(http.NewRequest(method, svr.URL+p, nil))
+		resp := testx.Must(http.DefaultClient.Do(req))
+		defer resp.Body.Close()
+		if s, ok := out.(*string); ok {
+			*s = string(testx.Must(io.ReadAll(resp.Body)))
+		} else {
+			testx.NoErr(json.NewDecoder(resp.Body).Decode(out))
+		}
+		return resp.StatusCode
+	}
+
+	var hosts struct{ Hosts []string }
+	assert.Equal(t, 200, call("GET", "/api/hosts", &hosts))
+	assert.Equal(t, []string{host}, hosts.Hosts)
+
+	var stats HostStats
+	assert.Equal(t, 200, call("GET", "/api/hosts/"+host+"/stats", &stats))
+	assert.Equal(t, int64(3), stats.Count)
+	assert.Equal(t, int64(3*len(content)), stats.RawSize)
+	assert.Greater(t, stats.Ratio, 1.0)
+
+	var list struct {
+		Total int64
+		Items []*ResponseInfo
+	}
+	assert.Equal(t, 200, call("GET", "/api/hosts/"+host+"/responses?limit=1&offset=1", &list))
+	assert.Equal(t, int64(3), list.Total)
+	assert.Equal(t, upstream.URL+"/a/2", list.Items[0].URL)
+	var apiErr apiError
+	assert.Equal(t, 400, call("GET", "/api/hosts/"+host+"/responses?limit=x", &apiErr))
+	assert.Contains(t, apiErr.Error, "invalid limit")
+	assert.Equal(t, 400, call("DELETE", "/api/responses", &apiErr))
+
+	var info ResponseInfo
+	assert.Equal(t, 200, call("GET", "/api/response?url="+url.QueryEscape(upstream.URL+"/a/1"), &info))
+	assert.Equal(t, "text/plain", info.ContentType)
+	assert.Contains(t, string(info.Header), "Content-Type")
+
+	var body string
+	assert.Equal(t, 200, call("GET", "/api/response/body?url="+url.QueryEscape(upstream.URL+"/a/1"), &body))
+	assert.Equal(t, content, body)
+
+	var deleted struct{ Deleted int64 }
+	assert.Equal(t, 200, call("DELETE", "/api/responses?prefix="+url.QueryEscape(upstream.URL+"/a/"), &deleted))
+	assert.Equal(t, int64(2), deleted.Deleted)
+	assert.Equal(t, 404, call("GET", "/api/response?url="+url.QueryEscape(upstream.URL+"/a/1"), &info))
+	assert.Equal(t, 200, call("DELETE", "/api/response?url="+url.QueryEscape(upstream.URL+"/b/1"), &deleted))
+	assert.Equal(t, int64(1), deleted.Deleted)
+
+	// the prefix is the path prefix of the url host
+	resp := testx.Must(client.Get(upstream.URL + "/a/1"))
+	_, _ = io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	assert.Equal(t, 200, call("DELETE", "/api/responses?prefix=/b/&url="+url.QueryEscape(upstream.URL), &deleted))
+	assert.Equal(t, int64(0), deleted.Deleted)
+	assert.Equal(t, 200, call("DELETE", "/api/responses?prefix=/a/&url="+url.QueryEscape(upstream.URL), &deleted))
+	assert.Equal(t, int64(1), deleted.Deleted)
+
+	// the host db used by the transport is cleared, not closed
+	resp = testx.Must(client.Get(upstream.URL + "/a/1"))
+	_, _ = io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	assert.Equal(t, 200, call("DELETE", "/api/hosts/"+host, &deleted))
+	assert.Equal(t, int64(1), deleted.Deleted)
+	assert.Equal(t, 200, call("GET", "/api/hosts/"+host+"/stats", &stats))
+	assert.Equal(t, int64(0), stats.Count)
+	resp = testx.Must(client.Get(upstream.URL + "/a/1"))
+	_, _ = io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	assert.Equal(t, 200, call("GET", "/api/hosts/"+host+"/stats", &stats))
+	assert.Equal(t, int64(1), stats.Count)
+	assert.Equal(t, 404, call("DELETE", "/api/hosts/nope", &deleted))
+	assert.Equal(t, 404, call("GET", "/api/hosts/..%2Fetc/stats", &stats))
+}
+
+func TestAPIVersions(t *testing.T) {
+	content := "v1"
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = io.WriteString(w, content+"\n")
+	}))
+	defer upstream.Close()
+
+	set := &sqlitecache.Set{Dir: t.TempDir()}
+	defer set.Close()
+	cache := sqlitecache.NewSetCache(set)
+	cache.History = true
+	tr := httpcache.NewTransport(cache)
+	tr.Mode = httpcache.ModeRecord
+	client := tr.Client()
+	for _, v := range []string{"v1", "v2"} {
+		content = v
+		resp := testx.Must(client.Get(upstream.URL))
+		_, _ = io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+	}
+
+	svr := httptest.NewServer(&API{Set: set, Cache: cache})
+	defer svr.Close()
+	call := func(method string, p string, out interface{}) int {
+		req := testx.Must(http.NewRequest(method, svr.URL+p, nil))
+		resp := testx.Must(http.DefaultClient.Do(req))
+		defer resp.Body.Close()
+		testx.NoErr(json.NewDecoder(resp.Body).Decode(out))
+		return resp.StatusCode
+	}
+	u := url.QueryEscape(upstream.URL)
+
+	var versions struct{ Items []*VersionInfo }
+	assert.Equal(t, 200, call("GET", "/api/response/versions?url="+u, &versions))
+	assert.Len(t, versions.Items, 2)
+	v1 := versions.Items[1].ID
+
+	var diff struct{ Diff string }
+	assert.Equal(t, 200, call("GET", fmt.Sprintf("/api/response/diff?url=%s&from=%d", u, v1), &diff))
+	assert.Contains(t, diff.Diff, "-v1\n+v2\n")
+	assert.Equal(t, 400, call("GET", fmt.Sprintf("/api/response/diff?url=%s&from=x", u), &diff))
+	assert.Equal(t, 404, call("GET", fmt.Sprintf("/api/response/diff?url=%s&from=%d", u, v1+100), &diff))
+
+	var info ResponseInfo
+	assert.Equal(t, 404, call("POST", fmt.Sprintf("/api/response/pin?url=%s&method=POST&version=%d", u, v1), &info))
+	assert.Equal(t, 200, call("POST", fmt.Sprintf("/api/response/pin?url=%s&version=%d", u, v1), &info))
+	assert.True(t, info.Pinned)
+	resp := testx.Must(http.Get(svr.URL + "/api/response/body?url=" + u))
+	assert.Equal(t, "v1\n", string(testx.Must(io.ReadAll(resp.Body))))
+	_ = resp.Body.Close()
+
+	assert.Equal(t, 200, call("DELETE", "/api/response/pin?url="+u, &struct{}{}))
+	var unpinned ResponseInfo
+	assert.Equal(t, 200, call("GET", "/api/response?url="+u, &unpinned))
+	assert.False(t, unpinned.Pinned)
+}
+
+func TestAPIVersionVariants(t *testing.T) {
+	content := "v1"
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Vary", "Accept")
+		_, _ = io.WriteString(w, content+" "+r.Header.Get("Accept")+"\n")
+	}))
+	defer upstream.Close()
+
+	set := &sqlitecache.Set{Dir: t.TempDir()}
+	defer set.Close()
+	cache := sqlitecache.NewSetCache(set)
+	cache.History = true
+	tr := httpcache.NewTransport(cache)
+	tr.Mode = httpcache.ModeRecord
+	tr.KeyFunc = cachekey.New(&cachekey.Options{DropParams: []string{"utm_*"}})
+	client := tr.Client()
+	for _, v := range []string{"v1", "v2"} {
+		content = v
+		for _, accept := range []string{"text/plain", "text/html"} {
+			req := testx.Must(http.NewRequest("GET", upstream.URL+"/?utm_source=a", nil))
+			req.Header.Set("Accept", accept)
+			resp := testx.Must(client.Do(req))
+			_, _ = io.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+		}
+	}
+
+	svr := httptest.NewServer(&API{Set: set, Cache: cache, KeyFunc: tr.KeyFunc})
+	defer svr.Close()
+	call := func(method string, p string, out interface{}) int {
+		req := testx.Must(http.NewRequest(method, svr.URL+p, nil))
+		resp := testx.Must(http.DefaultClient.Do(req))
+		defer resp.Body.Close()
+		testx.NoErr(json.NewDecoder(resp.Body).Decode(out))
+		return resp.StatusCode
+	}
+	// the url is resolved to the normalized key, the variant is selected by vary
+	u := url.QueryEscape(upstream.URL + "/?utm_source=b")
+	vary := url.QueryEscape(models.VaryKey(http.Header{"Vary": {"Accept"}}, http.Header{"Accept": {"text/html"}}))
+
+	var apiErr apiError
+	assert.Equal(t, 400, call("GET", "/api/response/versions?url="+u, &apiErr))
+	assert.Contains(t, apiErr.Error, "multiple variants")
+	var versions struct{ Items []*VersionInfo }
+	assert.Equal(t, 200, call("GET", "/api/response/versions?url="+u+"&vary="+vary, &versions))
+	assert.Len(t, versions.Items, 2)
+
+	var diff struct{ Diff string }
+	assert.Equal(t, 200, call("GET", fmt.Sprintf("/api/response/diff?url=%s&vary=%s&from=%d", u, vary, versions.Items[1].ID), &diff))
+	assert.Contains(t, diff.Diff, "-v1 text/html\n+v2 text/html\n")
+
+	var info ResponseInfo
+	assert.Equal(t, 200, call("POST", fmt.Sprintf("/api/response/pin?url=%s&version=%d", u, versions.Items[1].ID), &info))
+	assert.True(t, info.Pinned)
+	assert.Equal(t, 200, call("DELETE", "/api/response/pin?url="+u+"&vary="+vary, &struct{}{}))
+	db := testx.Must(sqlitecache.OpenHostDB(set, testx.Must(url.Parse(upstream.URL)).Hostname()))
+	var pinned int64
+	testx.NoErr(db.Model(&models.HTTPResponse{}).Where("pinned = ?", true).Count(&pinned).Error)
+	assert.Equal(t, int64(0), pinned)
+}
+
+func TestAPIToken(t *testing.T) {
+	set := &sqlitecache.Set{Dir: t.TempDir()}
+	defer set.Close()
+	metrics := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "metrics")
+	})
+	svr := httptest.NewServer(&API{Set: set, Cache: sqlitecache.NewSetCache(set), Metrics: metrics, Token: "secret"})
+	defer svr.Close()
+	call := func(p string, token string) *http.Response {
+		req := testx.Must(http.NewRequest("GET", svr.URL+p, nil))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp := testx.Must(http.DefaultClient.Do(req))
+		_ = resp.Body.Close()
+		return resp
+	}
+
+	for _, p := range []string{"/api/hosts", "/metrics", "/nope"} {
+		assert.Equal(t, 401, call(p, "").StatusCode, p)
+		assert.Equal(t, 401, call(p, "wrong").StatusCode, p)
+	}
+	resp := call("/api/hosts", "")
+	assert.Equal(t, "Bearer", resp.Header.Get("WWW-Authenticate"))
+	assert.Equal(t, 200, call("/api/hosts", "secret").StatusCode)
+	assert.Equal(t, 200, call("/metrics", "secret").StatusCode)
+	assert.Equal(t, 404, call("/nope", "secret").StatusCode)
+}
+
+func TestAPIRevalidations(t *testing.T) {
+	rv := httpcache.NewRevalidator(1)
+	svr := httptest.NewServer(&API{Revalidator: rv})
+	defer svr.Close()
+	call := func(method string, p string, out interface{}) int {
+		req := testx.Must(http.NewRequest(method, svr.URL+p, nil))
+		resp := testx.Must(http.DefaultClient.Do(req))
+		defer resp.Body.Close()
+		testx.NoErr(json.NewDecoder(resp.Body).Decode(out))
+		return resp.StatusCode
+	}
+
+	rv.Submit("GET https://example.com/", "https://example.com/", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	var list struct{ Revalidations []httpcache.Revalidation }
+	assert.Equal(t, 200, call("GET", "/api/revalidations", &list))
+	assert.Len(t, list.Revalidations, 1)
+	assert.Equal(t, "https://example.com/", list.Revalidations[0].URL)
+
+	var out map[string]interface{}
+	assert.Equal(t, 404, call("DELETE", "/api/revalidations?key=nope", &out))
+	assert.Equal(t, 200, call("DELETE", "/api/revalidations?key="+url.QueryEscape("GET https://example.com/"), &out))
+	assert.Equal(t, 1.0, out["canceled"])
+	rv.Wait()
+	assert.Equal(t, 200, call("GET", "/api/revalidations", &list))
+	assert.Empty(t, list.Revalidations)
+}
@@ -0,0 +1,118 @@
+package proxc
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/wenerme/proxc/httpcache/dbcache"
+	"github.com/wenerme/proxc/httpcache/dbcache/sqlitecache"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultEvictInterval is the default interval of the eviction loop
+const DefaultEvictInterval = 10 * time.Minute
+
+// EvictConf limits the cache, see dbcache.EvictOptions, zero for no limit
+type EvictConf struct {
+	MaxSize     Size          `yaml:"max_size,omitempty"`
+	MaxHostSize Size          `yaml:"max_host_size,omitempty"`
+	MaxEntries  int64         `yaml:"max_entries,omitempty"`
+	MaxAge      time.Duration `yaml:"max_age,omitempty"` // since last access
+	Policy      string        `yaml:"policy,omitempty"`  // lru or lfu, default to lru
+	// Interval of the eviction loop, default to DefaultEvictInterval
+	Interval time.Duration `yaml:"interval,omitempty"`
+}
+
+// Enabled return true if any limit is set
+func (c *EvictConf) Enabled() bool {
+	return c != nil && (c.MaxSize > 0 || c.MaxHostSize > 0 || c.MaxEntries > 0 || c.MaxAge > 0)
+}
+
+func (c *EvictConf) Init() error {
+	switch c.Policy {
+	case "", dbcache.EvictLRU, dbcache.EvictLFU:
+	default:
+		return errors.Errorf("invalid evict policy %q", c.Policy)
+	}
+	if c.Interval <= 0 {
+		c.Interval = DefaultEvictInterval
+	}
+	return nil
+}
+
+func (c *EvictConf) Options() *dbcache.EvictOptions {
+	return &dbcache.EvictOptions{
+		MaxSize:     int64(c.MaxSize),
+		MaxHostSize: int64(c.MaxHostSize),
+		MaxEntries:  c.MaxEntries,
+		MaxAge:      c.MaxAge,
+		Policy:      c.Policy,
+	}
+}
+
+// Evict run the eviction once
+func (svr *Server) Evict() (o *dbcache.EvictOptions, err error) {
+	o = svr.Conf.Evict.Options()
+	o.Blobs = svr.Cache.Blobs
+	err = sqlitecache.Evict(svr.Set, o)
+	return
+}
+
+func (svr *Server) evictLoop() {
+	for {
+		o, err := svr.Evict()
+		if err != nil {
+			log.Error().Err(err).Msg("evict error")
+		} else {
+			log.Info().Int64("evicted", o.Evicted).Int64("size", o.EvictedSize).
+				Int64("files", o.Files.Files).Int64("file_size", o.Files.Size).Msg("evict")
+		}
+		time.Sleep(svr.Conf.Evict.Interval)
+	}
+}
+
+// Size in bytes, e.g. `1024`, `512K`, `10MB`, `1GiB`, units are 1024 based
+type Size int64
+
+var sizeUnits = []string{"", "K", "M", "G", "T"}
+
+func ParseSize(s string) (Size, error) {
+	v := strings.ToUpper(strings.TrimSpace(s))
+	v = strings.TrimSuffix(strings.TrimSuffix(v, "B"), "I")
+	n := 0
+	for n < len(v) && (v[n] >= '0' && v[n] <= '9' || v[n] == '.') {
+		n++
+	}
+	f, err := strconv.ParseFloat(v[:n], 64)
+	if err != nil {
+		return 0, errors.Errorf("invalid size %q", s)
+	}
+	unit := strings.TrimSpace(v[n:])
+	for i, u := range sizeUnits {
+		if u == unit {
+			return Size(f * float64(int64(1)<<(10*i))), nil
+		}
+	}
+	return 0, errors.Errorf("invalid size %q", s)
+}
+
+func (s Size) String() string {
+	i := 0
+	for i < len(sizeUnits)-1 && s != 0 && s%(1<<10) == 0 {
+		s >>= 10
+		i++
+	}
+	return strconv.FormatInt(int64(s), 10) + sizeUnits[i]
+}
+
+func (s *Size) UnmarshalYAML(node *yaml.Node) (err error) {
+	*s, err = ParseSize(node.Value)
+	return
+}
+
+func (s Size) MarshalYAML() (interface{}, error) {
+	return s.String(), nil
+}
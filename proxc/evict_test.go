@@ -0,0 +1,52 @@
+package proxc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wenerme/wego/testx"
+	"gopkg.in/yaml.v3"
+)
+
+func TestSize(t *testing.T) {
+	for _, test := range []struct {
+		s    string
+		size Size
+	}{
+		{"1024", 1024},
+		{"512K", 512 << 10},
+		{"10MB", 10 << 20},
+		{"1GiB", 1 << 30},
+		{"1.5g", 3 << 29},
+		{"2T", 2 << 40},
+	} {
+		assert.Equal(t, test.size, testx.Must(ParseSize(test.s)), test.s)
+	}
+	for _, s := range []string{"", "G", "10X", "-"} {
+		_, err := ParseSize(s)
+		assert.Error(t, err, s)
+	}
+	assert.Equal(t, "10M", Size(10<<20).String())
+	assert.Equal(t, "1025", Size(1025).String())
+
+	conf := &ServerConf{}
+	testx.NoErr(yaml.Unmarshal([]byte(`
+evict:
+  max_size: 10G
+  max_host_size: 512M
+  max_age: 720h
+  policy: lfu
+`), conf))
+	assert.True(t, conf.Evict.Enabled())
+	testx.NoErr(conf.Evict.Init())
+	assert.Equal(t, DefaultEvictInterval, conf.Evict.Interval)
+	o := conf.Evict.Options()
+	assert.Equal(t, int64(10<<30), o.MaxSize)
+	assert.Equal(t, int64(512<<20), o.MaxHostSize)
+	assert.Equal(t, 720*time.Hour, o.MaxAge)
+	assert.Contains(t, string(testx.Must(yaml.Marshal(conf.Evict))), "max_size: 10G")
+
+	assert.Error(t, (&EvictConf{Policy: "fifo"}).Init())
+	assert.False(t, (*EvictConf)(nil).Enabled())
+}
@@ -0,0 +1,143 @@
+package proxc
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog/log"
+	"github.com/wenerme/proxc/httpcache"
+	"github.com/wenerme/proxc/httpcache/dbcache/models"
+	"github.com/wenerme/proxc/httpcache/dbcache/sqlitecache"
+)
+
+// Metrics collects the prometheus metrics of the proxy and the cache,
+// observes httpcache.Transport and dbcache.Cache
+type Metrics struct {
+	Registry *prometheus.Registry
+
+	requests *prometheus.CounterVec
+	served   *prometheus.CounterVec
+	get      *prometheus.HistogramVec
+	set      *prometheus.HistogramVec
+	ratio    *prometheus.HistogramVec
+}
+
+// NewMetrics create the metrics, the db sizes of set are collected on scrape if not nil
+func NewMetrics(set *sqlitecache.Set) *Metrics {
+	m := &Metrics{
+		Registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxc_cache_requests_total",
+			Help: "Requests by host and cache result, hit, miss, revalidated, stale-on-error or bypass.",
+		}, []string{"host", "result"}),
+		served: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxc_served_bytes_total",
+			Help: "Response body bytes served by host and source, cache or upstream.",
+		}, []string{"host", "source"}),
+		get: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "proxc_cache_get_duration_seconds",
+			Help:    "Latency of loading responses from the cache db by result, hit, miss or error.",
+			Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+		}, []string{"result"}),
+		set: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "proxc_cache_set_duration_seconds",
+			Help:    "Latency of storing responses to the cache db by result, ok or error.",
+			Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+		}, []string{"result"}),
+		ratio: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "proxc_cache_compression_ratio",
+			Help:    "Stored body size to raw size of responses stored in db by encoding.",
+			Buckets: []float64{0.1, 0.2, 0.3, 0.4, 0.5, 0.6, 0.7, 0.8, 0.9, 1},
+		}, []string{"encoding"}),
+	}
+	m.Registry.MustRegister(m.requests, m.served, m.get, m.set, m.ratio,
+		collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	if set != nil {
+		m.Registry.MustRegister(&setCollector{set: set})
+	}
+	return m
+}
+
+// Handler serves the metrics in prometheus text format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.Registry, promhttp.HandlerOpts{})
+}
+
+// Observe implements httpcache.Observer
+func (m *Metrics) Observe(e *httpcache.Event) {
+	host := e.Request.URL.Hostname()
+	switch e.Type {
+	case httpcache.EventServed:
+		source := "upstream"
+		if e.FromCache {
+			source = "cache"
+		}
+		m.served.WithLabelValues(host, source).Add(float64(e.Bytes))
+	case httpcache.EventHit, httpcache.EventMiss, httpcache.EventRevalidated, httpcache.EventStaleOnError, httpcache.EventBypass:
+		m.requests.WithLabelValues(host, e.Type).Inc()
+	}
+}
+
+// ObserveGet implements dbcache.Observer
+func (m *Metrics) ObserveGet(req *http.Request, resp *http.Response, d time.Duration, err error) {
+	result := "hit"
+	switch {
+	case err != nil:
+		result = "error"
+	case resp == nil:
+		result = "miss"
+	}
+	m.get.WithLabelValues(result).Observe(d.Seconds())
+}
+
+// ObserveSet implements dbcache.Observer
+func (m *Metrics) ObserveSet(req *http.Request, hr *models.HTTPResponse, d time.Duration, err error) {
+	if err != nil {
+		m.set.WithLabelValues("error").Observe(d.Seconds())
+		return
+	}
+	m.set.WithLabelValues("ok").Observe(d.Seconds())
+	// file content is stored as is
+	if hr != nil && hr.ContentHash == "" && hr.RawSize > 0 {
+		encoding := hr.ContentEncoding
+		if encoding == "" {
+			encoding = "identity"
+		}
+		m.ratio.WithLabelValues(encoding).Observe(float64(hr.BodySize) / float64(hr.RawSize))
+	}
+}
+
+// setCollector collects the size of db files and the number of opened dbs
+type setCollector struct {
+	set *sqlitecache.Set
+}
+
+var (
+	dbSizeDesc   = prometheus.NewDesc("proxc_db_size_bytes", "Size of the db files including the wal by key.", []string{"db"}, nil)
+	dbOpenedDesc = prometheus.NewDesc("proxc_db_opened", "Number of opened dbs.", nil, nil)
+)
+
+func (c *setCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- dbSizeDesc
+	ch <- dbOpenedDesc
+}
+
+func (c *setCollector) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(dbOpenedDesc, prometheus.GaugeValue, float64(len(c.set.Opened())))
+	keys, err := c.set.Keys()
+	if err != nil {
+		log.Warn().Err(err).Msg("list db keys error")
+		return
+	}
+	for _, key := range keys {
+		size, err := c.set.Size(key)
+		if err != nil {
+			log.Warn().Err(err).Str("db", key).Msg("db size error")
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(dbSizeDesc, prometheus.GaugeValue, float64(size), key)
+	}
+}
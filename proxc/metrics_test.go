@@ -0,0 +1,84 @@
+package proxc
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wenerme/proxc/httpcache"
+	"github.com/wenerme/proxc/httpcache/dbcache/sqlitecache"
+	"github.com/wenerme/wego/testx"
+)
+
+func TestMetrics(t *testing.T) {
+	content := strings.Repeat("Hello proxc\n", 100)
+	var errors int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		switch r.URL.Path {
+		case "/fresh":
+			w.Header().Set("Cache-Control", "max-age=3600")
+		case "/etag":
+			w.Header().Set("Cache-Control", "max-age=0")
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		case "/error":
+			w.Header().Set("Cache-Control", "max-age=0, stale-if-error=3600")
+			if atomic.AddInt32(&errors, 1) > 1 {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+		_, _ = io.WriteString(w, content)
+	}))
+	defer upstream.Close()
+
+	set := &sqlitecache.Set{Dir: t.TempDir()}
+	defer set.Close()
+	metrics := NewMetrics(set)
+	cache := sqlitecache.NewSetCache(set)
+	cache.Observer = metrics
+	tr := httpcache.NewTransport(cache)
+	tr.Observer = metrics
+	client := tr.Client()
+	for _, p := range []string{"/fresh", "/fresh", "/etag", "/etag", "/error", "/error"} {
+		resp := testx.Must(client.Get(upstream.URL + p))
+		_, _ = io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+	}
+	resp := testx.Must(client.Post(upstream.URL+"/fresh", "text/plain", nil))
+	_ = resp.Body.Close()
+
+	svr := httptest.NewServer(&API{Set: set, Cache: cache, Metrics: metrics.Handler()})
+	defer svr.Close()
+	resp = testx.Must(http.Get(svr.URL + "/metrics"))
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	out := string(testx.Must(io.ReadAll(resp.Body)))
+
+	for _, line := range []string{
+		`proxc_cache_requests_total{host="127.0.0.1",result="hit"} 1`,
+		`proxc_cache_requests_total{host="127.0.0.1",result="miss"} 3`,
+		`proxc_cache_requests_total{host="127.0.0.1",result="revalidated"} 1`,
+		`proxc_cache_requests_total{host="127.0.0.1",result="stale-on-error"} 1`,
+		`proxc_cache_requests_total{host="127.0.0.1",result="bypass"} 1`,
+		`proxc_served_bytes_total{host="127.0.0.1",source="cache"} ` + strconv.Itoa(3*len(content)),
+		`proxc_served_bytes_total{host="127.0.0.1",source="upstream"} ` + strconv.Itoa(3*len(content)),
+		`proxc_cache_get_duration_seconds_count{result="hit"} 3`,
+		`proxc_cache_get_duration_seconds_count{result="miss"} 3`,
+		`proxc_cache_set_duration_seconds_count{result="ok"}`,
+		`proxc_cache_compression_ratio_count{encoding=`,
+		`proxc_db_size_bytes{db="127.0.0.1"}`,
+		`proxc_db_opened 2`,
+	} {
+		assert.Contains(t, out, line)
+	}
+}
@@ -0,0 +1,241 @@
+package proxc
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/wenerme/proxc/httpcache"
+	"github.com/wenerme/proxc/httpcache/cachekey"
+)
+
+const (
+	// PolicyFresh always serve cached response
+	PolicyFresh = "fresh"
+	// PolicyRFC follow the Cache-Control of request and response
+	PolicyRFC = "rfc"
+	// PolicyTTL serve cached response within TTL
+	PolicyTTL = "ttl"
+	// PolicyTransparent bypass the cached response, still store the new one
+	PolicyTransparent = "transparent"
+	// PolicyStaleWhileRevalidate serve cached response within TTL, after that serve stale response within Stale and revalidate in background
+	PolicyStaleWhileRevalidate = "swr"
+)
+
+// CacheRule maps request to a cache policy, first matched rule wins.
+//
+// Host and Path are globs, `*` matches anything except `/`, `**` matches anything.
+type CacheRule struct {
+	Host   string            `yaml:"host,omitempty"`
+	Path   string            `yaml:"path,omitempty"`
+	Regex  string            `yaml:"regex,omitempty"` // match against full url
+	Policy string            `yaml:"policy,omitempty"`
+	TTL    time.Duration     `yaml:"ttl,omitempty"`
+	Stale  time.Duration     `yaml:"stale,omitempty"`  // stale window for swr, zero means no limit
+	Header map[string]string `yaml:"header,omitempty"` // override response header, empty value to delete
+	// Methods are cacheable methods besides GET and HEAD, e.g. POST, the request body is part of the key
+	Methods []string `yaml:"methods,omitempty"`
+	// Body canonicalize the request body of Methods for the key, raw, json or graphql, default to raw
+	Body string `yaml:"body,omitempty"`
+
+	host  *regexp.Regexp
+	path  *regexp.Regexp
+	regex *regexp.Regexp
+}
+
+func (r *CacheRule) Init() (err error) {
+	switch r.Policy {
+	case "":
+		r.Policy = PolicyRFC
+	case PolicyFresh, PolicyRFC, PolicyTTL, PolicyTransparent, PolicyStaleWhileRevalidate:
+	default:
+		return errors.Errorf("invalid cache policy %q", r.Policy)
+	}
+	switch r.Body {
+	case "", cachekey.BodyRaw, cachekey.BodyJSON, cachekey.BodyGraphQL:
+	default:
+		return errors.Errorf("invalid rule body %q", r.Body)
+	}
+	for i, v := range r.Methods {
+		r.Methods[i] = strings.ToUpper(v)
+	}
+	if r.Host != "" {
+		r.host = globRegexp(strings.ToLower(r.Host))
+	}
+	if r.Path != "" {
+		r.path = globRegexp(r.Path)
+	}
+	if r.Regex != "" {
+		r.regex, err = regexp.Compile(r.Regex)
+		if err != nil {
+			return errors.Wrapf(err, "invalid rule regex %q", r.Regex)
+		}
+	}
+	return
+}
+
+func (r *CacheRule) Match(req *http.Request) bool {
+	u := req.URL
+	if r.host != nil && !r.host.MatchString(strings.ToLower(u.Hostname())) {
+		return false
+	}
+	if r.path != nil && !r.path.MatchString(u.Path) {
+		return false
+	}
+	if r.regex != nil && !r.regex.MatchString(u.String()) {
+		return false
+	}
+	return true
+}
+
+// GetFreshness return httpcache freshness of the cached response
+func (r *CacheRule) GetFreshness(req *http.Request, resp *http.Response) int {
+	switch r.Policy {
+	case PolicyFresh:
+		return httpcache.Fresh
+	case PolicyTransparent:
+		return httpcache.Transparent
+	case PolicyTTL, PolicyStaleWhileRevalidate:
+		age, err := httpcache.CurrentAge(resp.Header)
+		if err != nil {
+			return httpcache.Stale
+		}
+		if age < r.TTL {
+			return httpcache.Fresh
+		}
+		if r.Policy == PolicyStaleWhileRevalidate && (r.Stale == 0 || age < r.TTL+r.Stale) {
+			return httpcache.StaleWhileRevalidate
+		}
+		return httpcache.Stale
+	default:
+		return httpcache.GetFreshness(req, resp)
+	}
+}
+
+// Cacheable return true if the method of req is one of Methods
+func (r *CacheRule) Cacheable(req *http.Request) bool {
+	for _, v := range r.Methods {
+		if v == req.Method {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *CacheRule) OverrideHeader(h http.Header) {
+	for k, v := range r.Header {
+		if v == "" {
+			h.Del(k)
+		} else {
+			h.Set(k, v)
+		}
+	}
+}
+
+// CacheRules is an ordered rule list
+type CacheRules struct {
+	Rules []*CacheRule
+	// Default is used when no rule matched
+	Default *CacheRule
+	// RFCFreshness is the freshness of the rfc policy, default to httpcache.GetFreshness,
+	// e.g. httpcache.Transport.RFCFreshness to honour the shared cache and the heuristic freshness
+	RFCFreshness func(req *http.Request, resp *http.Response) int
+}
+
+func NewCacheRules(rules []*CacheRule, policy string) (*CacheRules, error) {
+	out := &CacheRules{Rules: rules, Default: &CacheRule{Policy: policy}}
+	for _, v := range append(rules, out.Default) {
+		if err := v.Init(); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func (rs *CacheRules) Match(req *http.Request) *CacheRule {
+	for _, v := range rs.Rules {
+		if v.Match(req) {
+			return v
+		}
+	}
+	return rs.Default
+}
+
+func (rs *CacheRules) GetFreshness(req *http.Request, resp *http.Response) int {
+	r := rs.Match(req)
+	if r.Policy == PolicyRFC && rs.RFCFreshness != nil {
+		return rs.RFCFreshness(req, resp)
+	}
+	return r.GetFreshness(req, resp)
+}
+
+func (rs *CacheRules) Cacheable(req *http.Request) bool {
+	return rs.Match(req).Cacheable(req)
+}
+
+// KeyFunc return the cachekey.Func of o, the canonicalized request body of cacheable methods is part of the key,
+// the Body of the matched rule overrides o.Body, o is optional
+func (rs *CacheRules) KeyFunc(o *cachekey.Options) cachekey.Func {
+	return func(req *http.Request) string {
+		r := rs.Match(req)
+		if !r.Cacheable(req) {
+			if o == nil {
+				return cachekey.FromRequest(req)
+			}
+			return o.Key(req)
+		}
+		var ko cachekey.Options
+		if o != nil {
+			ko = *o
+		}
+		switch {
+		case r.Body != "":
+			ko.Body = r.Body
+		case ko.Body == "":
+			ko.Body = cachekey.BodyRaw
+		}
+		return ko.Key(req)
+	}
+}
+
+// Transport wrap next http.RoundTripper to apply header override of matched rule
+func (rs *CacheRules) Transport(next http.RoundTripper) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		resp, err := next.RoundTrip(req)
+		if err == nil {
+			rs.Match(req).OverrideHeader(resp.Header)
+		}
+		return resp, err
+	})
+}
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// globRegexp convert glob to regexp, `*` matches anything except `/`, `**` matches anything
+func globRegexp(glob string) *regexp.Regexp {
+	sb := strings.Builder{}
+	sb.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				sb.WriteString(".*")
+				i++
+			} else {
+				sb.WriteString("[^/]*")
+			}
+		case '?':
+			sb.WriteString("[^/]")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	sb.WriteString("$")
+	return regexp.MustCompile(sb.String())
+}
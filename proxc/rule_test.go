@@ -0,0 +1,143 @@
+package proxc
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wenerme/proxc/httpcache"
+	"github.com/wenerme/proxc/httpcache/cachekey"
+	"github.com/wenerme/wego/testx"
+	"gopkg.in/yaml.v3"
+)
+
+func TestCacheRules(t *testing.T) {
+	var conf ServerConf
+	testx.NoErr(yaml.Unmarshal([]byte(`
+rules:
+  - host: "*.debian.org"
+    policy: fresh
+  - host: api.example.com
+    path: /v1/**
+    policy: ttl
+    ttl: 1h
+  - regex: ^https://example\.com/live
+    policy: swr
+    ttl: 1m
+    stale: 1h
+    header:
+      Cache-Control: max-age=60
+      Set-Cookie: ""
+`), &conf))
+	rules := testx.Must(NewCacheRules(conf.Rules, PolicyRFC))
+
+	newResp := func(age time.Duration) *http.Response {
+		return &http.Response{Header: http.Header{
+			"Date": []string{time.Now().Add(-age).UTC().Format(time.RFC1123)},
+		}}
+	}
+	for _, test := range []struct {
+		url       string
+		age       time.Duration
+		freshness int
+	}{
+		{"https://deb.debian.org/debian/dists/stable/Release", 24 * time.Hour, httpcache.Fresh},
+		{"https://api.example.com/v1/users/1", time.Minute, httpcache.Fresh},
+		{"https://api.example.com/v1/users/1", 2 * time.Hour, httpcache.Stale},
+		{"https://api.example.com/v2/users", 0, httpcache.Stale},
+		{"https://example.com/live/a", 0, httpcache.Fresh},
+		{"https://example.com/live/a", 10 * time.Minute, httpcache.StaleWhileRevalidate},
+		{"https://example.com/live/a", 2 * time.Hour, httpcache.Stale},
+	} {
+		req := testx.Must(http.NewRequest("GET", test.url, nil))
+		assert.Equal(t, test.freshness, rules.GetFreshness(req, newResp(test.age)), test.url)
+	}
+
+	// the age by the stored times and the Age header
+	req := testx.Must(http.NewRequest("GET", "https://api.example.com/v1/users/1", nil))
+	resp := &http.Response{Header: http.Header{
+		httpcache.XCacheRequestTime:  []string{time.Now().Add(-time.Minute).UTC().Format(time.RFC3339Nano)},
+		httpcache.XCacheResponseTime: []string{time.Now().Add(-time.Minute).UTC().Format(time.RFC3339Nano)},
+	}}
+	assert.Equal(t, httpcache.Fresh, rules.GetFreshness(req, resp))
+	resp.Header.Set("Age", "7200")
+	assert.Equal(t, httpcache.Stale, rules.GetFreshness(req, resp))
+
+	req = testx.Must(http.NewRequest("GET", "https://example.com/live", nil))
+	h := http.Header{"Set-Cookie": []string{"a=b"}}
+	rules.Match(req).OverrideHeader(h)
+	assert.Equal(t, http.Header{"Cache-Control": []string{"max-age=60"}}, h)
+
+	_, err := NewCacheRules([]*CacheRule{{Policy: "forever"}}, PolicyRFC)
+	assert.Error(t, err)
+}
+
+func TestCacheRulesHeuristic(t *testing.T) {
+	var conf ServerConf
+	testx.NoErr(yaml.Unmarshal([]byte(`
+rules:
+  - host: api.example.com
+    policy: ttl
+    ttl: 1s
+heuristic:
+  fraction: 0.2
+  max_age: 1h
+  header:
+    X-Heuristic: ["1"]
+`), &conf))
+	assert.Equal(t, &httpcache.Heuristic{Fraction: 0.2, MaxAge: time.Hour, Header: http.Header{"X-Heuristic": {"1"}}}, conf.Heuristic)
+	rules := testx.Must(NewCacheRules(conf.Rules, PolicyRFC))
+	rules.RFCFreshness = conf.Heuristic.GetFreshness
+
+	newResp := func() *http.Response {
+		now := time.Now().UTC()
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{
+			"Date":          []string{now.Add(-time.Minute).Format(http.TimeFormat)},
+			"Last-Modified": []string{now.Add(-24 * time.Hour).Format(http.TimeFormat)},
+		}}
+	}
+	req := testx.Must(http.NewRequest("GET", "https://example.com/a", nil))
+	resp := newResp()
+	assert.Equal(t, httpcache.Fresh, rules.GetFreshness(req, resp))
+	assert.Equal(t, "1", resp.Header.Get("X-Heuristic"))
+	req = testx.Must(http.NewRequest("GET", "https://api.example.com/a", nil))
+	assert.Equal(t, httpcache.Stale, rules.GetFreshness(req, newResp()))
+}
+
+func TestCacheRulesMethods(t *testing.T) {
+	rules := testx.Must(NewCacheRules([]*CacheRule{
+		{Host: "api.example.com", Path: "/graphql", Methods: []string{"post"}, Body: cachekey.BodyGraphQL},
+		{Host: "api.example.com", Path: "/search", Methods: []string{"POST"}},
+	}, PolicyRFC))
+	key := rules.KeyFunc(nil)
+	newReq := func(url string, body string) *http.Request {
+		return testx.Must(http.NewRequest("POST", url, strings.NewReader(body)))
+	}
+
+	req := newReq("https://api.example.com/graphql", `{"query":"{ a }"}`)
+	assert.True(t, rules.Cacheable(req))
+	assert.Equal(t, key(req), key(newReq("https://api.example.com/graphql", `{"query":"{\n  a\n}"}`)))
+	assert.True(t, strings.HasPrefix(key(req), "https://api.example.com/graphql\noperation=\nbody="))
+
+	req = newReq("https://api.example.com/search", `{"q":"a"}`)
+	assert.True(t, rules.Cacheable(req))
+	assert.NotEqual(t, key(req), key(newReq("https://api.example.com/search", `{"q":"b"}`)))
+
+	req = newReq("https://api.example.com/users", `{}`)
+	assert.False(t, rules.Cacheable(req))
+	assert.Equal(t, "https://api.example.com/users", key(req))
+
+	// the body is keyed once, by the rule over the key options
+	key = rules.KeyFunc(&cachekey.Options{Body: cachekey.BodyJSON, BodyHash: true})
+	req = newReq("https://api.example.com/graphql", `{"query":"{ a }"}`)
+	assert.True(t, strings.HasPrefix(key(req), "https://api.example.com/graphql\noperation=\nbody="))
+	assert.Equal(t, 1, strings.Count(key(req), "\nbody="))
+	req = newReq("https://api.example.com/search", `{"q":"a"}`)
+	assert.Equal(t, key(req), key(newReq("https://api.example.com/search", `{ "q": "a" }`)))
+	assert.Equal(t, 1, strings.Count(key(req), "\nbody="))
+
+	_, err := NewCacheRules([]*CacheRule{{Methods: []string{"POST"}, Body: "xml"}}, PolicyRFC)
+	assert.Error(t, err)
+}
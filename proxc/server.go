@@ -1,14 +1,22 @@
 package proxc
 
 import (
+	"net"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/lqqyt2423/go-mitmproxy/addon"
 	"github.com/lqqyt2423/go-mitmproxy/addon/web"
+	"github.com/lqqyt2423/go-mitmproxy/flow"
 	"github.com/lqqyt2423/go-mitmproxy/proxy"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
 	"github.com/wenerme/proxc/httpcache"
+	"github.com/wenerme/proxc/httpcache/cachekey"
+	"github.com/wenerme/proxc/httpcache/dbcache"
 	"github.com/wenerme/proxc/httpcache/dbcache/sqlitecache"
+	"github.com/wenerme/proxc/httpcache/reqtrace"
 	"github.com/wenerme/wego/confs"
 )
 
@@ -18,6 +26,67 @@ type ServerConf struct {
 	Addr          string
 	CaRootPath    string `yaml:"ca_root_path"`
 	DBDir         string `yaml:"db_dir"`
+	// BlobDir stores the file content, default to `<db_dir>/blobs`
+	BlobDir string `yaml:"blob_dir,omitempty"`
+	// Policy is the default cache policy when no rule matched
+	Policy string       `yaml:"policy"`
+	Rules  []*CacheRule `yaml:"rules,omitempty"`
+	// APIAddr serves the cache management API, same as WebAddr to replace the web interface, the omitted host binds to loopback unless APIToken is set
+	APIAddr string `yaml:"api_addr,omitempty"`
+	// APIToken is the bearer token required by the API, optional
+	APIToken string `yaml:"api_token,omitempty"`
+	// Mode of the transport, replay to serve only from cache, record to always refresh the cache and keep previous versions
+	Mode string `yaml:"mode,omitempty"`
+	// MissStatus is the status code of replay mode cache miss, default to 504
+	MissStatus int `yaml:"miss_status,omitempty"`
+	// History records every distinct response as a version
+	History bool `yaml:"history,omitempty"`
+	// Key normalizes the cache key, default to the url
+	Key *cachekey.Options `yaml:"key,omitempty"`
+	// RedactHeaders are the request headers redacted before storing, default to Authorization, Proxy-Authorization and Cookie
+	RedactHeaders []string `yaml:"redact_headers,omitempty"`
+	// RevalidateConcurrency is the max number of background revalidations, default to httpcache.DefaultRevalidateConcurrency
+	RevalidateConcurrency int `yaml:"revalidate_concurrency,omitempty"`
+	// Evict limits the cache size and age, checked periodically
+	Evict *EvictConf `yaml:"evict,omitempty"`
+	// Heuristic freshness of the rfc policy responses without explicit expiration time, disabled if nil
+	Heuristic *httpcache.Heuristic `yaml:"heuristic,omitempty"`
+	// Shared works as a shared cache, honours s-maxage, private and Authorization, sets Age on cached responses
+	Shared bool `yaml:"shared,omitempty"`
+}
+
+// CacheRules return the rules of conf, the default policy is PolicyFresh
+func (conf *ServerConf) CacheRules() (*CacheRules, error) {
+	policy := conf.Policy
+	if policy == "" {
+		policy = PolicyFresh
+	}
+	return NewCacheRules(conf.Rules, policy)
+}
+
+// KeyFunc return the cache key func of the transport, to resolve the url to the stored key
+func (conf *ServerConf) KeyFunc() (cachekey.Func, error) {
+	rules, err := conf.CacheRules()
+	if err != nil {
+		return nil, err
+	}
+	return rules.KeyFunc(conf.Key), nil
+}
+
+// GetAPIAddr return the listen address of the API, the omitted host binds to loopback unless APIToken is set
+func (conf *ServerConf) GetAPIAddr() string {
+	host, port, err := net.SplitHostPort(conf.APIAddr)
+	if err != nil || host != "" || conf.APIToken != "" {
+		return conf.APIAddr
+	}
+	return net.JoinHostPort("127.0.0.1", port)
+}
+
+func (conf *ServerConf) GetBlobDir() string {
+	if conf.BlobDir != "" {
+		return conf.BlobDir
+	}
+	return sqlitecache.BlobDir(conf.DBDir)
 }
 
 func NewServer(o *ServerConf) *Server {
@@ -29,10 +98,20 @@ func NewServer(o *ServerConf) *Server {
 type Server struct {
 	Proxy *proxy.Proxy
 	Conf  *ServerConf
+	Set   *sqlitecache.Set
+	Cache *dbcache.Cache
+	API   *API
+	// Metrics of the proxy and the cache, served at /metrics of the API
+	Metrics *Metrics
 }
 
 func (svr *Server) Init() (err error) {
 	conf := svr.Conf
+	switch conf.Mode {
+	case httpcache.ModeDefault, httpcache.ModeReplay, httpcache.ModeRecord:
+	default:
+		return errors.Errorf("invalid mode %q", conf.Mode)
+	}
 	opts := &proxy.Options{
 		Addr:              conf.Addr,
 		StreamLargeBodies: 1024 * 1024 * 5,
@@ -45,25 +124,77 @@ func (svr *Server) Init() (err error) {
 	}
 
 	p.AddAddon(&addon.Log{})
-	p.AddAddon(web.NewWebAddon(conf.WebAddr))
+	p.AddAddon(&clientAddrAddon{})
+	if conf.APIAddr != conf.WebAddr {
+		p.AddAddon(web.NewWebAddon(conf.WebAddr))
+	}
 
 	err = os.MkdirAll(conf.DBDir, 0o777)
 	if err != nil {
 		return
 	}
 
-	cache := sqlitecache.NewSQLiteCache(conf.DBDir)
-	tr := httpcache.NewTransport(cache)
-	tr.Transport = p.Client.Transport
-	tr.GetFreshness = func(req *http.Request, resp *http.Response) int {
-		return httpcache.Fresh
+	if conf.Evict != nil {
+		if err = conf.Evict.Init(); err != nil {
+			return
+		}
 	}
+
+	rules, err := conf.CacheRules()
+	if err != nil {
+		return
+	}
+
+	svr.Set = &sqlitecache.Set{Dir: conf.DBDir}
+	cache := sqlitecache.NewSetCache(svr.Set)
+	cache.Blobs = &dbcache.FSBlobStore{Dir: conf.GetBlobDir()}
+	cache.KeepPrevious = conf.Mode == httpcache.ModeRecord
+	cache.History = conf.History
+	cache.RedactHeaders = conf.RedactHeaders
+	svr.Metrics = NewMetrics(svr.Set)
+	cache.Observer = svr.Metrics
+	tr := httpcache.NewTransport(cache)
+	tr.Observer = svr.Metrics
+	tr.Transport = rules.Transport(p.Client.Transport)
+	tr.Heuristic = conf.Heuristic
+	tr.Shared = conf.Shared
+	rules.RFCFreshness = tr.RFCFreshness
+	tr.GetFreshness = rules.GetFreshness
+	tr.Mode = conf.Mode
+	tr.ReplayMissStatus = conf.MissStatus
+	tr.KeyFunc = rules.KeyFunc(conf.Key)
+	tr.Cacheable = rules.Cacheable
+	tr.Revalidator = httpcache.NewRevalidator(conf.RevalidateConcurrency)
 	p.Client.Transport = tr
 
 	svr.Proxy = p
+	svr.Cache = cache
+	svr.API = &API{Set: svr.Set, Cache: cache, KeyFunc: tr.KeyFunc, Revalidator: tr.Revalidator, Metrics: svr.Metrics.Handler(), Token: conf.APIToken}
 	return
 }
 
+// clientAddrAddon pass the client address to the cache by reqtrace.XClientAddr
+type clientAddrAddon struct {
+	addon.Base
+}
+
+func (*clientAddrAddon) Requestheaders(f *flow.Flow) {
+	if raw := f.Request.Raw(); raw != nil {
+		f.Request.Header.Set(reqtrace.XClientAddr, raw.RemoteAddr)
+	}
+}
+
 func (svr *Server) Start() (err error) {
+	if addr := svr.Conf.GetAPIAddr(); addr != "" {
+		go func() {
+			log.Info().Str("addr", addr).Msg("api server start")
+			hs := &http.Server{Addr: addr, Handler: svr.API, ReadHeaderTimeout: 10 * time.Second}
+			log.Error().Err(hs.ListenAndServe()).Msg("api server stopped")
+		}()
+	}
+	// replay never deletes
+	if svr.Conf.Evict.Enabled() && svr.Conf.Mode != httpcache.ModeReplay {
+		go svr.evictLoop()
+	}
 	return svr.Proxy.Start()
 }
@@ -4,6 +4,8 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestServer(t *testing.T) {
@@ -18,3 +20,20 @@ func TestServer(t *testing.T) {
 		t.Fatal("Init failed")
 	}
 }
+
+func TestServerConfGetAPIAddr(t *testing.T) {
+	for _, test := range []struct {
+		addr  string
+		token string
+		want  string
+	}{
+		{":9082", "", "127.0.0.1:9082"},
+		{":9082", "secret", ":9082"},
+		{"0.0.0.0:9082", "", "0.0.0.0:9082"},
+		{"[::1]:9082", "", "[::1]:9082"},
+		{"", "", ""},
+	} {
+		conf := &ServerConf{APIAddr: test.addr, APIToken: test.token}
+		assert.Equal(t, test.want, conf.GetAPIAddr(), test.addr)
+	}
+}